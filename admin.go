@@ -0,0 +1,335 @@
+package dnsredir
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An admin HTTP endpoint, which exports a JSON snapshot of plugin state, and drains upstream hosts on demand
+// Multiple server blocks may share the same admin address, which the listener is reference counted
+type adminServer struct {
+	ln        net.Listener
+	srv       *http.Server
+	instances map[*Dnsredir]struct{}
+}
+
+var (
+	adminMu      sync.Mutex
+	adminServers = make(map[string]*adminServer)
+)
+
+func registerAdmin(addr string, r *Dnsredir) error {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	if s, ok := adminServers[addr]; ok {
+		s.instances[r] = struct{}{}
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s := &adminServer{
+		ln:        ln,
+		instances: map[*Dnsredir]struct{}{r: {}},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminPathStatus, s.handleStatus)
+	mux.HandleFunc(adminPathDrain, s.handleDrain)
+	mux.HandleFunc(adminPathUndrain, s.handleDrain)
+	mux.HandleFunc(adminPathPolicy, s.handlePolicy)
+	mux.HandleFunc(adminPathConfig, s.handleConfig)
+	s.srv = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+	adminServers[addr] = s
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("admin: %v", err)
+		}
+	}()
+	log.Infof("admin: listening on %v", ln.Addr())
+	return nil
+}
+
+func unregisterAdmin(addr string, r *Dnsredir) error {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	s, ok := adminServers[addr]
+	if !ok {
+		return nil
+	}
+	delete(s.instances, r)
+	if len(s.instances) != 0 {
+		return nil
+	}
+	delete(adminServers, addr)
+	return s.srv.Close()
+}
+
+// Return registered instances in a stable order
+func (s *adminServer) sortedInstances() []*Dnsredir {
+	adminMu.Lock()
+	instances := make([]*Dnsredir, 0, len(s.instances))
+	for r := range s.instances {
+		instances = append(instances, r)
+	}
+	adminMu.Unlock()
+
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].serverBlock < instances[j].serverBlock
+	})
+	return instances
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", mimeTypeJson)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Warningf("admin: %v", err)
+	}
+}
+
+type hostStatus struct {
+	Name           string     `json:"name"`
+	Fails          int32      `json:"fails"`
+	Down           bool       `json:"down"`
+	Draining       bool       `json:"draining,omitempty"`
+	Inflight       int32      `json:"inflight,omitempty"`
+	LastCheck      *time.Time `json:"last_check,omitempty"`
+	LastCheckRtt   string     `json:"last_check_rtt,omitempty"`
+	LastCheckError string     `json:"last_check_error,omitempty"`
+	CheckBackoff   string     `json:"check_backoff,omitempty"`
+	Breaker        string     `json:"breaker,omitempty"`
+	Srv            string     `json:"srv,omitempty"`
+	Priority       uint16     `json:"priority,omitempty"`
+	Weight         uint16     `json:"weight,omitempty"`
+	// Last exchange errors from the oldest to the newest, see: errorHistory
+	Errors []exchangeError `json:"errors,omitempty"`
+}
+
+type nameItemStatus struct {
+	Source string            `json:"source"`
+	Names  uint64            `json:"names"`
+	Tags   map[string]uint64 `json:"tags,omitempty"`
+}
+
+type upstreamStatus struct {
+	From        []string                    `json:"from"`
+	Policy      string                      `json:"policy"`
+	Spray       bool                        `json:"spray"`
+	MaxFails    int32                       `json:"max_fails"`
+	Names       []nameItemStatus            `json:"names,omitempty"`
+	Inline      uint64                      `json:"inline"`
+	Except      uint64                      `json:"except"`
+	Transforms  []string                    `json:"transforms,omitempty"`
+	MatchTiming map[string]matchPhaseStatus `json:"match_timing,omitempty"`
+	Hosts       []hostStatus                `json:"hosts"`
+}
+
+type instanceStatus struct {
+	Server    string           `json:"server"`
+	Upstreams []upstreamStatus `json:"upstreams"`
+}
+
+func (uh *UpstreamHost) status() hostStatus {
+	st := hostStatus{
+		Name:     uh.Name(),
+		Fails:    atomic.LoadInt32(&uh.fails),
+		Down:     uh.down(),
+		Draining: uh.drained(),
+		Inflight: atomic.LoadInt32(&uh.inflight),
+		Srv:      uh.srvName,
+		Priority: uh.priority,
+		Weight:   uh.weight,
+		Errors:   uh.errors.snapshot(),
+	}
+	if res, ok := uh.lastCheck.Load().(checkResult); ok {
+		st.LastCheck = &res.time
+		st.LastCheckRtt = res.rtt.String()
+		st.LastCheckError = res.err
+	}
+	if backoff := atomic.LoadInt64(&uh.checkBackoff); backoff != 0 {
+		st.CheckBackoff = time.Duration(backoff).String()
+	}
+	if uh.breaker != nil {
+		st.Breaker = uh.breaker.String()
+	}
+	return st
+}
+
+func (u *reloadableUpstream) status() upstreamStatus {
+	st := upstreamStatus{
+		Policy:   policyName(u.loadPolicy()),
+		Spray:    u.spray != nil,
+		MaxFails: u.maxFails,
+		Inline:   u.inline.Len(),
+		Except:   u.ignored.Len(),
+	}
+	// Credentials are redacted as /config does
+	for _, from := range u.from {
+		st.From = append(st.From, redactSource(from))
+	}
+	for _, item := range u.items {
+		names := item.loadNames()
+		item.RLock()
+		tags := item.tags
+		item.RUnlock()
+		st.Names = append(st.Names, nameItemStatus{
+			Source: item.redactedSource(),
+			Names:  names.Len(),
+			Tags:   tags,
+		})
+	}
+	for _, t := range u.transforms {
+		st.Transforms = append(st.Transforms, t.Name())
+	}
+	st.MatchTiming = u.matchTiming.status()
+	for _, host := range u.loadHosts() {
+		st.Hosts = append(st.Hosts, host.status())
+	}
+	return st
+}
+
+func policyName(p Policy) string {
+	if p == nil {
+		// see: HealthCheck.Select()
+		return "random"
+	}
+	if s, ok := p.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", p)
+}
+
+func (s *adminServer) handleStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var instances []instanceStatus
+	for _, r := range s.sortedInstances() {
+		st := instanceStatus{Server: r.serverBlock}
+		for _, up := range *r.Upstreams {
+			st.Upstreams = append(st.Upstreams, up.(*reloadableUpstream).status())
+		}
+		instances = append(instances, st)
+	}
+	writeJson(w, instances)
+}
+
+// Mark hosts given by `host' form value(either name or address, e.g. "udp://1.1.1.1:53" or "1.1.1.1:53") as draining
+//	or undraining, across all instances and upstreams. Drain state persists until undrained or CoreDNS restarts.
+func (s *adminServer) handleDrain(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	name := req.FormValue("host")
+	if name == "" {
+		http.Error(w, "missing host", http.StatusBadRequest)
+		return
+	}
+
+	draining := req.URL.Path == adminPathDrain
+	hosts := make([]string, 0)
+	for _, r := range s.sortedInstances() {
+		for _, up := range *r.Upstreams {
+			for _, host := range up.(*reloadableUpstream).loadHosts() {
+				if host.Name() == name || host.addr == name {
+					host.setDraining(draining)
+					hosts = append(hosts, host.Name())
+				}
+			}
+		}
+	}
+	if len(hosts) == 0 {
+		http.Error(w, fmt.Sprintf("host %q not found", name), http.StatusNotFound)
+		return
+	}
+	log.Infof("admin: %v draining: %v", hosts, draining)
+	writeJson(w, map[string]interface{}{
+		"hosts":    hosts,
+		"draining": draining,
+	})
+}
+
+// Swap selection policy of upstreams to the one given by `policy' form value(optionally with `random_start'), across
+//	all instances. Only upstreams whose `from' contains the `upstream' form value are swapped if given.
+func (s *adminServer) handlePolicy(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	name := req.FormValue("policy")
+	policy, ok := SupportedPolicies[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown policy %q", name), http.StatusBadRequest)
+		return
+	}
+	randomStart := req.FormValue("random_start") != ""
+	if randomStart {
+		if _, ok := newRandomStartPolicy(name); !ok {
+			http.Error(w, fmt.Sprintf("%q has no initial selection to randomize", name), http.StatusBadRequest)
+			return
+		}
+	}
+	from := req.FormValue("upstream")
+
+	upstreams := make([][]string, 0)
+	for _, r := range s.sortedInstances() {
+		for _, up := range *r.Upstreams {
+			u := up.(*reloadableUpstream)
+			if from != "" && !containsString(u.from, from) {
+				continue
+			}
+			p := policy
+			if randomStart {
+				// Each upstream has its own state, rather than the shared one in SupportedPolicies
+				p, _ = newRandomStartPolicy(name)
+			}
+			u.setPolicy(p)
+			upstreams = append(upstreams, u.from)
+		}
+	}
+	if len(upstreams) == 0 {
+		http.Error(w, fmt.Sprintf("upstream %q not found", from), http.StatusNotFound)
+		return
+	}
+	log.Infof("admin: %v policy: %v random_start: %v", upstreams, name, randomStart)
+	writeJson(w, map[string]interface{}{
+		"upstreams":    upstreams,
+		"policy":       name,
+		"random_start": randomStart,
+	})
+}
+
+func containsString(arr []string, s string) bool {
+	for _, v := range arr {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	adminPathStatus  = "/status"
+	adminPathDrain   = "/drain"
+	adminPathUndrain = "/undrain"
+	adminPathPolicy  = "/policy"
+	adminPathConfig  = "/config"
+)
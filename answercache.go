@@ -0,0 +1,128 @@
+package dnsredir
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Answers shouldn't be cached longer than an hour regardless of record TTLs, so changes propagate eventually
+	maxAnswerCacheTtl = time.Hour
+	// Maximum number of answers cached per upstream
+	maxAnswerCache = 4096
+)
+
+// Replies for queries with different DO or CD bits may differ, see: cd_bit
+type answerKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+}
+
+type answerEntry struct {
+	reply  *dns.Msg
+	stored time.Time
+}
+
+// A bounded cache of answers of an upstream, each answer is cached for at least minTtl regardless of record TTLs
+// So a fragile upstream is protected from re-query storms of short-TTL records.
+type answerCache struct {
+	minTtl time.Duration
+
+	sync.Mutex
+	// Values are answerEntry
+	entries *expiringLru
+}
+
+func newAnswerCache(minTtl time.Duration) *answerCache {
+	return &answerCache{
+		minTtl:  minTtl,
+		entries: newExpiringLru(maxAnswerCache),
+	}
+}
+
+func newAnswerKey(state *request.Request) answerKey {
+	return answerKey{
+		name:   strings.ToLower(state.QName()),
+		qtype:  state.QType(),
+		qclass: state.QClass(),
+		do:     state.Do(),
+		cd:     state.Req.CheckingDisabled,
+	}
+}
+
+// Return the minimal TTL of answer and authority records, zero if there's none
+func minRecordTtl(reply *dns.Msg) time.Duration {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns} {
+		for _, rr := range section {
+			if t := rr.Header().Ttl; !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// Cache the reply as seen by the client, the least recently used answer is evicted if the cache is full
+// Only NOERROR and NXDOMAIN replies are cached, truncated replies aren't. nil cache caches nothing
+func (c *answerCache) add(state *request.Request, reply *dns.Msg, now time.Time) {
+	if c == nil || reply.Truncated || (reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError) {
+		return
+	}
+	ttl := minRecordTtl(reply)
+	if ttl < c.minTtl {
+		ttl = c.minTtl
+	}
+	if ttl > maxAnswerCacheTtl {
+		ttl = maxAnswerCacheTtl
+	}
+
+	// The reply is still processed afterwards, e.g. by reply modifiers
+	cached := reply.Copy()
+	// OPT of the requester(e.g. COOKIE, ECS options, buffer size) is specific to it, see: get()
+	stripOpt(cached)
+
+	c.Lock()
+	defer c.Unlock()
+	c.entries.add(newAnswerKey(state), answerEntry{reply: cached, stored: now}, now.Add(ttl))
+}
+
+// Return a copy of the cached answer replying the request, nil if not cached or expired
+// Record TTLs are decreased by time elapsed since cached, down to zero once outlived, thus downstream caches
+//	don't cache the answer longer than the upstream intended, while requests are still replied from the cache.
+func (c *answerCache) get(state *request.Request, now time.Time) *dns.Msg {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	v, ok := c.entries.get(newAnswerKey(state), now)
+	c.Unlock()
+	if !ok {
+		return nil
+	}
+	entry := v.(answerEntry)
+
+	reply := entry.reply.Copy()
+	// A minimal OPT for the request, without options of whoever first asked
+	if opt := state.Req.IsEdns0(); opt != nil {
+		reply.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	reply.Id = state.Req.Id
+	reply.Question = append([]dns.Question(nil), state.Req.Question...)
+	reply.RecursionDesired = state.Req.RecursionDesired
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	rewriteTTLs(reply, func(rr dns.RR) uint32 {
+		if ttl := rr.Header().Ttl; ttl > elapsed {
+			return ttl - elapsed
+		}
+		return 0
+	})
+	return reply
+}
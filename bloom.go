@@ -0,0 +1,115 @@
+package dnsredir
+
+import (
+	"math"
+	"strings"
+)
+
+// An immutable Bloom filter of domain names, built once per name list parse thus lookups are lock-free
+// It answers "definitely not in the set" for most non-matching names, without touching the domain set.
+type bloomFilter struct {
+	bits []uint64
+	m    uint64 // Number of bits
+	k    uint64 // Number of hash functions
+}
+
+// Allocate a Bloom filter for `n' names with the false positive rate `p'
+//	see: https://en.wikipedia.org/wiki/Bloom_filter#Optimal_number_of_hash_functions
+func newBloomFilter(n uint64, p float64) *bloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	// Round up to multiple of 64
+	m = (m + 63) / 64 * 64
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits: make([]uint64, m/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// Build a Bloom filter of all names in the domain set
+func newBloomFilterFromSet(names domainSet, p float64) *bloomFilter {
+	b := newBloomFilter(names.Len(), p)
+	_ = names.ForEachDomain(func(name string) error {
+		b.add(name)
+		return nil
+	})
+	return b
+}
+
+// FNV-1a 64-bit hash without allocation, see: stringHash()
+func fnv64a(s string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= prime64
+	}
+	return h
+}
+
+// Derive k hash values from two halves of a single hash
+//	see: Kirsch, Mitzenmacher. Less hashing, same performance: building a better Bloom filter
+func (b *bloomFilter) locations(s string, f func(i uint64) bool) bool {
+	h := fnv64a(s)
+	h1, h2 := h&0xffffffff, h>>32
+	for i := uint64(0); i < b.k; i++ {
+		if !f((h1 + i*h2) % b.m) {
+			return false
+		}
+	}
+	return true
+}
+
+// MT-Unsafe
+func (b *bloomFilter) add(s string) {
+	b.locations(s, func(i uint64) bool {
+		b.bits[i/64] |= 1 << (i % 64)
+		return true
+	})
+}
+
+// Return false if `s' is definitely not in the set, true if it may be in the set
+func (b *bloomFilter) mayContain(s string) bool {
+	return b.locations(s, func(i uint64) bool {
+		return b.bits[i/64]&(1<<(i%64)) != 0
+	})
+}
+
+// Size in bytes
+func (b *bloomFilter) size() uint64 {
+	return uint64(len(b.bits)) * 8
+}
+
+// Assume `child' is lower cased and without trailing dot
+// Equivalent to domainSet.Match(), each suffix of `child' is looked up in the domain set only if it may be in the filter
+// There're only exact lookups, which are recorded into `m'(if any), see: domainSet.matchTimed()
+func (d *domainSet) matchBloom(child string, b *bloomFilter, m *matchTiming) bool {
+	if len(child) == 0 {
+		panic("Why child is an empty string?!")
+	}
+	t := m.start()
+	defer func() { m.observe(matchPhaseExact, t) }()
+	for {
+		if b.mayContain(child) {
+			s := (*d)[domainToIndex(child)]
+			if s.Contains(child) {
+				return true
+			}
+		}
+		i := strings.IndexByte(child, '.')
+		if i <= 0 {
+			return false
+		}
+		child = child[i+1:]
+	}
+}
@@ -0,0 +1,131 @@
+package dnsredir
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStateNames = [...]string{"closed", "open", "half-open"}
+
+// A per-host circuit breaker, which replaces the fails/max_fails ejection once enabled
+// 	closed: exchanges are allowed, opens after `threshold' consecutive failures
+// 	open: exchanges are rejected, becomes half-open after `cooldown'
+// 	half-open: a single trial exchange is allowed, closes if it succeeded, reopens otherwise
+type circuitBreaker struct {
+	sync.Mutex
+	name      string // Host name, used for logging and metrics
+	threshold int32
+	cooldown  time.Duration
+
+	state    int
+	failures int32 // Consecutive failures
+	openedAt time.Time
+	trial    bool      // Whether the half-open trial exchange is in flight
+	trialAt  time.Time // When the trial exchange started
+}
+
+func newCircuitBreaker(name string, threshold int32, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+	CircuitBreakerState.WithLabelValues(name).Set(breakerClosed)
+	return b
+}
+
+// Caller should hold the lock
+func (b *circuitBreaker) setState(state int) {
+	if b.state == state {
+		return
+	}
+	log.Infof("Circuit breaker of %v: %v -> %v", b.name, breakerStateNames[b.state], breakerStateNames[state])
+	b.state = state
+	b.trial = false
+	if state == breakerOpen {
+		b.openedAt = time.Now()
+	}
+	CircuitBreakerState.WithLabelValues(b.name).Set(float64(state))
+}
+
+// Return current state, open breaker becomes half-open lazily once cooled down
+// Caller should hold the lock
+func (b *circuitBreaker) current() int {
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		b.setState(breakerHalfOpen)
+	}
+	if b.trial && time.Since(b.trialAt) >= b.cooldown {
+		// Trial exchange result never reported, allow another one
+		b.trial = false
+	}
+	return b.state
+}
+
+// Whether the host should be considered as down
+func (b *circuitBreaker) down() bool {
+	b.Lock()
+	defer b.Unlock()
+	state := b.current()
+	return state == breakerOpen || (state == breakerHalfOpen && b.trial)
+}
+
+// Return true if an exchange is allowed, the half-open trial exchange will be taken if so
+// nil breaker always allows
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	switch b.current() {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		if !b.trial {
+			b.trial = true
+			b.trialAt = time.Now()
+			return true
+		}
+	}
+	return false
+}
+
+func (b *circuitBreaker) success() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.failures = 0
+	b.setState(breakerClosed)
+}
+
+func (b *circuitBreaker) failure() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.current() == breakerHalfOpen {
+		// Trial exchange failed
+		b.setState(breakerOpen)
+		return
+	}
+	b.failures++
+	if b.state == breakerClosed && b.failures >= b.threshold {
+		b.failures = 0
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return breakerStateNames[b.current()]
+}
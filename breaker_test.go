@@ -0,0 +1,82 @@
+package dnsredir
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	coretest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker("test", 3, time.Hour)
+
+	b.failure()
+	b.failure()
+	if b.down() || !b.allow() {
+		t.Fatalf("Breaker shouldn't open before reaching threshold")
+	}
+	b.success()
+	b.failure()
+	b.failure()
+	if b.down() {
+		t.Fatalf("Failures should be consecutive, success resets them")
+	}
+	b.failure()
+	if !b.down() || b.allow() {
+		t.Fatalf("Breaker should open after threshold reached, got %v", b)
+	}
+
+	// Cool down
+	b.openedAt = time.Now().Add(-time.Hour)
+	if b.down() || b.String() != "half-open" {
+		t.Fatalf("Breaker should become half-open after cooldown, got %v", b)
+	}
+	if !b.allow() {
+		t.Fatalf("Half-open breaker should allow a trial exchange")
+	}
+	if b.allow() || !b.down() {
+		t.Fatalf("Half-open breaker should allow only a single trial exchange")
+	}
+	b.failure()
+	if b.String() != "open" {
+		t.Fatalf("Breaker should reopen if trial exchange failed, got %v", b)
+	}
+
+	b.openedAt = time.Now().Add(-time.Hour)
+	if !b.allow() {
+		t.Fatalf("Half-open breaker should allow a trial exchange")
+	}
+	b.success()
+	if b.String() != "closed" || b.down() {
+		t.Fatalf("Breaker should close if trial exchange succeeded, got %v", b)
+	}
+
+	var nilBreaker *circuitBreaker
+	if !nilBreaker.allow() {
+		t.Fatalf("Disabled breaker should always allow")
+	}
+	nilBreaker.failure()
+	nilBreaker.success()
+}
+
+func TestCircuitBreakerSpray(t *testing.T) {
+	r := newTestDnsredir(t, "dnsredir . {\n circuit_breaker 1 1m\n spray\n to 127.0.0.1:1 127.0.0.1:2\n}")
+	u := (*r.Upstreams)[0].(*reloadableUpstream)
+	for _, host := range u.hosts {
+		host.breaker.failure()
+	}
+
+	// Sprayed to hosts whose breakers refuse, rather than spinning until the deadline
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	rcode, err := r.ServeDNS(context.Background(), dnstest.NewRecorder(&coretest.ResponseWriter{}), req)
+	if rcode != dns.RcodeServerFailure || err != errBreakerOpen {
+		t.Fatalf("Expected SERVFAIL with %v, got rcode: %v err: %v", errBreakerOpen, rcode, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected no spin on open breakers, took %v", elapsed)
+	}
+}
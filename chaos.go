@@ -0,0 +1,108 @@
+package dnsredir
+
+import (
+	"context"
+	"fmt"
+	"github.com/coredns/caddy"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Fault injection for resilience testing, never enable it in production
+// It can only be enabled when environment variable chaosEnvKey is set to "1"
+type chaos struct {
+	delay        time.Duration
+	delayPercent float64
+	failPercent  float64
+}
+
+const chaosEnvKey = "DNSREDIR_ENABLE_CHAOS"
+
+const (
+	chaosTypeDelay = "delay"
+	chaosTypeFail  = "fail"
+)
+
+func parseChaos(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	if os.Getenv(chaosEnvKey) != "1" {
+		return c.Errf("%v: fault injection is for testing only, set environment variable %v=1 to enable it", dir, chaosEnvKey)
+	}
+	if u.chaos == nil {
+		u.chaos = &chaos{}
+	}
+
+	args := c.RemainingArgs()
+	switch dir {
+	case "chaos_delay":
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		dur, err := parseDuration0(dir, args[0])
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		percent, err := parsePercent(dir, args[1])
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		u.chaos.delay = dur
+		u.chaos.delayPercent = percent
+	case "chaos_fail":
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		percent, err := parsePercent(dir, args[0])
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		u.chaos.failPercent = percent
+	default:
+		panic("Unexpected chaos directive " + dir)
+	}
+	log.Warningf("%v: %v (fault injection enabled, DO NOT use it in production)", dir, args)
+	return nil
+}
+
+func hitPercent(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// Inject faults before an exchange, return true if the exchange should fail
+func (c *chaos) inject(ctx context.Context, server, to string) bool {
+	if c == nil {
+		return false
+	}
+
+	if c.delay > 0 && hitPercent(c.delayPercent) {
+		ChaosFaultCount.WithLabelValues(server, to, chaosTypeDelay).Inc()
+		select {
+		case <-time.After(c.delay):
+		case <-ctx.Done():
+		}
+	}
+
+	if hitPercent(c.failPercent) {
+		ChaosFaultCount.WithLabelValues(server, to, chaosTypeFail).Inc()
+		return true
+	}
+	return false
+}
+
+// Parse a percentage in range [0, 100], `%' suffix is optional
+func parsePercent(dir, arg string) (float64, error) {
+	s := arg
+	if n := len(s); n > 0 && s[n-1] == '%' {
+		s = s[:n-1]
+	}
+	percent, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("%v: percentage %v out of range [0, 100]", dir, arg)
+	}
+	return percent, nil
+}
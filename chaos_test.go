@@ -0,0 +1,129 @@
+package dnsredir
+
+import (
+	"context"
+	"fmt"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	coretest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParsePercent(t *testing.T) {
+	tests := []struct {
+		input    string
+		shouldOk bool
+		expected float64
+	}{
+		{"0", true, 0},
+		{"50%", true, 50},
+		{"12.5", true, 12.5},
+		{"100%", true, 100},
+		{"101", false, 0},
+		{"-1%", false, 0},
+		{"%", false, 0},
+		{"foo", false, 0},
+	}
+	for i, test := range tests {
+		percent, err := parsePercent("chaos_fail", test.input)
+		if (err == nil) != test.shouldOk || (err == nil && percent != test.expected) {
+			t.Errorf("Test#%v failed  %q expected %v %v, got %v %v", i, test.input, test.shouldOk, test.expected, percent, err)
+		}
+	}
+}
+
+func TestChaosGated(t *testing.T) {
+	_ = os.Unsetenv(chaosEnvKey)
+	for _, input := range []string{
+		"dnsredir . {\n chaos_fail 10\n to 1.1.1.1\n}",
+		"dnsredir . {\n chaos_delay 1s 10\n to 1.1.1.1\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := newReloadableUpstream(c); err == nil {
+			t.Errorf("Expected fault injection refused without %v, input: %q", chaosEnvKey, input)
+		}
+	}
+}
+
+func TestChaosInject(t *testing.T) {
+	_ = os.Setenv(chaosEnvKey, "1")
+	defer func() { _ = os.Unsetenv(chaosEnvKey) }()
+
+	var queries int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Qtype != dns.TypeNS {
+			// Health checks aren't counted
+			atomic.AddInt32(&queries, 1)
+			m.Answer = []dns.RR{coretest.A(req.Question[0].Name + " 60 IN A 192.0.2.1")}
+		}
+		_ = w.WriteMsg(m)
+	})
+	defer s.Close()
+
+	tests := []struct {
+		option   string
+		rcode    int
+		err      error
+		minDelay time.Duration
+		queries  int32
+		// Number of injected faults
+		faults float64
+	}{
+		{"chaos_fail 100%", dns.RcodeServerFailure, errChaosFault, 0, 0, 1},
+		{"chaos_fail 0", dns.RcodeSuccess, nil, 0, 1, 0},
+		{"chaos_delay 100ms 100", dns.RcodeSuccess, nil, 100 * time.Millisecond, 1, 1},
+	}
+	for i, test := range tests {
+		input := fmt.Sprintf("dnsredir . {\n %v\n to %v\n}", test.option, s.Addr)
+		r := newTestDnsredir(t, input)
+		u := (*r.Upstreams)[0].(*reloadableUpstream)
+		u.HealthCheck.Start()
+		host := u.hosts[0]
+
+		faults := testutil.ToFloat64(ChaosFaultCount.WithLabelValues("", host.Name(), chaosTypeFail)) +
+			testutil.ToFloat64(ChaosFaultCount.WithLabelValues("", host.Name(), chaosTypeDelay))
+		atomic.StoreInt32(&queries, 0)
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+		start := time.Now()
+		rcode, err := r.ServeDNS(context.Background(), rec, req)
+		elapsed := time.Since(start)
+		u.HealthCheck.Stop()
+
+		if rcode != test.rcode || err != test.err {
+			t.Errorf("Test#%v %q expected rcode: %v err: %v, got %v %v", i, test.option, test.rcode, test.err, rcode, err)
+		}
+		if elapsed < test.minDelay {
+			t.Errorf("Test#%v %q expected delay of at least %v, took %v", i, test.option, test.minDelay, elapsed)
+		}
+		if n := atomic.LoadInt32(&queries); n != test.queries {
+			t.Errorf("Test#%v %q expected %v upstream queries, got %v", i, test.option, test.queries, n)
+		}
+		n := testutil.ToFloat64(ChaosFaultCount.WithLabelValues("", host.Name(), chaosTypeFail)) +
+			testutil.ToFloat64(ChaosFaultCount.WithLabelValues("", host.Name(), chaosTypeDelay)) - faults
+		if n != test.faults {
+			t.Errorf("Test#%v %q expected %v faults counted, got %v", i, test.option, test.faults, n)
+		}
+	}
+}
+
+func TestChaosDelayCancelled(t *testing.T) {
+	c := &chaos{delay: time.Hour, delayPercent: 100}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if c.inject(ctx, "", "test") {
+		t.Fatalf("Expected no failure injected")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected delay cut short by cancelled context, took %v", elapsed)
+	}
+}
@@ -0,0 +1,187 @@
+package dnsredir
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Effective configuration exported by the admin endpoint, for auditing of templated Corefiles
+// Secrets(e.g. URL credentials, Redis passwords, TLS client keys) are redacted, see: redactSource()
+type hostConfig struct {
+	Name          string `json:"name"`
+	TlsServerName string `json:"tls_server_name,omitempty"`
+	// Key pair itself is never exported
+	TlsClientCert bool   `json:"tls_client_cert,omitempty"`
+	Srv           string `json:"srv,omitempty"`
+	Priority      uint16 `json:"priority,omitempty"`
+	Weight        uint16 `json:"weight,omitempty"`
+	// Transport fallback chain after the host itself, see: UpstreamHost.chain()
+	Fallbacks []string `json:"fallbacks,omitempty"`
+}
+
+type upstreamConfig struct {
+	From               []string     `json:"from"`
+	Policy             string       `json:"policy"`
+	Spray              bool         `json:"spray"`
+	MaxFails           int32        `json:"max_fails"`
+	HealthCheck        string       `json:"health_check"`
+	HealthCheckTimeout string       `json:"health_check_timeout"`
+	Timeout            string       `json:"timeout,omitempty"`
+	MaxQueryTime       string       `json:"max_query_time,omitempty"`
+	Bootstrap          []string     `json:"bootstrap,omitempty"`
+	Expire             string       `json:"expire"`
+	DialTimeout        string       `json:"dial_timeout,omitempty"`
+	PathReload         string       `json:"path_reload"`
+	UrlReload          string       `json:"url_reload"`
+	UrlReadTimeout     string       `json:"url_read_timeout"`
+	Sources            []string     `json:"sources,omitempty"`
+	SrvNames           []string     `json:"srv_names,omitempty"`
+	Transforms         []string     `json:"transforms,omitempty"`
+	Features           []string     `json:"features,omitempty"`
+	Hosts              []hostConfig `json:"hosts"`
+}
+
+type instanceConfig struct {
+	Server        string           `json:"server"`
+	MaxConcurrent int32            `json:"max_concurrent,omitempty"`
+	Upstreams     []upstreamConfig `json:"upstreams"`
+}
+
+const redacted = "xxxxx"
+
+// Redact password and query values of URL sources, e.g. access tokens, other sources are returned as-is
+func redactSource(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for k := range q {
+			q[k] = []string{redacted}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// Return path or URL of the name item with credentials redacted, see: redactSource()
+func (item *NameItem) redactedSource() string {
+	if item.redis != nil {
+		return item.redis.String()
+	}
+	if item.whichType != NameItemTypePath {
+		return redactSource(item.url)
+	}
+	return item.path
+}
+
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func (uh *UpstreamHost) config() hostConfig {
+	c := hostConfig{
+		Name:     uh.Name(),
+		Srv:      uh.srvName,
+		Priority: uh.priority,
+		Weight:   uh.weight,
+	}
+	if cfg := uh.transport.tlsConfig; cfg != nil {
+		c.TlsServerName = cfg.ServerName
+		c.TlsClientCert = len(cfg.Certificates) != 0
+	}
+	for _, fallback := range uh.fallbacks {
+		c.Fallbacks = append(c.Fallbacks, fallback.Name())
+	}
+	return c
+}
+
+// Return names of enabled directives which take no value worth exporting
+func (u *reloadableUpstream) features() []string {
+	var features []string
+	for name, enabled := range map[string]bool{
+		"loop_detect":        u.loopDetect,
+		"tcp_fallback":       u.tcpFallback,
+		"lenient_match":      u.lenientMatch,
+		"normalize_question": u.normalizeQuestion,
+		"strict_names":       u.strictNames,
+		"sanitize_response":  u.sanitize,
+		"dryrun":             u.dryrun,
+		"prefetch_alternate": u.prefetchSem != nil,
+		"servfail_ttl":       u.servfailCache != nil,
+		"cache_min_ttl":      u.answerCache != nil,
+		"ratelimit":          u.rateLimit != nil,
+		"chaos":              u.chaos != nil,
+		"override":           u.overrides != nil,
+		"delegate":           u.delegations != nil,
+		"forward_edns":       u.forwardEdns != nil,
+		"trace":              u.trace != 0,
+		"circuit_breaker":    u.breakerThreshold != 0,
+		"admin":              u.adminAddr != "",
+	} {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+func (u *reloadableUpstream) config() upstreamConfig {
+	c := upstreamConfig{
+		Policy:             policyName(u.loadPolicy()),
+		Spray:              u.spray != nil,
+		MaxFails:           u.maxFails,
+		HealthCheck:        u.checkInterval.String(),
+		HealthCheckTimeout: u.checkTimeout.String(),
+		Timeout:            durationString(u.timeout),
+		MaxQueryTime:       durationString(u.maxQueryTime),
+		Bootstrap:          u.bootstrap,
+		Expire:             u.transport.expire.String(),
+		DialTimeout:        durationString(u.transport.fixedDialTimeout),
+		PathReload:         u.pathReload.String(),
+		UrlReload:          u.urlReload.String(),
+		UrlReadTimeout:     u.urlReadTimeout.String(),
+		SrvNames:           u.srvNames,
+		Features:           u.features(),
+	}
+	for _, from := range u.from {
+		c.From = append(c.From, redactSource(from))
+	}
+	for _, item := range u.items {
+		c.Sources = append(c.Sources, item.redactedSource())
+	}
+	for _, t := range u.transforms {
+		c.Transforms = append(c.Transforms, t.Name())
+	}
+	for _, host := range u.loadHosts() {
+		c.Hosts = append(c.Hosts, host.config())
+	}
+	return c
+}
+
+func (s *adminServer) handleConfig(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var instances []instanceConfig
+	for _, r := range s.sortedInstances() {
+		c := instanceConfig{Server: r.serverBlock, MaxConcurrent: r.maxConcurrent}
+		for _, up := range *r.Upstreams {
+			c.Upstreams = append(c.Upstreams, up.(*reloadableUpstream).config())
+		}
+		instances = append(instances, c)
+	}
+	writeJson(w, instances)
+}
@@ -0,0 +1,120 @@
+package dnsredir
+
+import (
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// NS records(with glue if any) of locally delegated zones, keyed by lower cased FQDN of the zone, see: delegate
+type delegationSet map[string]*delegation
+
+type delegation struct {
+	ns   []dns.RR
+	glue []dns.RR
+}
+
+// Syntax: delegate NAME NSNAME[@IP]...
+func parseDelegate(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return c.ArgErr()
+	}
+
+	zone := strings.ToLower(dns.Fqdn(args[0]))
+	if _, ok := dns.IsDomainName(zone); !ok {
+		return c.Errf("%v: %q isn't a domain name", dir, args[0])
+	}
+	if u.delegations == nil {
+		u.delegations = make(delegationSet)
+	}
+	d := u.delegations[zone]
+	if d == nil {
+		d = &delegation{}
+		u.delegations[zone] = d
+	}
+	// TTL is filled at reply time, see: delegateReply()
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET}
+	}
+	for _, arg := range args[1:] {
+		nsName, ipStr := SplitByByte(arg, '@')
+		nsName = strings.ToLower(dns.Fqdn(nsName))
+		if _, ok := dns.IsDomainName(nsName); !ok || nsName == "." {
+			return c.Errf("%v: %q isn't a name server name", dir, arg)
+		}
+		if !containsNs(d.ns, nsName) {
+			d.ns = append(d.ns, &dns.NS{Hdr: hdr(zone, dns.TypeNS), Ns: nsName})
+		}
+		if ipStr == "" {
+			continue
+		}
+		ip := net.ParseIP(ipStr[1:])
+		if ip == nil {
+			return c.Errf("%v: %q isn't an IP address", dir, ipStr[1:])
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			d.glue = append(d.glue, &dns.A{Hdr: hdr(nsName, dns.TypeA), A: ip4})
+		} else {
+			d.glue = append(d.glue, &dns.AAAA{Hdr: hdr(nsName, dns.TypeAAAA), AAAA: ip})
+		}
+	}
+	log.Infof("%v: %v %v", dir, zone, args[1:])
+	return nil
+}
+
+func containsNs(rrs []dns.RR, name string) bool {
+	for _, rr := range rrs {
+		if rr.(*dns.NS).Ns == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the closest delegated zone enclosing the name, i.e. longest match
+func (s delegationSet) lookup(name string) (string, *delegation) {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if d, ok := s[name[off:]]; ok {
+			return name[off:], d
+		}
+	}
+	return "", nil
+}
+
+// Return a referral to name servers of the delegated zone enclosing the query name, nil if the request should be forwarded
+// NS records go to authority section, glue(if any) to additional section, see: https://tools.ietf.org/html/rfc1034#section-4.3.2
+// DS records of the zone itself belong to the parent side, thus they're referred by the parent if delegated, forwarded otherwise.
+func (u *reloadableUpstream) delegateReply(state *request.Request) *dns.Msg {
+	if state.QClass() != dns.ClassINET {
+		return nil
+	}
+	qname := strings.ToLower(state.QName())
+	zone, d := u.delegations.lookup(qname)
+	if d != nil && qname == zone && state.QType() == dns.TypeDS {
+		d = nil
+		if off, end := dns.NextLabel(qname, 0); !end {
+			_, d = u.delegations.lookup(qname[off:])
+		}
+	}
+	if d == nil {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	for _, rr := range d.ns {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = u.overrideTTL
+		m.Ns = append(m.Ns, rr)
+	}
+	for _, rr := range d.glue {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = u.overrideTTL
+		m.Extra = append(m.Extra, rr)
+	}
+	return m
+}
@@ -13,7 +13,9 @@ import (
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	"net"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -24,6 +26,32 @@ type Dnsredir struct {
 	Next plugin.Handler
 
 	Upstreams *[]Upstream
+
+	// Server block keys, e.g. ".:53"
+	serverBlock string
+	// Admin HTTP endpoint addresses(if any)
+	adminAddrs []string
+	// Merged CHAOS names of all upstreams(if any), see: reloadableUpstream.chaosNames
+	chaosNames map[string]string
+
+	// Maximum in-flight upstream exchanges across all upstreams, zero if unlimited
+	maxConcurrent int32
+	// Drop requests silently rather than reply SERVFAIL once maxConcurrent reached
+	maxConcurrentDrop bool
+	inflight          int32
+
+	// Action taken on overlapping names across upstreams at startup, see: overlapIgnore
+	overlap int
+	// Refuse looped back queries, true if any upstream enabled loop_detect
+	loopDetect bool
+	// Per-query trace mode, zero if disabled, see: traceAll
+	trace int
+	// Route names to the matched upstream of the most specific name, rather than the first matched one,
+	//	true if any upstream enabled match longest
+	matchLongest bool
+	// Opcodes allowed before routing, nil if any opcode is allowed, see: reloadableUpstream.opcodes
+	opcodes     map[int]struct{}
+	opcodeRcode int
 }
 
 // Upstream manages a pool of proxy upstream hosts
@@ -33,6 +61,8 @@ type Upstream interface {
 	Match(name string) bool
 	// Select an upstream host to be routed to, nil if no available host
 	Select() *UpstreamHost
+	// Check if all upstream hosts are down
+	AllDown() bool
 
 	// Exchanger returns the exchanger to be used for this upstream
 	//Exchanger() interface{}
@@ -49,10 +79,23 @@ func (r *Dnsredir) OnStartup() error {
 			return err
 		}
 	}
+	if err := r.checkOverlaps(); err != nil {
+		return err
+	}
+	for _, addr := range r.adminAddrs {
+		if err := registerAdmin(addr, r); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (r *Dnsredir) OnShutdown() error {
+	for _, addr := range r.adminAddrs {
+		if err := unregisterAdmin(addr, r); err != nil {
+			log.Warningf("admin: %v", err)
+		}
+	}
 	for _, up := range *r.Upstreams {
 		if err := up.Stop(); err != nil {
 			return err
@@ -61,62 +104,317 @@ func (r *Dnsredir) OnShutdown() error {
 	return nil
 }
 
-func (r *Dnsredir) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) (int, error) {
+// ClientIPKey is the context key of the real client IP(a net.IP value), which takes precedence over the peer address
+// A frontend aware of PROXY protocol(or alike) placed before dnsredir in the plugin chain can set it,
+//	so client-aware features(e.g. client_affinity) see the real client rather than the load balancer.
+type ClientIPKey struct{}
+
+// Return the real client IP placed in the context if any, peer IP of the request otherwise
+func clientIP(ctx context.Context, state *request.Request) string {
+	if ip, ok := ctx.Value(ClientIPKey{}).(net.IP); ok && ip != nil {
+		return ip.String()
+	}
+	return state.IP()
+}
+
+func (r *Dnsredir) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) (rcode int, err error) {
 	state := &request.Request{W: w, Req: req}
+	if tr := r.newTrace(state); tr != nil {
+		tw := &traceWriter{ResponseWriter: w, trace: tr}
+		defer func() {
+			if !tw.written && tr.reply && !plugin.ClientWrite(rcode) {
+				// Write the failure ourselves, so the trace is carried
+				writeRcode(tw, req, rcode)
+				rcode = dns.RcodeSuccess
+			}
+			tr.finish(state, rcode, err, tw.written)
+		}()
+		w = tw
+		state.W = w
+		return r.serveDNS(ctx, w, state, tr)
+	}
+	return r.serveDNS(ctx, w, state, nil)
+}
+
+func (r *Dnsredir) serveDNS(ctx context.Context, w dns.ResponseWriter, state *request.Request, tr *queryTrace) (int, error) {
+	req := state.Req
+	if reply := r.opcodeReply(state); reply != nil {
+		tr.addf("opcode %v not allowed", dns.OpcodeToString[req.Opcode])
+		_ = w.WriteMsg(reply)
+		return dns.RcodeSuccess, nil
+	}
+	if reply := r.chaosReply(state); reply != nil {
+		_ = w.WriteMsg(reply)
+		return dns.RcodeSuccess, nil
+	}
 	name := state.Name()
 
 	server := metrics.WithServer(ctx)
-	upstream0, t := r.match(server, name)
+	if r.loopDetect && isLooped(req) {
+		log.Warningf("Forwarding loop detected  qname: %v qtype: %v client: %v, check the upstream hosts",
+			state.QName(), state.Type(), state.RemoteAddr())
+		LoopCount.WithLabelValues(server).Inc()
+		tr.addf("forwarding loop detected")
+		writeRcode(w, req, dns.RcodeRefused)
+		return dns.RcodeSuccess, nil
+	}
+
+	upstream0, unready, t := r.route(server, name, state, tr)
 	if upstream0 == nil {
 		log.Debugf("%q not found in name list, t: %v", name, t)
+		tr.addf("no upstream matched, pass to next plugin")
 		return plugin.NextOrFailure(r.Name(), r.Next, ctx, w, req)
 	}
 	upstream := upstream0.(*reloadableUpstream)
+	if unready {
+		log.Debugf("Name lists of upstream %v aren't ready, reply %q with %v",
+			upstream.from, name, dns.RcodeToString[upstream.onUnready])
+		UnreadyCount.WithLabelValues(server).Inc()
+		tr.addf("upstream %v not ready, on_unready: %v", upstream.from, dns.RcodeToString[upstream.onUnready])
+		writeRcode(w, req, upstream.onUnready)
+		return dns.RcodeSuccess, nil
+	}
 	log.Debugf("%q in name list, t: %v", name, t)
 
+	if reply := upstream.localReply(server, state); reply != nil {
+		tr.addf("replied locally")
+		_ = w.WriteMsg(reply)
+		return dns.RcodeSuccess, nil
+	}
+
+	client := clientIP(ctx, state)
+	if reply := upstream.rateLimitReply(server, client, state); reply != nil {
+		tr.addf("client %v rate limited", client)
+		_ = w.WriteMsg(reply)
+		return dns.RcodeSuccess, nil
+	}
+
+	if upstream.servfailCache.contains(state, time.Now()) {
+		log.Debugf("Cached resolution failure  qname: %v qtype: %v", state.QName(), state.Type())
+		ServfailCacheHitCount.WithLabelValues(server).Inc()
+		tr.addf("cached resolution failure")
+		writeRcode(w, state.Req, dns.RcodeServerFailure)
+		return dns.RcodeSuccess, nil
+	}
+
+	if reply := upstream.answerCache.get(state, time.Now()); reply != nil {
+		log.Debugf("Cached answer  qname: %v qtype: %v", state.QName(), state.Type())
+		AnswerCacheHitCount.WithLabelValues(server).Inc()
+		tr.addf("cached answer")
+		upstream.transformReply(state, reply)
+		_ = w.WriteMsg(reply)
+		return dns.RcodeSuccess, nil
+	}
+
+	if !r.acquire(server) {
+		log.Debugf("Too many in-flight requests, max: %v, qname: %v", r.maxConcurrent, state.QName())
+		tr.addf("too many in-flight requests, max: %v drop: %v", r.maxConcurrent, r.maxConcurrentDrop)
+		if !r.maxConcurrentDrop {
+			writeRcode(w, state.Req, dns.RcodeServerFailure)
+		}
+		return dns.RcodeSuccess, nil
+	}
+	defer r.release(server)
+
+	// Query sent to upstream hosts, which may differ from the client's
+	ustate := upstream.prepareRequest(state)
+
 	var reply *dns.Msg
 	var upstreamErr error
+	// Number of replies rejected though hosts responded, e.g. by unhealthy_answer, see: allRejected()
+	rejected := 0
+	// Number of selected hosts whose circuit breaker refused the exchange
+	refused := 0
 	deadline := time.Now().Add(defaultTimeout)
+	if upstream.maxQueryTime != 0 {
+		// Bound all retries, connects and exchanges, rather than the long default loop deadline only
+		deadline = time.Now().Add(upstream.maxQueryTime)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	// Wire format of the last reply read, hexdumped if mismatched, see: log_mismatch
+	var raw []byte
+	if upstream.logMismatch != 0 {
+		ctx = context.WithValue(ctx, rawReplyKey{}, &raw)
+	}
 	for time.Now().Before(deadline) {
 		start := time.Now()
 
-		host := upstream.Select()
+		host := upstream.selectTraced(client, tr)
 		if host == nil {
 			log.Debug(errNoHealthy)
+			tr.addf("%v", errNoHealthy)
+			upstream.servfailCache.add(state, time.Now())
 			return dns.RcodeServerFailure, errNoHealthy
 		}
 		log.Debugf("Upstream host %v is selected", host.Name())
 
+		if !host.breaker.allow() {
+			// Lost the race of half-open trial exchange, the host is considered as down now
+			// Or the host is selected by spray while its breaker is open, don't spin until the deadline
+			upstreamErr = errBreakerOpen
+			tr.addf("host %v skipped, circuit breaker: %v", host.Name(), host.breaker)
+			if refused++; upstream.allRejected(refused) {
+				return dns.RcodeServerFailure, upstreamErr
+			}
+			continue
+		}
+
+		if upstream.chaos.inject(ctx, server, host.Name()) {
+			log.Debugf("Injected failure for %v", host.Name())
+			tr.addf("injected failure for %v", host.Name())
+			host.breaker.failure()
+			return dns.RcodeServerFailure, errChaosFault
+		}
+
+		proto := ustate.Proto()
+		atomic.AddInt32(&host.inflight, 1)
 		for {
 			t := time.Now()
-			reply, upstreamErr = host.Exchange(ctx, state, upstream.bootstrap, upstream.noIPv6)
-			log.Debugf("rtt: %v", time.Since(t))
+			raw = nil
+			reply, upstreamErr = host.exchange(ctx, ustate, proto, upstream.bootstrap, upstream.ipPref)
+			rtt := time.Since(t)
+			log.Debugf("rtt: %v", rtt)
+			tr.addf("exchange with %v over %v, rtt: %v err: %v", host.Name(), proto, rtt, upstreamErr)
+			if upstream.slowLog != 0 && rtt > upstream.slowLog {
+				log.Warningf("Slow exchange with %v  qname: %v qtype: %v rtt: %v err: %v",
+					host.Name(), state.QName(), state.Type(), rtt, upstreamErr)
+			}
 			if upstreamErr == errCachedConnClosed {
 				// [sic] Remote side closed conn, can only happen with TCP.
 				// Retry for another connection
 				log.Debugf("%v: %v", upstreamErr, host.Name())
 				continue
 			}
+			if upstreamErr == nil && reply.Truncated && proto == "udp" && host.udpCapable() {
+				TruncationCount.WithLabelValues(server, host.Name()).Inc()
+				if upstream.tcpFallback && host.proto == "dns" {
+					// Retry over TCP on behalf of the client, rather than replying the truncated reply
+					log.Debugf("Truncated reply from %v, retry over TCP  qname: %v", host.Name(), state.QName())
+					TcpFallbackCount.WithLabelValues(server, host.Name()).Inc()
+					tr.addf("truncated reply, retry over TCP")
+					proto = "tcp"
+					continue
+				}
+			}
 			break
 		}
+		atomic.AddInt32(&host.inflight, -1)
 
 		if upstreamErr != nil {
+			host.breaker.failure()
+			host.errors.add(state.QName(), upstreamErr, time.Now())
 			if upstream.maxFails != 0 {
 				log.Warningf("Exchange() failed  error: %v", upstreamErr)
 				healthCheck(upstream, host)
 			}
+			var se *shortReadError
+			if errors.As(upstreamErr, &se) {
+				ShortReadCount.WithLabelValues(server, host.Name()).Inc()
+			}
+			var ue *unpackError
+			if errors.As(upstreamErr, &ue) {
+				UnpackErrorCount.WithLabelValues(server, host.Name()).Inc()
+				if upstream.unpackServfail {
+					tr.addf("unpack error, reply SERVFAIL")
+					return dns.RcodeServerFailure, upstreamErr
+				}
+			}
 			continue
 		}
 
-		if !state.Match(reply) {
-			debug.Hexdumpf(reply, "Wrong reply  id: %v, qname: %v qtype: %v", reply.Id, state.QName(), state.QType())
+		if reply.Truncated && host.streamCapable(proto) {
+			// Stream transports have no size limit to truncate for, the reply is broken
+			log.Warningf("Truncated reply over stream from %v  qname: %v qtype: %v",
+				host.Name(), state.QName(), state.Type())
+			StreamTruncationCount.WithLabelValues(server, host.Name()).Inc()
+			tr.addf("truncated reply over stream, next: %v", upstream.streamTruncatedNext)
+			if upstream.streamTruncatedNext {
+				upstreamErr = errStreamTruncated
+				host.breaker.failure()
+				healthCheck(upstream, host)
+				continue
+			}
+		}
+
+		if upstream.oversizedReply(reply) {
+			log.Warningf("Oversized reply from %v  qname: %v qtype: %v max: %v truncated: %v",
+				host.Name(), state.QName(), state.Type(), upstream.maxMsgSize, upstream.maxMsgSizeTruncate)
+			OversizedReplyCount.WithLabelValues(server, host.Name()).Inc()
+			tr.addf("oversized reply, max: %v truncate: %v", upstream.maxMsgSize, upstream.maxMsgSizeTruncate)
+			if !upstream.maxMsgSizeTruncate {
+				// Don't trust the payload, another host may answer within the limit
+				upstreamErr = errOversizedReply
+				host.breaker.failure()
+				healthCheck(upstream, host)
+				if rejected++; upstream.allRejected(rejected) {
+					// EDNS0 buffer size is clamped, yet replies over TCP aren't limited by it
+					tr.addf("all hosts replied oversized replies")
+					upstream.servfailCache.add(state, time.Now())
+					return dns.RcodeServerFailure, upstreamErr
+				}
+				continue
+			}
+		}
 
-			formerr := new(dns.Msg)
-			formerr.SetRcode(state.Req, dns.RcodeFormatError)
-			_ = w.WriteMsg(formerr)
+		upstream.restoreReply(state, ustate, reply)
+		if !upstream.replyMatch(state, reply) {
+			debug.Hexdumpf(reply, "Wrong reply  id: %v, qname: %v qtype: %v", reply.Id, state.QName(), state.QType())
+			ResponseMismatchCount.WithLabelValues(server, host.Name()).Inc()
+			upstream.logMismatchedReply(host, state, reply, raw)
+			host.breaker.failure()
+			tr.addf("mismatched reply")
+
+			switch upstream.mismatch {
+			case mismatchNext:
+				// Another host may answer correctly
+				upstreamErr = errMismatchedReply
+				healthCheck(upstream, host)
+				continue
+			case mismatchDrop:
+				// Client will time out, as if the spoofed reply never arrived
+				return dns.RcodeSuccess, nil
+			}
+			writeRcode(w, state.Req, dns.RcodeFormatError)
 			return dns.RcodeSuccess, nil
 		}
 
+		if upstream.maxCnameDepth != 0 {
+			if depth := cnameChainDepth(reply.Answer, state.QName()); depth < 0 || depth > upstream.maxCnameDepth {
+				log.Warningf("CNAME chain too deep or looped  host: %v qname: %v depth: %v max: %v",
+					host.Name(), state.QName(), depth, upstream.maxCnameDepth)
+				tr.addf("CNAME chain too deep or looped, depth: %v", depth)
+				// Host itself is working, the answer is rejected by policy
+				host.breaker.success()
+				writeRcode(w, state.Req, dns.RcodeServerFailure)
+				return dns.RcodeSuccess, nil
+			}
+		}
+
+		if upstream.isUnhealthyAnswer(reply) {
+			// Host responded, yet with a sentinel answer, count it as a failure and retry with another host
+			upstreamErr = errUnhealthyAnswer
+			log.Warningf("Unhealthy answer from %v  qname: %v qtype: %v rcode: %v",
+				host.Name(), state.QName(), state.Type(), dns.RcodeToString[reply.Rcode])
+			tr.addf("unhealthy answer, rcode: %v", dns.RcodeToString[reply.Rcode])
+			host.breaker.failure()
+			healthCheck(upstream, host)
+			if rejected++; upstream.allRejected(rejected) {
+				tr.addf("all hosts replied unhealthy answers")
+				upstream.servfailCache.add(state, time.Now())
+				return dns.RcodeServerFailure, upstreamErr
+			}
+			continue
+		}
+		host.breaker.success()
+
+		if upstream.prefetchSem != nil {
+			upstream.prefetch(server, ustate, host, reply)
+		}
+		upstream.answerCache.add(state, reply, time.Now())
+		upstream.transformReply(state, reply)
+
 		// Add resolved IPs to ipset/pf before write response to DNS resolver
 		// 	thus the rule based routing can take effect immediately
 		ipsetAddIP(upstream, reply)
@@ -134,12 +432,30 @@ func (r *Dnsredir) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dns.
 		return dns.RcodeSuccess, nil
 	}
 
+	if upstream.maxQueryTime != 0 {
+		log.Debugf("Max query time %v exceeded  qname: %v qtype: %v err: %v",
+			upstream.maxQueryTime, state.QName(), state.Type(), upstreamErr)
+		MaxQueryTimeCount.WithLabelValues(server).Inc()
+		tr.addf("max query time %v exceeded, err: %v", upstream.maxQueryTime, upstreamErr)
+		if upstream.maxQueryTimeRcode != maxQueryTimeDrop {
+			writeRcode(w, state.Req, upstream.maxQueryTimeRcode)
+		}
+		return dns.RcodeSuccess, nil
+	}
+
 	if upstreamErr == nil {
 		panic("Why upstreamErr is nil?! Are you in a debugger or your machine running slow?")
 	}
+	upstream.servfailCache.add(state, time.Now())
 	return dns.RcodeServerFailure, upstreamErr
 }
 
+// Return true if `rejected' replies made a pass over hosts of the upstream
+// Hosts likely answer the same question alike, thus it's pointless to retry until the deadline.
+func (u *reloadableUpstream) allRejected(rejected int) bool {
+	return rejected >= len(u.loadHosts())
+}
+
 func healthCheck(r *reloadableUpstream, uh *UpstreamHost) {
 	// Skip unnecessary health checking
 	if r.checkInterval == 0 || r.maxFails == 0 {
@@ -151,17 +467,47 @@ func healthCheck(r *reloadableUpstream, uh *UpstreamHost) {
 	go func(uh *UpstreamHost) {
 		time.Sleep(failTimeout)
 		// Failure count may go negative here, should be rectified by HC eventually
-		atomic.AddInt32(&uh.fails, -1)
-		// Kick off health check on every failureCheck failure
-		if fails%failureCheck == 0 {
+		if atomic.AddInt32(&uh.fails, -1) == r.maxFails-1 {
+			uh.markRecovered()
+		}
+		// Kick off health check on every failureCheck failure, unless the host is backing off
+		if fails%failureCheck == 0 && uh.checkDue() {
 			_ = uh.Check()
 		}
 	}(uh)
 }
 
+// Acquire an in-flight slot, false if maxConcurrent reached
+func (r *Dnsredir) acquire(server string) bool {
+	if r.maxConcurrent == 0 {
+		return true
+	}
+	if atomic.AddInt32(&r.inflight, 1) > r.maxConcurrent {
+		atomic.AddInt32(&r.inflight, -1)
+		return false
+	}
+	InflightGauge.WithLabelValues(server).Inc()
+	return true
+}
+
+func (r *Dnsredir) release(server string) {
+	if r.maxConcurrent == 0 {
+		return
+	}
+	atomic.AddInt32(&r.inflight, -1)
+	InflightGauge.WithLabelValues(server).Dec()
+}
+
 func (r *Dnsredir) Name() string { return pluginName }
 
-func (r *Dnsredir) match(server, name string) (Upstream, time.Duration) {
+func (r *Dnsredir) match(server, name string, state *request.Request) (Upstream, time.Duration) {
+	up, _, t := r.route(server, name, state, nil)
+	return up, t
+}
+
+// Return the upstream which the request routed to, unready is true if the name isn't matched,
+//	yet it's routed to the upstream since its name lists aren't ready, see: onUnready
+func (r *Dnsredir) route(server, name string, state *request.Request, tr *queryTrace) (_ Upstream, unready bool, _ time.Duration) {
 	t1 := time.Now()
 
 	if r.Upstreams == nil {
@@ -172,25 +518,105 @@ func (r *Dnsredir) match(server, name string) (Upstream, time.Duration) {
 	if len(name) > 1 {
 		name = removeTrailingDot(name)
 	}
-
+	// Domain names are case-insensitive, see: https://tools.ietf.org/html/rfc4343
+	name = strings.ToLower(name)
+
+	// The first matched upstream, used as last resort if all matched upstreams are down
+	var fallback Upstream
+	// The most specific matched upstream so far, see: matchLongest
+	var longest Upstream
+	specificity := -1
 	for _, up := range *r.Upstreams {
+		u := up.(*reloadableUpstream)
 		// For maximum performance, we search the first matched item and return directly
-		// Unlike proxy plugin, which try to find longest match
-		if up.Match(name) {
-			t2 := time.Since(t1)
-			NameLookupDuration.WithLabelValues(server, "1").Observe(float64(t2.Milliseconds()))
-			return up, t2
+		// Unlike proxy plugin, which try to find longest match, unless matchLongest enabled
+		if !u.matchRequest(state) {
+			tr.addf("upstream %v skipped, request doesn't match", u.from)
+			continue
+		}
+		if u.dryrun {
+			// Validate impact of a new list against real traffic before enforcing it
+			//	requests are never held or replied for it regardless of on_init and on_unready
+			if up.Match(name) {
+				log.Debugf("Would match %q  upstream: %v qtype: %v client: %v", name, u.from, state.Type(), state.RemoteAddr())
+				WouldMatchCount.WithLabelValues(server, strings.Join(u.from, " ")).Inc()
+				tr.addf("upstream %v would match, dryrun", u.from)
+			}
+			continue
+		}
+		// Requests never routed to the upstream are never held
+		loading := u.onInit != onInitForward && !u.initialized()
+		if loading && u.onInit == onInitHold && !u.waitInitialized(u.onInitHold) {
+			log.Debugf("Initial population of upstream %v not finished in %v", u.from, u.onInitHold)
+		}
+		if !up.Match(name) {
+			if loading && u.onInit == onInitFallthrough {
+				// The name may be matched once populated, don't route it to next upstream
+				log.Debugf("Upstream %v is populating, pass %q to next plugin", u.from, name)
+				tr.addf("upstream %v is populating", u.from)
+				break
+			}
+			if u.onUnready != onUnreadyForward && !u.ready() {
+				// The name may be in names not loaded yet, don't route it to next upstream
+				t2 := time.Since(t1)
+				NameLookupDuration.WithLabelValues(server, "0").Observe(float64(t2.Milliseconds()))
+				return up, true, t2
+			}
+			tr.addf("upstream %v skipped, name doesn't match", u.from)
+			continue
+		}
+		if up.AllDown() {
+			// Fail over to next matched upstream(if any)
+			log.Debugf("All hosts are down in upstream %v, try next one for %q", u.from, name)
+			tr.addf("upstream %v matched, yet all hosts are down", u.from)
+			if fallback == nil {
+				fallback = up
+			}
+			continue
+		}
+		if r.matchLongest {
+			n := u.matchSpecificity(name)
+			tr.addf("upstream %v matched, specificity: %v", u.from, n)
+			// Upstreams of the same specificity are tie-broken by order
+			if n > specificity {
+				longest, specificity = up, n
+			}
+			continue
 		}
+		t2 := time.Since(t1)
+		NameLookupDuration.WithLabelValues(server, "1").Observe(float64(t2.Milliseconds()))
+		tr.addf("upstream %v matched, t: %v", u.from, t2)
+		return up, false, t2
+	}
+
+	if longest != nil {
+		t2 := time.Since(t1)
+		NameLookupDuration.WithLabelValues(server, "1").Observe(float64(t2.Milliseconds()))
+		tr.addf("upstream %v matched longest, t: %v", longest.(*reloadableUpstream).from, t2)
+		return longest, false, t2
+	}
+
+	if fallback != nil {
+		tr.addf("fall back to upstream %v", fallback.(*reloadableUpstream).from)
+		t2 := time.Since(t1)
+		NameLookupDuration.WithLabelValues(server, "1").Observe(float64(t2.Milliseconds()))
+		return fallback, false, t2
 	}
 
 	t2 := time.Since(t1)
 	NameLookupDuration.WithLabelValues(server, "0").Observe(float64(t2.Milliseconds()))
-	return nil, t2
+	return nil, false, t2
 }
 
 var (
 	errNoHealthy        = errors.New("no healthy upstream host")
 	errCachedConnClosed = errors.New("cached connection was closed by peer")
+	errUnhealthyAnswer  = errors.New("upstream host replied with an unhealthy answer")
+	errChaosFault       = errors.New("injected fault")
+	errMismatchedReply  = errors.New("upstream host replied with a mismatched question")
+	errOversizedReply   = errors.New("upstream host replied with an oversized message")
+	errBreakerOpen      = errors.New("circuit breaker of upstream host refused the exchange")
+	errStreamTruncated  = errors.New("upstream host replied with a truncated message over stream")
 )
 
 const (
@@ -198,3 +624,9 @@ const (
 	defaultFailTimeout = 2000 * time.Millisecond
 	failureCheck       = 3
 )
+
+// Health check backoff of a failing host, see: UpstreamHost.backoff()
+const (
+	minCheckBackoff = 2 * time.Second
+	maxCheckBackoff = 2 * time.Minute
+)
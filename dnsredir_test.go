@@ -0,0 +1,1071 @@
+package dnsredir
+
+import (
+	"context"
+	"fmt"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	coretest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestDnsredir(t *testing.T, input string) *Dnsredir {
+	c := caddy.NewTestController("dns", input)
+	ups, err := NewReloadableUpstreams(c)
+	if err != nil {
+		t.Fatalf("NewReloadableUpstreams() failed, input: %q error: %v", input, err)
+	}
+	return &Dnsredir{Upstreams: &ups}
+}
+
+func newTestState(name string, qtype uint16) *request.Request {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	return &request.Request{W: &coretest.ResponseWriter{}, Req: req}
+}
+
+func TestMatchCaseInsensitive(t *testing.T) {
+	r := newTestDnsredir(t, "dnsredir nonexistent.conf {\n example.com \n to 1.2.3.4 \n}")
+
+	tests := []struct {
+		name    string
+		matched bool
+	}{
+		{"example.com.", true},
+		{"ExAmPlE.CoM.", true},
+		{"EXAMPLE.COM", true},
+		{"WwW.eXaMpLe.CoM.", true},
+		{"example.net.", false},
+		{"ExAmPlE.NeT.", false},
+	}
+	for i, test := range tests {
+		up, _ := r.match("", test.name, newTestState(test.name, dns.TypeA))
+		if matched := up != nil; matched != test.matched {
+			t.Errorf("Test#%v failed  %q matched: %v vs %v", i, test.name, matched, test.matched)
+		}
+	}
+}
+
+func TestMatchLongest(t *testing.T) {
+	input := `
+dnsredir . {
+	to 8.8.8.8
+}
+dnsredir nonexistent.conf {
+	example.com
+	a.corp.example.com
+	%v
+	to 1.2.3.4
+}
+dnsredir nonexistent.conf {
+	corp.example.com
+	to 9.9.9.9
+}`
+	tests := []struct {
+		longest  bool
+		name     string
+		expected int
+	}{
+		{false, "www.corp.example.com.", 0},
+		{true, "www.corp.example.com.", 2},
+		{true, "corp.example.com.", 2},
+		{true, "www.example.com.", 1},
+		// Nested entries of an upstream, the most specific one counts
+		{true, "x.a.corp.example.com.", 1},
+		{true, "example.net.", 0},
+		{true, ".", 0},
+	}
+	for i, test := range tests {
+		opt := "match first"
+		if test.longest {
+			opt = "match longest"
+		}
+		r := newTestDnsredir(t, fmt.Sprintf(input, opt))
+		r.matchLongest = (*r.Upstreams)[1].(*reloadableUpstream).matchLongest
+		up, _ := r.match("", test.name, newTestState(test.name, dns.TypeA))
+		if up != (*r.Upstreams)[test.expected] {
+			t.Errorf("Test#%v failed  %q expected upstream#%v, got %v", i, test.name, test.expected, up)
+		}
+	}
+}
+
+func TestDryrun(t *testing.T) {
+	// Loading or unready dryrun upstreams never change routing
+	for _, option := range []string{"", "on_init fallthrough", "on_init hold 1s", "on_unready SERVFAIL"} {
+		input := fmt.Sprintf(`
+dnsredir nonexistent.conf {
+	example.com
+	dryrun
+	%v
+	to 1.2.3.4
+}
+dnsredir . {
+	to 8.8.8.8
+}`, option)
+		r := newTestDnsredir(t, input)
+		u := (*r.Upstreams)[0].(*reloadableUpstream)
+		// Pretend initial population is in progress
+		u.initDone = make(chan struct{})
+		label := strings.Join(u.from, " ")
+		tests := []struct {
+			name  string
+			would float64
+		}{
+			{"www.example.com.", 1},
+			{"example.net.", 0},
+		}
+		for i, test := range tests {
+			would := testutil.ToFloat64(WouldMatchCount.WithLabelValues("", label))
+			start := time.Now()
+			up, unready, _ := r.route("", test.name, newTestState(test.name, dns.TypeA), nil)
+			if up != (*r.Upstreams)[1] || unready {
+				t.Errorf("Test#%v failed  %q %q expected the catch-all upstream, got %v unready: %v", i, option, test.name, up, unready)
+			}
+			if elapsed := time.Since(start); elapsed >= time.Second {
+				t.Errorf("Test#%v failed  %q %q expected not held, took %v", i, option, test.name, elapsed)
+			}
+			if n := testutil.ToFloat64(WouldMatchCount.WithLabelValues("", label)) - would; n != test.would {
+				t.Errorf("Test#%v failed  %q %q expected %v would-be matches, got %v", i, option, test.name, test.would, n)
+			}
+		}
+	}
+}
+
+func TestMatchFailover(t *testing.T) {
+	r := newTestDnsredir(t, `
+dnsredir nonexistent.conf {
+	example.com
+	to 1.2.3.4 5.6.7.8
+}
+dnsredir nonexistent.conf {
+	example.com
+	to 9.9.9.9
+}
+dnsredir . {
+	to 8.8.8.8
+}`)
+	ups := *r.Upstreams
+	const down = defaultMaxFails
+
+	tests := []struct {
+		name string
+		// Fails of each host of each upstream
+		fails    [][]int32
+		expected int
+	}{
+		{"www.example.com.", [][]int32{{0, 0}, {0}, {0}}, 0},
+		// First block partially down is still preferred
+		{"www.example.com.", [][]int32{{down, 0}, {0}, {0}}, 0},
+		// All down in first block
+		{"www.example.com.", [][]int32{{down, down}, {0}, {0}}, 1},
+		// All down in first and second block, fallback to root zone
+		{"www.example.com.", [][]int32{{down, down}, {down}, {0}}, 2},
+		// All down in all matched blocks, fallback to the first matched one
+		{"www.example.com.", [][]int32{{down, down}, {down}, {down}}, 0},
+		{"example.net.", [][]int32{{down, down}, {down}, {down}}, 2},
+		{"example.net.", [][]int32{{0, 0}, {0}, {0}}, 2},
+	}
+	for i, test := range tests {
+		for j, up := range ups {
+			for k, host := range up.(*reloadableUpstream).hosts {
+				host.fails = test.fails[j][k]
+			}
+		}
+		up, _ := r.match("", test.name, newTestState(test.name, dns.TypeA))
+		if up != ups[test.expected] {
+			t.Errorf("Test#%v failed  %q expected upstream#%v, got %v", i, test.name, test.expected, up)
+		}
+	}
+}
+
+func TestMatchRoot(t *testing.T) {
+	r := newTestDnsredir(t, `
+dnsredir nonexistent.conf {
+	example.com
+	to 1.1.1.1
+}
+dnsredir nonexistent.conf {
+	example.net
+	root match
+	to 2.2.2.2
+}
+dnsredir . {
+	to 3.3.3.3
+}`)
+	ups := *r.Upstreams
+
+	matched := func(name string) int {
+		up, _ := r.match("", name, newTestState(name, dns.TypeA))
+		for i := range ups {
+			if ups[i] == up {
+				return i
+			}
+		}
+		return -1
+	}
+
+	if i := matched("."); i != 1 {
+		t.Fatalf("Root query should be matched by `root match' upstream, got #%v", i)
+	}
+	if i := matched("www.example.net."); i != 1 {
+		t.Fatalf("`root match' shouldn't affect other names, got #%v", i)
+	}
+
+	ups[1].(*reloadableUpstream).root = rootNext
+	if i := matched("."); i != 2 {
+		t.Fatalf("Root query should be matched by `.' upstream, got #%v", i)
+	}
+
+	ups[2].(*reloadableUpstream).root = rootNext
+	if i := matched("."); i != -1 {
+		t.Fatalf("Root query shouldn't be matched if all upstreams skip it, got #%v", i)
+	}
+	if i := matched("example.org."); i != 2 {
+		t.Fatalf("`root next' shouldn't affect other names, got #%v", i)
+	}
+}
+
+func TestMatchTiming(t *testing.T) {
+	input := `dnsredir nonexistent.conf {
+	example.com
+	except www.example.com
+	match_timing
+	to 1.1.1.1
+}`
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+	u := up.(*reloadableUpstream)
+
+	for _, name := range []string{"example.com", "www.example.com", "example.net"} {
+		u.Match(name)
+	}
+	st := u.matchTiming.status()
+	// All names are looked up in name list and INLINE, only INLINE matched names are looked up in ignored names
+	// Exact lookups and suffix walks are recorded per domain set lookup, i.e. of each name list item, INLINE and ignored names
+	sets := uint64(3*len(u.NameList.items) + 3 + 2)
+	for phase, count := range map[string]uint64{"names": 3, "inline": 3, "except": 2, "exact": sets, "suffix": sets} {
+		if st[phase].Count != count {
+			t.Errorf("Phase %q expected count %v, got %v", phase, count, st[phase])
+		}
+	}
+
+	if st := (&reloadableUpstream{}).matchTiming.status(); st != nil {
+		t.Errorf("Expected no timing if disabled, got %v", st)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	r := &Dnsredir{maxConcurrent: 2}
+	if !r.acquire("") || !r.acquire("") {
+		t.Fatalf("Expected slots below the limit to be acquired")
+	}
+	if r.acquire("") {
+		t.Fatalf("Expected acquire to fail once the limit reached")
+	}
+	r.release("")
+	if !r.acquire("") {
+		t.Fatalf("Expected a released slot to be acquired again")
+	}
+	if n := atomic.LoadInt32(&r.inflight); n != 2 {
+		t.Fatalf("Expected 2 in-flight requests, got %v", n)
+	}
+
+	unlimited := &Dnsredir{}
+	for i := 0; i < 100; i++ {
+		if !unlimited.acquire("") {
+			t.Fatalf("Expected unlimited in-flight requests")
+		}
+	}
+}
+
+func TestMatchQtype(t *testing.T) {
+	r := newTestDnsredir(t, `
+dnsredir nonexistent.conf {
+	example.com
+	qtype A
+	to 1.1.1.1
+}
+dnsredir nonexistent.conf {
+	example.com
+	qtype aaaa
+	qtype TXT
+	to 2.2.2.2
+}`)
+	ups := *r.Upstreams
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		index int // -1 if not matched
+	}{
+		{"www.example.com.", dns.TypeA, 0},
+		{"www.example.com.", dns.TypeAAAA, 1},
+		{"example.com.", dns.TypeTXT, 1},
+		{"example.com.", dns.TypeMX, -1},
+		{"example.net.", dns.TypeA, -1},
+	}
+	for i, test := range tests {
+		up, _ := r.match("", test.name, newTestState(test.name, test.qtype))
+		index := -1
+		for j := range ups {
+			if ups[j] == up {
+				index = j
+			}
+		}
+		if index != test.index {
+			t.Errorf("Test#%v failed  %q %v expected upstream #%v, got #%v",
+				i, test.name, dns.TypeToString[test.qtype], test.index, index)
+		}
+	}
+}
+
+func TestMatchCookie(t *testing.T) {
+	r := newTestDnsredir(t, `
+dnsredir nonexistent.conf {
+	example.com
+	cookie absent
+	to 1.1.1.1
+}
+dnsredir nonexistent.conf {
+	example.com
+	to 2.2.2.2
+}`)
+	ups := *r.Upstreams
+
+	tests := []struct {
+		cookie string // Empty if no cookie
+		tcp    bool
+		index  int
+	}{
+		{"", false, 0},
+		{"", true, 1},
+		{"0123456789abcdef", false, 1},
+		{"0123456789abcdef0123456789abcdef", false, 1},
+		// Malformed cookies
+		{"0123456789", false, 0},
+		{"0123456789abcdef01", false, 0},
+	}
+	for i, test := range tests {
+		state := newTestState("www.example.com.", dns.TypeA)
+		state.W = &coretest.ResponseWriter{TCP: test.tcp}
+		if test.cookie != "" {
+			state.Req.SetEdns0(dns.DefaultMsgSize, false)
+			opt := state.Req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: test.cookie})
+		}
+		up, _ := r.match("", "www.example.com.", state)
+		if up != ups[test.index] {
+			t.Errorf("Test#%v failed  cookie: %q tcp: %v expected upstream #%v", i, test.cookie, test.tcp, test.index)
+		}
+
+		reply := (&reloadableUpstream{cookieTc: true}).localReply("", state)
+		if truncated := reply != nil && reply.Truncated; truncated != (test.index == 0) {
+			t.Errorf("Test#%v failed  cookie: %q tcp: %v truncated: %v", i, test.cookie, test.tcp, truncated)
+		}
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	r := newTestDnsredir(t, `dnsredir nonexistent.conf {
+	example.com
+	except mail.example.com
+	to 1.1.1.1
+}
+dnsredir nonexistent.conf {
+	www.example.com
+	mail.example.com
+	example.net
+	to 8.8.8.8
+}
+dnsredir . {
+	except example.net
+	to 9.9.9.9
+}`)
+
+	// The last upstream has no names of its own, thus shadows nothing
+	n, samples := findOverlaps(*r.Upstreams)
+	if n != 1 || len(samples) != 1 || !strings.HasPrefix(samples[0], "www.example.com(") {
+		t.Errorf("Expected www.example.com overlaps only, got %v %v", n, samples)
+	}
+
+	if err := r.checkOverlaps(); err != nil {
+		t.Errorf("Overlaps shouldn't be checked by default, got %v", err)
+	}
+	r.overlap = overlapWarn
+	if err := r.checkOverlaps(); err != nil {
+		t.Errorf("Expected overlaps to be warned only, got %v", err)
+	}
+	r.overlap = overlapError
+	if err := r.checkOverlaps(); err == nil {
+		t.Errorf("Expected error for overlapping names")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	state := newTestState("example.com.", dns.TypeA)
+	if ip := clientIP(context.Background(), state); ip != state.IP() {
+		t.Errorf("Expected peer IP %v, got %v", state.IP(), ip)
+	}
+
+	ctx := context.WithValue(context.Background(), ClientIPKey{}, net.ParseIP("192.0.2.1"))
+	if ip := clientIP(ctx, state); ip != "192.0.2.1" {
+		t.Errorf("Expected client IP from context, got %v", ip)
+	}
+
+	// Malformed values are ignored
+	ctx = context.WithValue(context.Background(), ClientIPKey{}, "192.0.2.1")
+	if ip := clientIP(ctx, state); ip != state.IP() {
+		t.Errorf("Expected peer IP %v, got %v", state.IP(), ip)
+	}
+}
+
+func TestOnInit(t *testing.T) {
+	newTest := func(onInit string) (*Dnsredir, *reloadableUpstream) {
+		r := newTestDnsredir(t, fmt.Sprintf(`dnsredir nonexistent.conf {
+	example.com
+	on_init %v
+	to 1.1.1.1
+}
+dnsredir . {
+	to 8.8.8.8
+}`, onInit))
+		u := (*r.Upstreams)[0].(*reloadableUpstream)
+		// Pretend initial population is in progress
+		u.initDone = make(chan struct{})
+		return r, u
+	}
+	state := newTestState("example.net.", dns.TypeA)
+
+	r, _ := newTest("forward")
+	if up, _ := r.match("", "example.net.", state); up != (*r.Upstreams)[1] {
+		t.Errorf("Expected unmatched name forwarded to next upstream, got %v", up)
+	}
+
+	r, u := newTest("fallthrough")
+	if up, _ := r.match("", "example.net.", state); up != nil {
+		t.Errorf("Expected unmatched name passed to next plugin, got %v", up)
+	}
+	if up, _ := r.match("", "example.com.", state); up != (*r.Upstreams)[0] {
+		t.Errorf("Expected matched name routed, got %v", up)
+	}
+	close(u.initDone)
+	if up, _ := r.match("", "example.net.", state); up != (*r.Upstreams)[1] {
+		t.Errorf("Expected unmatched name forwarded to next upstream once populated, got %v", up)
+	}
+
+	r, u = newTest("hold 50ms")
+	start := time.Now()
+	if up, _ := r.match("", "example.net.", state); up != (*r.Upstreams)[1] || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Expected timed out hold, got %v in %v", up, time.Since(start))
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(u.initDone)
+	}()
+	start = time.Now()
+	if up, _ := r.match("", "example.net.", state); up != (*r.Upstreams)[1] || time.Since(start) >= 50*time.Millisecond {
+		t.Errorf("Expected hold until populated, got %v in %v", up, time.Since(start))
+	}
+
+	// Requests not matching the upstream aren't held
+	r, u = newTest("hold 1s")
+	u.qtypes = map[uint16]struct{}{dns.TypeAAAA: {}}
+	start = time.Now()
+	if up, _ := r.match("", "example.com.", state); up != (*r.Upstreams)[1] || time.Since(start) >= time.Second {
+		t.Errorf("Expected unmatched request not held, got %v in %v", up, time.Since(start))
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n on_init\n to 1.1.1.1\n}",
+		"dnsredir . {\n on_init wait\n to 1.1.1.1\n}",
+		"dnsredir . {\n on_init forward 1s\n to 1.1.1.1\n}",
+		"dnsredir . {\n on_init hold 1ms\n to 1.1.1.1\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := NewReloadableUpstreams(c); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestOnUnready(t *testing.T) {
+	r := newTestDnsredir(t, `dnsredir nonexistent.conf {
+	example.com
+	on_unready SERVFAIL
+	to 1.1.1.1
+}
+dnsredir . {
+	to 8.8.8.8
+}`)
+	u := (*r.Upstreams)[0].(*reloadableUpstream)
+	state := newTestState("example.net.", dns.TypeA)
+
+	// Name list is empty since the file doesn't exist
+	if up, unready, _ := r.route("", "example.net.", state, nil); up != (*r.Upstreams)[0] || !unready {
+		t.Errorf("Expected unmatched name replied by unready upstream, got %v unready: %v", up, unready)
+	}
+	if up, unready, _ := r.route("", "example.com.", state, nil); up != (*r.Upstreams)[0] || unready {
+		t.Errorf("Expected matched name routed, got %v unready: %v", up, unready)
+	}
+	rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+	if _, err := r.ServeDNS(context.Background(), rec, state.Req); err != nil || rec.Msg == nil {
+		t.Fatalf("ServeDNS() failed: %v", err)
+	}
+	if rec.Msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL, got %v", dns.RcodeToString[rec.Msg.Rcode])
+	}
+
+	names := make(domainSet)
+	names.Add("example.org")
+	u.items[0].storeNames(names, nil)
+	if up, unready, _ := r.route("", "example.net.", state, nil); up != (*r.Upstreams)[1] || unready {
+		t.Errorf("Expected unmatched name forwarded to next upstream once ready, got %v unready: %v", up, unready)
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n on_unready\n to 1.1.1.1\n}",
+		"dnsredir . {\n on_unready NOERROR\n to 1.1.1.1\n}",
+		"dnsredir . {\n on_unready fallthrough\n to 1.1.1.1\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := NewReloadableUpstreams(c); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestTcpFallback(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			m.Truncated = true
+		} else {
+			m.Answer = []dns.RR{coretest.A("example.com. 60 IN A 192.0.2.1")}
+		}
+		_ = w.WriteMsg(m)
+	})
+	defer s.Close()
+
+	for _, fallback := range []bool{false, true} {
+		input := fmt.Sprintf("dnsredir . {\n to dns://%v\n}", s.Addr)
+		if fallback {
+			input = fmt.Sprintf("dnsredir . {\n tcp_fallback\n to dns://%v\n}", s.Addr)
+		}
+		r := newTestDnsredir(t, input)
+		u := (*r.Upstreams)[0].(*reloadableUpstream)
+		u.checkInterval = 0
+		u.HealthCheck.Start()
+		host := u.hosts[0]
+
+		truncated := testutil.ToFloat64(TruncationCount.WithLabelValues("", host.Name()))
+		fallbacks := testutil.ToFloat64(TcpFallbackCount.WithLabelValues("", host.Name()))
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+		if _, err := r.ServeDNS(context.Background(), rec, req); err != nil || rec.Msg == nil {
+			t.Fatalf("ServeDNS() failed: %v", err)
+		}
+		u.HealthCheck.Stop()
+
+		if fallback == rec.Msg.Truncated || fallback != (len(rec.Msg.Answer) == 1) {
+			t.Errorf("Unexpected reply  tcp_fallback: %v reply: %v", fallback, rec.Msg)
+		}
+		if n := testutil.ToFloat64(TruncationCount.WithLabelValues("", host.Name())) - truncated; n != 1 {
+			t.Errorf("Expected 1 truncated reply counted, got %v", n)
+		}
+		expected := 0.
+		if fallback {
+			expected = 1
+		}
+		if n := testutil.ToFloat64(TcpFallbackCount.WithLabelValues("", host.Name())) - fallbacks; n != expected {
+			t.Errorf("Expected %v TCP fallback counted, got %v", expected, n)
+		}
+	}
+}
+
+func TestExchangeTimeout(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(300 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		_ = w.WriteMsg(m)
+	})
+	defer s.Close()
+
+	for _, timeout := range []time.Duration{0, 50 * time.Millisecond} {
+		input := fmt.Sprintf("dnsredir . {\n to dns://%v\n}", s.Addr)
+		if timeout != 0 {
+			input = fmt.Sprintf("dnsredir . {\n timeout %v\n to dns://%v\n}", timeout, s.Addr)
+		}
+		r := newTestDnsredir(t, input)
+		u := (*r.Upstreams)[0].(*reloadableUpstream)
+		u.checkInterval = 0
+		u.HealthCheck.Start()
+		host := u.hosts[0]
+		if host.timeout != timeout {
+			t.Errorf("Expected timeout %v, got %v", timeout, host.timeout)
+		}
+
+		start := time.Now()
+		_, err := host.exchange(context.Background(), newTestState("example.com.", dns.TypeA), "udp", nil, u.ipPref)
+		elapsed := time.Since(start)
+		u.HealthCheck.Stop()
+
+		if timeout == 0 && err != nil {
+			t.Errorf("Expected exchange to succeed with default timeout, got %v", err)
+		}
+		if timeout != 0 && (err == nil || elapsed >= 300*time.Millisecond) {
+			t.Errorf("Expected exchange to time out after %v, got %v in %v", timeout, err, elapsed)
+		}
+	}
+}
+
+func TestPrefetchAlternate(t *testing.T) {
+	// Handler is shared by both servers, which answers different IPs per server
+	var firstPort string
+	handler := func(w dns.ResponseWriter, req *dns.Msg) {
+		ip := "192.0.2.2"
+		if _, port, _ := net.SplitHostPort(w.LocalAddr().String()); port == firstPort {
+			ip = "192.0.2.1"
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{coretest.A(req.Question[0].Name + " 60 IN A " + ip)}
+		_ = w.WriteMsg(m)
+	}
+	a := dnstest.NewServer(handler)
+	defer a.Close()
+	_, firstPort, _ = net.SplitHostPort(a.Addr)
+	b := dnstest.NewServer(handler)
+	defer b.Close()
+
+	r := newTestDnsredir(t, fmt.Sprintf("dnsredir . {\n prefetch_alternate\n policy sequential\n to dns://%v dns://%v\n}", a.Addr, b.Addr))
+	u := (*r.Upstreams)[0].(*reloadableUpstream)
+	u.checkInterval = 0
+	u.HealthCheck.Start()
+	defer u.HealthCheck.Stop()
+	alt := u.hosts[1]
+
+	mismatches := func() float64 {
+		return testutil.ToFloat64(PrefetchAlternateCount.WithLabelValues("", alt.Name(), prefetchMismatch))
+	}
+	before := mismatches()
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+	if _, err := r.ServeDNS(context.Background(), rec, req); err != nil || rec.Msg == nil {
+		t.Fatalf("ServeDNS() failed: %v", err)
+	}
+	if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("Expected answer of the first host, got %v", rec.Msg)
+	}
+	for i := 0; i < 100 && mismatches() == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := mismatches() - before; n != 1 {
+		t.Errorf("Expected 1 mismatched alternate answer, got %v", n)
+	}
+}
+
+func TestServfailCache(t *testing.T) {
+	r := newTestDnsredir(t, "dnsredir . {\n servfail_ttl 2s\n to 127.0.0.1:1\n}")
+	u := (*r.Upstreams)[0].(*reloadableUpstream)
+	host := u.hosts[0]
+	atomic.StoreInt32(&host.fails, u.maxFails+1)
+
+	serve := func(name string) (int, error) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+		rcode, err := r.ServeDNS(context.Background(), rec, req)
+		if rec.Msg != nil {
+			rcode = rec.Msg.Rcode
+		}
+		return rcode, err
+	}
+	hits := testutil.ToFloat64(ServfailCacheHitCount.WithLabelValues(""))
+	if rcode, err := serve("example.com."); rcode != dns.RcodeServerFailure || err == nil {
+		t.Fatalf("Expected SERVFAIL with error, got %v %v", rcode, err)
+	}
+	// Cached failure is replied without error, case-insensitively
+	if rcode, err := serve("EXAMPLE.com."); rcode != dns.RcodeServerFailure || err != nil {
+		t.Fatalf("Expected cached SERVFAIL, got %v %v", rcode, err)
+	}
+	if n := testutil.ToFloat64(ServfailCacheHitCount.WithLabelValues("")) - hits; n != 1 {
+		t.Errorf("Expected 1 cache hit, got %v", n)
+	}
+
+	// Cached failures expire
+	state := newTestState("example.org.", dns.TypeA)
+	now := time.Now()
+	u.servfailCache.add(state, now)
+	if !u.servfailCache.contains(state, now.Add(time.Second)) || u.servfailCache.contains(state, now.Add(3*time.Second)) {
+		t.Errorf("Expected cached failure expires after TTL")
+	}
+	if u.servfailCache.contains(newTestState("example.org.", dns.TypeAAAA), now) {
+		t.Errorf("Expected failures cached per query type")
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n servfail_ttl 500ms\n to 1.1.1.1\n}",
+		"dnsredir . {\n servfail_ttl 10m\n to 1.1.1.1\n}",
+		"dnsredir . {\n servfail_ttl 1s 2s\n to 1.1.1.1\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := NewReloadableUpstreams(c); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{coretest.A("example.com. 60 IN A 192.0.2.1")}
+		_ = w.WriteMsg(m)
+	})
+	defer s.Close()
+
+	r := newTestDnsredir(t, fmt.Sprintf("dnsredir . {\n trace edns\n to dns://%v\n}", s.Addr))
+	u := (*r.Upstreams)[0].(*reloadableUpstream)
+	r.trace = u.trace
+	u.checkInterval = 0
+	u.HealthCheck.Start()
+	defer u.HealthCheck.Stop()
+
+	for _, traced := range []bool{false, true} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if traced {
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: traceOption})
+		}
+		rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+		if _, err := r.ServeDNS(context.Background(), rec, req); err != nil || rec.Msg == nil {
+			t.Fatalf("ServeDNS() failed: %v", err)
+		}
+		if len(rec.Msg.Answer) != 1 {
+			t.Errorf("Unexpected reply %v", rec.Msg)
+		}
+
+		var steps []string
+		for _, rr := range rec.Msg.Extra {
+			if txt, ok := rr.(*dns.TXT); ok && txt.Hdr.Class == dns.ClassCHAOS {
+				steps = append(steps, strings.Join(txt.Txt, ""))
+			}
+		}
+		if !traced {
+			if len(steps) != 0 {
+				t.Errorf("Expected no trace without the trace option, got %v", steps)
+			}
+			continue
+		}
+		trace := strings.Join(steps, "\n")
+		for _, s := range []string{"id: ", "matched", "selected", "exchange with " + u.hosts[0].Name(), "rcode: NOERROR"} {
+			if !strings.Contains(trace, s) {
+				t.Errorf("Expected %q in trace, got %v", s, trace)
+			}
+		}
+	}
+
+	c := caddy.NewTestController("dns", "dnsredir . {\n trace debug\n to 1.1.1.1\n}")
+	if _, err := NewReloadableUpstreams(c); err == nil {
+		t.Errorf("Expected error for unknown trace mode")
+	}
+}
+
+func TestTcpTruncated(t *testing.T) {
+	// Handler is shared by both servers, the first server replies truncated messages
+	var firstPort string
+	handler := func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if _, port, _ := net.SplitHostPort(w.LocalAddr().String()); port == firstPort {
+			m.Truncated = true
+		} else {
+			m.Answer = []dns.RR{coretest.A(req.Question[0].Name + " 60 IN A 192.0.2.1")}
+		}
+		_ = w.WriteMsg(m)
+	}
+	a := dnstest.NewServer(handler)
+	defer a.Close()
+	_, firstPort, _ = net.SplitHostPort(a.Addr)
+	b := dnstest.NewServer(handler)
+	defer b.Close()
+
+	for _, next := range []bool{false, true} {
+		input := fmt.Sprintf("dnsredir . {\n policy sequential\n to tcp://%v tcp://%v\n}", a.Addr, b.Addr)
+		if next {
+			input = fmt.Sprintf("dnsredir . {\n tcp_truncated next\n policy sequential\n to tcp://%v tcp://%v\n}", a.Addr, b.Addr)
+		}
+		r := newTestDnsredir(t, input)
+		u := (*r.Upstreams)[0].(*reloadableUpstream)
+		u.HealthCheck.Start()
+		host := u.hosts[0]
+
+		truncated := testutil.ToFloat64(StreamTruncationCount.WithLabelValues("", host.Name()))
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+		if _, err := r.ServeDNS(context.Background(), rec, req); err != nil || rec.Msg == nil {
+			t.Fatalf("ServeDNS() failed: %v", err)
+		}
+		u.HealthCheck.Stop()
+
+		if next == rec.Msg.Truncated || next != (len(rec.Msg.Answer) == 1) {
+			t.Errorf("Unexpected reply  tcp_truncated next: %v reply: %v", next, rec.Msg)
+		}
+		if n := testutil.ToFloat64(StreamTruncationCount.WithLabelValues("", host.Name())) - truncated; n < 1 {
+			t.Errorf("Expected truncated reply over stream counted, got %v", n)
+		}
+	}
+}
+
+func TestMaxQueryTime(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, req *dns.Msg) {
+		// Slower than max_query_time, yet faster than the exchange timeout
+		time.Sleep(500 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		_ = w.WriteMsg(m)
+	})
+	defer s.Close()
+
+	for _, tc := range []struct {
+		args  string
+		rcode int
+	}{
+		{"", dns.RcodeServerFailure},
+		{"refused", dns.RcodeRefused},
+		{"drop", -1},
+	} {
+		input := fmt.Sprintf("dnsredir . {\n max_query_time 100ms %v\n to %v\n}", tc.args, s.Addr)
+		r := newTestDnsredir(t, input)
+		u := (*r.Upstreams)[0].(*reloadableUpstream)
+		u.HealthCheck.Start()
+
+		exceeded := testutil.ToFloat64(MaxQueryTimeCount.WithLabelValues(""))
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+		start := time.Now()
+		if _, err := r.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("ServeDNS() failed: %v", err)
+		}
+		elapsed := time.Since(start)
+		u.HealthCheck.Stop()
+
+		if elapsed > 400*time.Millisecond {
+			t.Errorf("Expected request bounded by max_query_time, took %v", elapsed)
+		}
+		if tc.rcode < 0 {
+			if rec.Msg != nil {
+				t.Errorf("Expected no reply for %q, got %v", tc.args, rec.Msg)
+			}
+		} else if rec.Msg == nil || rec.Msg.Rcode != tc.rcode {
+			t.Errorf("Expected rcode %v for %q, got %v", dns.RcodeToString[tc.rcode], tc.args, rec.Msg)
+		}
+		if n := testutil.ToFloat64(MaxQueryTimeCount.WithLabelValues("")) - exceeded; n != 1 {
+			t.Errorf("Expected exceeded request counted, got %v", n)
+		}
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n max_query_time\n to 1.1.1.1\n}",
+		"dnsredir . {\n max_query_time 1ms\n to 1.1.1.1\n}",
+		"dnsredir . {\n max_query_time 16s\n to 1.1.1.1\n}",
+		"dnsredir . {\n max_query_time 1s noerror\n to 1.1.1.1\n}",
+		"dnsredir . {\n max_query_time 1s foo\n to 1.1.1.1\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := newReloadableUpstream(c); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestAnswerCacheOpt(t *testing.T) {
+	c := newAnswerCache(time.Minute)
+	now := time.Now()
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"})
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Answer = []dns.RR{coretest.A("example.com. 60 IN A 192.0.2.1")}
+	reply.Extra = []dns.RR{dns.Copy(opt)}
+	c.add(&request.Request{W: &coretest.ResponseWriter{}, Req: req}, reply, now)
+
+	// Another client without EDNS0
+	req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	cached := c.get(&request.Request{W: &coretest.ResponseWriter{}, Req: req}, now)
+	if cached == nil || cached.IsEdns0() != nil {
+		t.Fatalf("Expected cached answer without OPT, got %v", cached)
+	}
+
+	req.SetEdns0(1232, false)
+	cached = c.get(&request.Request{W: &coretest.ResponseWriter{}, Req: req}, now)
+	if cached == nil {
+		t.Fatalf("Expected cached answer")
+	}
+	if opt := cached.IsEdns0(); opt == nil || opt.UDPSize() != 1232 || len(opt.Option) != 0 {
+		t.Errorf("Expected OPT rebuilt from the request, got %v", opt)
+	}
+}
+
+func TestCacheMinTtl(t *testing.T) {
+	var queries int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Qtype != dns.TypeNS {
+			// Health checks aren't counted
+			atomic.AddInt32(&queries, 1)
+			m.Answer = []dns.RR{coretest.A(req.Question[0].Name + " 1 IN A 192.0.2.1")}
+		}
+		_ = w.WriteMsg(m)
+	})
+	defer s.Close()
+
+	input := fmt.Sprintf("dnsredir . {\n cache_min_ttl 1m\n to %v\n}", s.Addr)
+	r := newTestDnsredir(t, input)
+	u := (*r.Upstreams)[0].(*reloadableUpstream)
+	u.HealthCheck.Start()
+	defer u.HealthCheck.Stop()
+
+	hits := testutil.ToFloat64(AnswerCacheHitCount.WithLabelValues(""))
+	for i, test := range []struct {
+		name    string
+		qtype   uint16
+		queries int32
+	}{
+		{"example.com.", dns.TypeA, 1},
+		// Cached regardless of the 1s record TTL, query name is case-insensitive
+		{"EXAMPLE.com.", dns.TypeA, 1},
+		{"example.com.", dns.TypeAAAA, 2},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+		rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+		if _, err := r.ServeDNS(context.Background(), rec, req); err != nil || rec.Msg == nil {
+			t.Fatalf("Test#%v ServeDNS() failed: %v", i, err)
+		}
+		if rec.Msg.Id != req.Id || rec.Msg.Question[0].Name != test.name || len(rec.Msg.Answer) != 1 {
+			t.Errorf("Test#%v unexpected reply %v", i, rec.Msg)
+		}
+		if n := atomic.LoadInt32(&queries); n != test.queries {
+			t.Errorf("Test#%v expected %v upstream queries, got %v", i, test.queries, n)
+		}
+	}
+	if n := testutil.ToFloat64(AnswerCacheHitCount.WithLabelValues("")) - hits; n != 1 {
+		t.Errorf("Expected 1 cache hit, got %v", n)
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n cache_min_ttl\n to 1.1.1.1\n}",
+		"dnsredir . {\n cache_min_ttl 100ms\n to 1.1.1.1\n}",
+		"dnsredir . {\n cache_min_ttl 2h\n to 1.1.1.1\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := newReloadableUpstream(c); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestUnhealthyAnswer(t *testing.T) {
+	var queries int32
+	handler := func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Qtype != dns.TypeNS {
+			// Health checks aren't counted
+			atomic.AddInt32(&queries, 1)
+			m.Answer = []dns.RR{coretest.A(req.Question[0].Name + " 60 IN A 10.0.0.1")}
+		}
+		_ = w.WriteMsg(m)
+	}
+	a := dnstest.NewServer(handler)
+	defer a.Close()
+	b := dnstest.NewServer(handler)
+	defer b.Close()
+
+	input := fmt.Sprintf("dnsredir . {\n unhealthy_answer 10.0.0.1\n to %v %v\n}", a.Addr, b.Addr)
+	r := newTestDnsredir(t, input)
+	u := (*r.Upstreams)[0].(*reloadableUpstream)
+	u.HealthCheck.Start()
+	defer u.HealthCheck.Stop()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+	start := time.Now()
+	rcode, err := r.ServeDNS(context.Background(), rec, req)
+	if rcode != dns.RcodeServerFailure || err != errUnhealthyAnswer {
+		t.Fatalf("Expected SERVFAIL with %v, got rcode: %v err: %v", errUnhealthyAnswer, rcode, err)
+	}
+	// Each host is asked once, rather than retried until the deadline
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected no retry once all hosts replied unhealthy answers, took %v", elapsed)
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("Expected 2 upstream queries, got %v", n)
+	}
+}
+
+func TestOversizedReject(t *testing.T) {
+	var queries int32
+	handler := func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Qtype != dns.TypeNS {
+			atomic.AddInt32(&queries, 1)
+			for i := 0; i < 10; i++ {
+				m.Answer = append(m.Answer, newTestRRs(t, fmt.Sprintf(`example.com. 60 IN TXT "%v"`, strings.Repeat("x", 100+i)))...)
+			}
+		}
+		_ = w.WriteMsg(m)
+	}
+	a := dnstest.NewServer(handler)
+	defer a.Close()
+	b := dnstest.NewServer(handler)
+	defer b.Close()
+
+	input := fmt.Sprintf("dnsredir . {\n max_upstream_msg_size 512\n to %v %v\n}", a.Addr, b.Addr)
+	r := newTestDnsredir(t, input)
+	u := (*r.Upstreams)[0].(*reloadableUpstream)
+	u.HealthCheck.Start()
+	defer u.HealthCheck.Stop()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	// EDNS0 buffer size clamped doesn't bound replies over TCP
+	rec := dnstest.NewRecorder(&coretest.ResponseWriter{TCP: true})
+	start := time.Now()
+	rcode, err := r.ServeDNS(context.Background(), rec, req)
+	if rcode != dns.RcodeServerFailure || err != errOversizedReply {
+		t.Fatalf("Expected SERVFAIL with %v, got rcode: %v err: %v", errOversizedReply, rcode, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected no retry once all hosts replied oversized replies, took %v", elapsed)
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("Expected 2 upstream queries, got %v", n)
+	}
+}
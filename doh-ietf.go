@@ -50,7 +50,7 @@ func (uh *UpstreamHost) ietfDnsExchange(ctx context.Context, state *request.Requ
 		return nil, err
 	}
 	req.Header.Set("Accept", headerAccept)
-	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("User-Agent", uh.transport.userAgent)
 	return uh.httpClient.Do(req)
 }
 
@@ -70,8 +70,9 @@ func (uh *UpstreamHost) ietfDnsParseResponse(state *request.Request, resp *http.
 	// Unlike ietf.go#parseResponseIETF(), we won't try to rectify TTLs due to networking latency.
 	//	since longest latency difference is less than 10 seconds, which tolerant for daily usage.
 	// Since we don't want to introduce too many complexities over this CoreDNS plugin.
-	reply := new(dns.Msg)
-	if err := reply.Unpack(body); err != nil {
+	keepRawReply(resp.Request.Context(), body)
+	reply, err := unpackReply(body, uh.sanitize)
+	if err != nil {
 		return nil, err
 	}
 	if reply.Id == 0 {
@@ -61,7 +61,7 @@ func (uh *UpstreamHost) jsonDnsExchange(ctx context.Context, state *request.Requ
 		return nil, err
 	}
 	req.Header.Set("Accept", headerAccept)
-	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("User-Agent", uh.transport.userAgent)
 	return uh.httpClient.Do(req)
 }
 
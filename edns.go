@@ -0,0 +1,226 @@
+package dnsredir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"strconv"
+	"strings"
+)
+
+// Return the first EDNS0 option with given code, nil if not found
+func findEdns0Option(m *dns.Msg, code uint16) dns.EDNS0 {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == code {
+				return o
+			}
+		}
+	}
+	return nil
+}
+
+// Remove all EDNS0 options with given code in place
+func removeEdns0Option(m *dns.Msg, code uint16) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != code {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// Names of well-known EDNS0 option codes, see: https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-11
+var edns0OptionCodes = map[string]uint16{
+	"LLQ":       dns.EDNS0LLQ,
+	"UL":        dns.EDNS0UL,
+	"NSID":      dns.EDNS0NSID,
+	"DAU":       dns.EDNS0DAU,
+	"DHU":       dns.EDNS0DHU,
+	"N3U":       dns.EDNS0N3U,
+	"SUBNET":    dns.EDNS0SUBNET,
+	"ECS":       dns.EDNS0SUBNET,
+	"EXPIRE":    dns.EDNS0EXPIRE,
+	"COOKIE":    dns.EDNS0COOKIE,
+	"KEEPALIVE": dns.EDNS0TCPKEEPALIVE,
+	"PADDING":   dns.EDNS0PADDING,
+	"EDE":       dns.EDNS0EDE,
+}
+
+// Option code is either a well-known name(case-insensitive) or a 16-bit integer
+func stringToEdns0Option(s string) (uint16, bool) {
+	if code, ok := edns0OptionCodes[strings.ToUpper(s)]; ok {
+		return code, true
+	}
+	code, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return uint16(code), true
+}
+
+// Check if the message has any EDNS0 option not in `codes'
+func hasEdns0OptionExcept(m *dns.Msg, codes map[uint16]struct{}) bool {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if _, ok := codes[o.Option()]; !ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Remove all EDNS0 options not in `codes' in place
+func keepEdns0Options(m *dns.Msg, codes map[uint16]struct{}) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if _, ok := codes[o.Option()]; ok {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// Syntax: forward_edns CODE...
+func parseForwardEdns(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	if u.forwardEdns == nil {
+		u.forwardEdns = make(map[uint16]struct{})
+	}
+	for _, arg := range args {
+		code, ok := stringToEdns0Option(arg)
+		if !ok {
+			return c.Errf("%v: unknown EDNS0 option %q", dir, arg)
+		}
+		u.forwardEdns[code] = struct{}{}
+	}
+	log.Infof("%v: %v", dir, args)
+	return nil
+}
+
+const (
+	// Requests are matched regardless of DNS Cookie
+	cookieAny = iota
+	// Only requests with a DNS Cookie are matched
+	cookiePresent
+	// Only requests without a DNS Cookie are matched
+	cookieAbsent
+)
+
+var cookieActions = map[string]int{
+	"present": cookiePresent,
+	"absent":  cookieAbsent,
+}
+
+// Check if the request carried a well-formed DNS Cookie, see: https://tools.ietf.org/html/rfc7873#section-4
+// Requests over TCP are considered cookie-bearing, since their source addresses can't be spoofed trivially.
+// Server cookies can't be verified without the secret of the server generated them, thus only lengths are checked.
+func hasCookie(state *request.Request) bool {
+	if state.Proto() == "tcp" {
+		return true
+	}
+	o, ok := findEdns0Option(state.Req, dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE)
+	if !ok {
+		return false
+	}
+	// Cookie in hex, client cookie is 8 bytes, optional server cookie is 8 to 32 bytes
+	n := len(o.Cookie)
+	return n == 16 || (n >= 32 && n <= 80 && n%2 == 0)
+}
+
+// Negotiate EDNS0 TCP Keepalive with the client, see: https://tools.ietf.org/html/rfc7828
+// The keepalive option from upstream hosts is about upstream-facing connections, thus always removed
+func setTcpKeepalive(state *request.Request, reply *dns.Msg, timeout uint16) {
+	removeEdns0Option(reply, dns.EDNS0TCPKEEPALIVE)
+	// The option MUST NOT be sent over UDP, nor sent unless the client sent it
+	if state.Proto() != "tcp" || findEdns0Option(state.Req, dns.EDNS0TCPKEEPALIVE) == nil {
+		return
+	}
+
+	opt := reply.IsEdns0()
+	if opt == nil {
+		reply.SetEdns0(uint16(state.Size()), state.Do())
+		opt = reply.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{
+		Code:    dns.EDNS0TCPKEEPALIVE,
+		Length:  2,
+		Timeout: timeout,
+	})
+}
+
+// EDNS0 local option carrying the loop detection nonce, see: https://tools.ietf.org/html/rfc6891#section-9
+const loopDetectOption = 65300
+
+// Nonce of this CoreDNS process, thus forwarding to itself(even via another dnsredir block) is detected too
+var loopNonce = func() []byte {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("rand.Read() failed, error: %v", err))
+	}
+	return b
+}()
+
+// Check if the request carried our loop detection nonce, i.e. it's forwarded by us and looped back
+// Each dnsredir of a forwarding chain appends its own nonce, so loops spanning multiple processes are detected.
+func isLooped(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == loopDetectOption && bytes.Equal(local.Data, loopNonce) {
+			return true
+		}
+	}
+	return false
+}
+
+// Append our loop detection nonce to the query in place
+// A minimal OPT is added to queries without EDNS0, which is stripped from the reply, see: stripLoopNonce()
+func addLoopNonce(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.MinMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: loopDetectOption, Data: loopNonce})
+}
+
+// Undo addLoopNonce() on the reply, in case upstream hosts echoed the option
+func stripLoopNonce(state *request.Request, reply *dns.Msg) {
+	if state.Req.IsEdns0() == nil {
+		// The client didn't send OPT, thus it mustn't receive one, see: https://tools.ietf.org/html/rfc6891#section-7
+		stripOpt(reply)
+		return
+	}
+	removeEdns0Option(reply, loopDetectOption)
+}
+
+// Remove OPT record(if any) from the additional section in place
+func stripOpt(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
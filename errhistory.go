@@ -0,0 +1,56 @@
+package dnsredir
+
+import (
+	"sync"
+	"time"
+)
+
+// Maximum size of per-host exchange error history
+const maxErrorHistory = 1024
+
+type exchangeError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+	Qname string    `json:"qname"`
+}
+
+// A fixed-size ring buffer of the last exchange errors of a host, which is exported via the admin endpoint
+// So failure patterns(e.g. timeouts vs connection resets) can be examined after the fact.
+type errorHistory struct {
+	sync.Mutex
+	errs []exchangeError
+	next int  // Index of the slot to be overwritten next
+	full bool // Whether all slots are used
+}
+
+func newErrorHistory(size int) *errorHistory {
+	return &errorHistory{errs: make([]exchangeError, size)}
+}
+
+// Record an exchange error, the oldest one is overwritten if the history is full
+// nil history records nothing
+func (h *errorHistory) add(qname string, err error, now time.Time) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.errs[h.next] = exchangeError{Time: now, Error: err.Error(), Qname: qname}
+	if h.next++; h.next == len(h.errs) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// Return a copy of recorded errors, from the oldest to the newest
+func (h *errorHistory) snapshot() []exchangeError {
+	if h == nil {
+		return nil
+	}
+	h.Lock()
+	defer h.Unlock()
+	if !h.full {
+		return append([]exchangeError(nil), h.errs[:h.next]...)
+	}
+	return append(append([]exchangeError(nil), h.errs[h.next:]...), h.errs[:h.next]...)
+}
@@ -0,0 +1,38 @@
+package dnsredir
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestErrorHistory(t *testing.T) {
+	var nilHistory *errorHistory
+	nilHistory.add("example.com.", errors.New("ignored"), time.Now())
+	if errs := nilHistory.snapshot(); errs != nil {
+		t.Errorf("nil history shouldn't record errors, got %v", errs)
+	}
+
+	h := newErrorHistory(3)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		h.add("example.com.", fmt.Errorf("error %v", i), now)
+	}
+	if errs := h.snapshot(); len(errs) != 2 || errs[0].Error != "error 0" || errs[1].Error != "error 1" {
+		t.Errorf("Unexpected history: %v", errs)
+	}
+
+	for i := 2; i < 5; i++ {
+		h.add("example.com.", fmt.Errorf("error %v", i), now)
+	}
+	errs := h.snapshot()
+	if len(errs) != 3 {
+		t.Fatalf("Expected 3 errors, got %v", errs)
+	}
+	for i, e := range errs {
+		if expected := fmt.Sprintf("error %v", i+2); e.Error != expected || e.Qname != "example.com." {
+			t.Errorf("Expected error#%v %q, got %v", i, expected, e)
+		}
+	}
+}
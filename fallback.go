@@ -0,0 +1,82 @@
+package dnsredir
+
+import (
+	"context"
+	"errors"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"sync/atomic"
+	"time"
+)
+
+// Separator of links of a transport fallback chain in TO..., e.g. "doh://1.1.1.1/dns-query|tls://1.1.1.1|tcp://1.1.1.1"
+// The first link is the host itself, which is selected, health checked and counted as a whole,
+//	the others are tried in order once the preceding one fails, so filtering of a protocol degrades gracefully.
+const fallbackSeparator = "|"
+
+// Return links of the fallback chain starting from the one worked last time
+func (uh *UpstreamHost) chain() []*UpstreamHost {
+	links := append([]*UpstreamHost{uh}, uh.fallbacks...)
+	i := int(atomic.LoadInt32(&uh.preferred))
+	return append(links[i:], links[:i]...)
+}
+
+// Remember the link worked, see: chain()
+func (uh *UpstreamHost) prefer(link *UpstreamHost) {
+	if link == uh {
+		atomic.StoreInt32(&uh.preferred, 0)
+		return
+	}
+	for i, l := range uh.fallbacks {
+		if l == link {
+			if atomic.SwapInt32(&uh.preferred, int32(i+1)) != int32(i+1) {
+				log.Infof("Transport of %v falls back to %v", uh.Name(), link.Name())
+			}
+			return
+		}
+	}
+}
+
+// Check if the link should be given up for the next one, i.e. the transport itself failed
+// A reply failed to unpack came through the transport, and a cached connection closed is retried by the caller.
+func fallbackError(err error) bool {
+	var ue *unpackError
+	return err != errCachedConnClosed && !errors.As(err, &ue)
+}
+
+// Exchange with links of the fallback chain in order until one succeeds, see: exchangeOnce()
+func (uh *UpstreamHost) exchange(ctx context.Context, state *request.Request, proto string, bootstrap []string, ipPref ipPreference) (*dns.Msg, error) {
+	if len(uh.fallbacks) == 0 {
+		return uh.exchangeOnce(ctx, state, proto, bootstrap, ipPref)
+	}
+	var reply *dns.Msg
+	var err error
+	for _, link := range uh.chain() {
+		reply, err = link.exchangeOnce(ctx, state, proto, bootstrap, ipPref)
+		if err == nil {
+			uh.prefer(link)
+			return reply, nil
+		}
+		if !fallbackError(err) || ctx.Err() != nil {
+			break
+		}
+		log.Debugf("Exchange with %v failed, try next transport  error: %v", link.Name(), err)
+	}
+	return reply, err
+}
+
+// Health check links of the fallback chain in order until one succeeds, see: send()
+func (uh *UpstreamHost) sendChain() (error, time.Duration) {
+	if len(uh.fallbacks) == 0 {
+		return uh.send()
+	}
+	var err error
+	var rtt time.Duration
+	for _, link := range uh.chain() {
+		if err, rtt = link.send(); err == nil {
+			uh.prefer(link)
+			break
+		}
+	}
+	return err, rtt
+}
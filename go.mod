@@ -7,8 +7,10 @@ require (
 	github.com/coredns/coredns v1.8.4
 	github.com/digineo/go-ipset/v2 v2.2.1
 	github.com/m13253/dns-over-https v1.4.2
+	github.com/mdlayher/netlink v1.1.2-0.20201013204415-ded538f7f4be
 	github.com/miekg/dns v1.1.42
 	github.com/prometheus/client_golang v1.10.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/ti-mo/netfilter v0.4.0 // indirect
 	golang.org/x/net v0.0.0-20210503060351-7fd8e65b6420
 )
@@ -3,6 +3,7 @@ package dnsredir
 import (
 	"context"
 	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/coredns/coredns/request"
@@ -12,10 +13,12 @@ import (
 	"net"
 	"net/http"
 	"net/http/cookiejar"
+	"net/http/httptrace"
 	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -38,7 +41,13 @@ type Transport struct {
 
 	recursionDesired bool          // RD flag
 	expire           time.Duration // [sic] After this duration a connection is expired
+	fixedDialTimeout time.Duration // Dial timeout used for new connections, zero to auto-tune
+	tcpProbePercent  float64       // Percentage of UDP exchanges sent over TCP instead
+	udpSndbuf        int           // SO_SNDBUF of UDP sockets, zero to use system default
+	udpRcvbuf        int           // SO_RCVBUF of UDP sockets, zero to use system default
+	userAgent        string        // User-Agent of DNS-over-HTTPS requests
 	tlsConfig        *tls.Config
+	tlsSessionCache  int // Capacity of TLS session cache for session resumption, zero if disabled
 
 	conns [typeTotalCount][]*persistConn // Buckets for udp, tcp and tcp-tls
 	dial  chan string
@@ -166,11 +175,52 @@ type UpstreamHostDownFunc func(*UpstreamHost) bool
 
 // UpstreamHost represents a single upstream DNS server
 type UpstreamHost struct {
+	// Unix nanoseconds when the host last recovered from down, zero if never
+	// Keep it the first field, 64-bit atomic operations require 64-bit alignment on 32-bit platforms
+	recoveredAt int64
+	// Health check backoff of a failing host, both are zero if the last health check succeeded
+	// nextCheck is Unix nanoseconds before which health checks are skipped, see: checkDue()
+	nextCheck    int64
+	checkBackoff int64
+	// Non-zero if a health check is in flight, so probes of a hanging host never pile up, see: Check()
+	checking int32
+	// Limit concurrent health checks among hosts of the upstream, nil if unlimited
+	checkSem chan struct{}
+
 	proto string // DNS protocol, i.e. "udp", "tcp", etc.
 	addr  string // IP:PORT
 
+	timeout time.Duration // Exchange timeout, zero to use the default, see: maxReadTimeout
+	// Re-marshal replies before forwarding, see: unpackReply()
+	sanitize bool
+	// Hosts of the same endpoint over other transports tried in order once this one fails, see: fallback.go
+	fallbacks []*UpstreamHost
+	// Index of the link of the fallback chain worked last time, which is tried first
+	preferred int32
+
 	fails    int32                // Fail count
 	downFunc UpstreamHostDownFunc // This function should be side-effect safe
+	// Non-zero if excluded from selection for maintenance via admin endpoint, which isn't a failure
+	draining int32
+	// In-flight exchanges, hosts reached maxInflight are excluded from selection
+	// None is selected(i.e. SERVFAIL) if all hosts are saturated, see: unsaturatedPool()
+	inflight    int32
+	maxInflight int32 // Zero if unlimited
+
+	lastCheck atomic.Value // Result of last health check(i.e. checkResult)
+
+	breaker *circuitBreaker // nil if circuit breaker disabled
+
+	errors *errorHistory // Last exchange errors, nil if disabled
+
+	// Key of the shared transport, empty if the transport isn't shared, see: acquireTransport()
+	poolKey string
+
+	// Hosts with lower priority are preferred, weight is used to distribute load among hosts with the same priority
+	// Both are zero unless the host is discovered via SRV
+	priority uint16
+	weight   uint16
+	srvName  string // SRV name which the host discovered via, empty if statically configured
 
 	c *dns.Client // DNS client used for health check
 
@@ -183,6 +233,12 @@ type UpstreamHost struct {
 	requestContentType string
 }
 
+type checkResult struct {
+	time time.Time
+	rtt  time.Duration
+	err  string // Empty if health check succeeded
+}
+
 func (uh *UpstreamHost) Name() string {
 	return uh.proto + "://" + uh.addr
 }
@@ -196,26 +252,17 @@ func (uh *UpstreamHost) InitDOH(u *reloadableUpstream) {
 		return
 	}
 
-	var resolver *net.Resolver
-	if len(u.bootstrap) != 0 {
-		resolver = &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				var d net.Dialer
-				// Randomly choose a bootstrap DNS to resolve upstream host
-				addr := u.bootstrap[rand.Intn(len(u.bootstrap))]
-				return d.DialContext(ctx, network, addr)
-			},
-		}
-	} else {
-		// Fallback to use system default resolvers, which located at /etc/resolv.conf
-	}
+	// Fallback to use system default resolvers(i.e. nil), which located at /etc/resolv.conf
+	resolver := bootstrapResolver(u.bootstrap, u.ipPref)
 
 	dialer := &net.Dialer{
 		Timeout:   8 * time.Second,
 		KeepAlive: 30 * time.Second,
 		Resolver:  resolver,
 	}
+	if uh.transport.fixedDialTimeout != 0 {
+		dialer.Timeout = uh.transport.fixedDialTimeout
+	}
 	httpTransport := &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
 		DialContext:           dialer.DialContext,
@@ -226,12 +273,31 @@ func (uh *UpstreamHost) InitDOH(u *reloadableUpstream) {
 		TLSHandshakeTimeout:   8 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
-	if u.noIPv6 {
+	if tlsConfig := u.transport.tlsConfig; tlsConfig.MinVersion != 0 || len(tlsConfig.CipherSuites) != 0 || u.transport.tlsSessionCache != 0 {
+		httpTransport.TLSClientConfig = &tls.Config{
+			MinVersion:   tlsConfig.MinVersion,
+			CipherSuites: tlsConfig.CipherSuites,
+		}
+		if u.transport.tlsSessionCache != 0 {
+			httpTransport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(u.transport.tlsSessionCache)
+		}
+	}
+	if u.ipPref != ipAny {
 		httpTransport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			if strings.HasPrefix(network, "tcp") {
-				network = "tcp4"
+			addrs, err := u.ipPref.resolve(ctx, resolver, addr)
+			if err != nil {
+				return nil, err
+			}
+			if addrs == nil {
+				return dialer.DialContext(ctx, u.ipPref.network(network), addr)
+			}
+			var conn net.Conn
+			for _, addr := range addrs {
+				if conn, err = dialer.DialContext(ctx, network, addr); err == nil {
+					break
+				}
 			}
-			return dialer.DialContext(ctx, network, addr)
+			return conn, err
 		}
 	}
 
@@ -274,6 +340,9 @@ func limitDialTimeout(currentAvg *int64, minValue, maxValue time.Duration) time.
 }
 
 func (t *Transport) dialTimeout() time.Duration {
+	if t.fixedDialTimeout != 0 {
+		return t.fixedDialTimeout
+	}
 	return limitDialTimeout(&t.avgDialTime, minDialTimeout, maxDialTimeout)
 }
 
@@ -283,62 +352,72 @@ func (t *Transport) updateDialTimeout(newDialTime time.Duration) {
 	atomic.AddInt64(&t.avgDialTime, dt/cumulativeAvgWeight)
 }
 
-func dialTimeout0(network, address string, tlsConfig *tls.Config, timeout time.Duration, bootstrap []string, noIPv6 bool) (*dns.Conn, error) {
-	var resolver *net.Resolver
-
-	if len(bootstrap) != 0 {
-		resolver = &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				if noIPv6 {
-					if strings.HasPrefix(network, "tcp") {
-						network = "tcp4"
-					}
-					if strings.HasPrefix(network, "udp") {
-						network = "udp4"
-					}
-				}
-				var d net.Dialer
-				// Randomly choose a bootstrap DNS to resolve upstream host
-				addr := bootstrap[rand.Intn(len(bootstrap))]
-				return d.DialContext(ctx, network, addr)
-			},
-		}
-	} else {
-		// Fallback to use system default resolvers, which located at /etc/resolv.conf
-	}
+func dialTimeout0(network, address string, tlsConfig *tls.Config, timeout time.Duration, bootstrap []string, ipPref ipPreference, control func(string, string, syscall.RawConn) error) (*dns.Conn, error) {
+	// Fallback to use system default resolvers(i.e. nil), which located at /etc/resolv.conf
+	resolver := bootstrapResolver(bootstrap, ipPref)
 
+	deadline := time.Now().Add(timeout)
 	dialer := &net.Dialer{
 		Timeout:  timeout,
 		Resolver: resolver,
+		// All resolved addresses(if any) share the same timeout
+		Deadline: deadline,
+		Control:  control,
+	}
+	client := dns.Client{Net: ipPref.network(network), Dialer: dialer, TLSConfig: tlsConfig}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	addrs, err := ipPref.resolve(ctx, resolver, address)
+	if err != nil {
+		return nil, err
+	}
+	if addrs == nil {
+		return client.Dial(address)
+	}
+
+	if tlsConfig != nil && tlsConfig.ServerName == "" {
+		// Since we dial the resolved IP addresses, TLS server name must be preserved
+		host, _, _ := net.SplitHostPort(address)
+		client.TLSConfig = tlsConfig.Clone()
+		client.TLSConfig.ServerName = host
+	}
+	var conn *dns.Conn
+	for _, addr := range addrs {
+		if conn, err = client.Dial(addr); err == nil {
+			break
+		}
 	}
-	client := dns.Client{Net: network, Dialer: dialer, TLSConfig: tlsConfig}
-	return client.Dial(address)
+	return conn, err
 }
 
 // [sic] DialTimeoutWithTLS acts like DialWithTLS but takes a timeout.
 // Taken from dns.DialTimeoutWithTLS() with modification
-func dialTimeoutWithTLS(network, address string, tlsConfig *tls.Config, timeout time.Duration, bootstrap []string, noIPv6 bool) (*dns.Conn, error) {
+func dialTimeoutWithTLS(network, address string, tlsConfig *tls.Config, timeout time.Duration, bootstrap []string, ipPref ipPreference) (*dns.Conn, error) {
 	if !strings.HasSuffix(network, "-tls") {
 		network += "-tls"
 	}
-	return dialTimeout0(network, address, tlsConfig, timeout, bootstrap, noIPv6)
+	return dialTimeout0(network, address, tlsConfig, timeout, bootstrap, ipPref, nil)
 }
 
 // [sic] DialTimeout acts like Dial but takes a timeout.
 // Taken from dns.DialTimeout() with modification
-func dialTimeout(network, address string, timeout time.Duration, bootstrap []string, noIPv6 bool) (*dns.Conn, error) {
-	return dialTimeout0(network, address, nil, timeout, bootstrap, noIPv6)
+func dialTimeout(network, address string, timeout time.Duration, bootstrap []string, ipPref ipPreference, control func(string, string, syscall.RawConn) error) (*dns.Conn, error) {
+	return dialTimeout0(network, address, nil, timeout, bootstrap, ipPref, control)
 }
 
 // Return:
 //	#0	Persistent connection
 //	#1	true if it's a cached connection
 //	#2	error(if any)
-func (uh *UpstreamHost) Dial(proto string, bootstrap []string, noIPv6 bool) (*persistConn, bool, error) {
+func (uh *UpstreamHost) Dial(ctx context.Context, proto string, bootstrap []string, ipPref ipPreference) (*persistConn, bool, error) {
 	if uh.proto != "dns" {
 		proto = protoToNetwork(uh.proto)
 	}
+	if proto == "udp" && hitPercent(uh.transport.tcpProbePercent) {
+		// Keep the cached TCP connection exercised, so TCP path problems surface proactively
+		proto = "tcp"
+	}
 
 	uh.transport.dial <- proto
 	pc := <-uh.transport.ret
@@ -347,23 +426,57 @@ func (uh *UpstreamHost) Dial(proto string, bootstrap []string, noIPv6 bool) (*pe
 	}
 
 	reqTime := time.Now()
-	timeout := uh.transport.dialTimeout()
+	timeout := ctxTimeout(ctx, uh.transport.dialTimeout())
 	if proto == "tcp-tls" {
-		conn, err := dialTimeoutWithTLS(proto, uh.addr, uh.transport.tlsConfig, timeout, bootstrap, noIPv6)
+		conn, err := dialTimeoutWithTLS(proto, uh.addr, uh.transport.tlsConfig, timeout, bootstrap, ipPref)
 		uh.transport.updateDialTimeout(time.Since(reqTime))
 		if err != nil {
 			return nil, false, err
 		}
+		uh.observeConnect(proto, time.Since(reqTime))
 		return &persistConn{c: conn}, false, err
 	}
-	conn, err := dialTimeout(proto, uh.addr, timeout, bootstrap, noIPv6)
+	conn, err := dialTimeout(proto, uh.addr, timeout, bootstrap, ipPref, uh.transport.udpControl())
 	uh.transport.updateDialTimeout(time.Since(reqTime))
 	if err != nil {
 		return nil, false, err
 	}
+	if proto != "udp" {
+		// UDP "connection" involves no handshake, it's meaningless to observe
+		uh.observeConnect(proto, time.Since(reqTime))
+	}
 	return &persistConn{c: conn}, false, err
 }
 
+// Return `d' capped by the remaining time until deadline of `ctx'(if any)
+func ctxTimeout(ctx context.Context, d time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if remain := time.Until(deadline); remain < d {
+			return remain
+		}
+	}
+	return d
+}
+
+func (uh *UpstreamHost) observeConnect(transport string, d time.Duration) {
+	ConnectDuration.WithLabelValues(uh.Name(), transport).Observe(d.Seconds())
+}
+
+// Observe connection establishment of DoH requests, connections reused by the HTTP transport aren't observed
+func (uh *UpstreamHost) connectTrace(ctx context.Context) context.Context {
+	var start time.Time
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(string) {
+			start = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused && !start.IsZero() {
+				uh.observeConnect(uh.proto, time.Since(start))
+			}
+		},
+	})
+}
+
 func (uh *UpstreamHost) dohExchange(ctx context.Context, state *request.Request) (*dns.Msg, error) {
 	var (
 		resp *http.Response
@@ -380,6 +493,7 @@ func (uh *UpstreamHost) dohExchange(ctx context.Context, state *request.Request)
 		}
 	}
 
+	ctx = uh.connectTrace(ctx)
 	switch requestContentType {
 	case mimeTypeDnsJson:
 		resp, err = uh.jsonDnsExchange(ctx, state, requestContentType)
@@ -415,12 +529,149 @@ func (uh *UpstreamHost) dohExchange(ctx context.Context, state *request.Request)
 	}
 }
 
-func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bootstrap []string, noIPv6 bool) (*dns.Msg, error) {
+// Upstream host replied with a DNS message which fails to unpack
+type unpackError struct {
+	err error
+}
+
+func (e *unpackError) Error() string {
+	return fmt.Sprintf("failed to unpack reply: %v", e.err)
+}
+
+func (e *unpackError) Unwrap() error { return e.err }
+
+// Unpack the reply, which is re-marshaled(i.e. packed then unpacked again) if `sanitize', so the client only sees
+//	a well-formed, re-serialized message. A malformed additional section is dropped as a whole(including OPT)
+//	with `sanitize', rather than failing the whole reply, since answer and authority sections are intact.
+func unpackReply(p []byte, sanitize bool) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	err := m.Unpack(p)
+	if !sanitize {
+		if err != nil {
+			return nil, &unpackError{err}
+		}
+		return m, nil
+	}
+	if err != nil {
+		if len(p) < dnsHeaderSize {
+			return nil, &unpackError{err}
+		}
+		// Section counts, see: https://tools.ietf.org/html/rfc1035#section-4.1.1
+		ancount, nscount := binary.BigEndian.Uint16(p[6:]), binary.BigEndian.Uint16(p[8:])
+		if len(m.Answer) != int(ancount) || len(m.Ns) != int(nscount) {
+			return nil, &unpackError{err}
+		}
+		log.Debugf("Malformed additional section dropped, error: %v", err)
+		m.Extra = nil
+	}
+
+	b, err := m.Pack()
+	if err != nil {
+		return nil, &unpackError{err}
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(b); err != nil {
+		return nil, &unpackError{err}
+	}
+	return ret, nil
+}
+
+// Returned if a stream(i.e. TCP, TLS) upstream host claimed a reply length it failed to deliver
+type shortReadError struct {
+	length uint16 // Claimed length
+	err    error
+}
+
+func (e *shortReadError) Error() string {
+	return fmt.Sprintf("short read of %v bytes reply: %v", e.length, e.err)
+}
+
+func (e *shortReadError) Unwrap() error { return e.err }
+
+// Read a reply from the connection, stream connections are read with the 2-byte length prefix
+//	replies up to 65535 bytes are read fully, see: https://tools.ietf.org/html/rfc1035#section-4.2.2
+// Unlike dns.Conn.ReadMsgHeader(), connection closed in the middle of a reply yields a shortReadError
+//	rather than io.EOF, which would be mistaken for a closed idle connection otherwise.
+func readMsg(co *dns.Conn) ([]byte, error) {
+	if _, ok := co.Conn.(net.PacketConn); ok {
+		return co.ReadMsgHeader(nil)
+	}
+
+	var l [2]byte
+	if _, err := io.ReadFull(co.Conn, l[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, &shortReadError{err: err}
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint16(l[:])
+	p := make([]byte, length)
+	if _, err := io.ReadFull(co.Conn, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, &shortReadError{length, err}
+	}
+	if length < dnsHeaderSize {
+		return nil, &shortReadError{length, dns.ErrShortRead}
+	}
+	return p, nil
+}
+
+// Size of DNS message header, see: https://tools.ietf.org/html/rfc1035#section-4.1.1
+const dnsHeaderSize = 12
+
+// Context key of a *[]byte, which receives wire format of the reply read(if any), see: log_mismatch
+type rawReplyKey struct{}
+
+// Keep wire format of the reply read if asked by the context, `p' shouldn't be reused afterwards
+func keepRawReply(ctx context.Context, p []byte) {
+	if raw, ok := ctx.Value(rawReplyKey{}).(*[]byte); ok {
+		*raw = p
+	}
+}
+
+func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bootstrap []string, ipPref ipPreference) (*dns.Msg, error) {
+	return uh.exchange(ctx, state, state.Proto(), bootstrap, ipPref)
+}
+
+// Check if the host may be exchanged over UDP, i.e. the protocol follows the request, or UDP is forced
+func (uh *UpstreamHost) udpCapable() bool {
+	return uh.proto == "dns" || uh.proto == "udp"
+}
+
+// Check if the host is exchanged over a stream(i.e. TCP, TLS, HTTPS), where TC bit is meaningless
+// `proto' is the protocol followed by "dns://" hosts, see: exchange()
+func (uh *UpstreamHost) streamCapable(proto string) bool {
+	switch uh.proto {
+	case "dns":
+		return proto != "udp"
+	case "udp":
+		return false
+	}
+	return true
+}
+
+// Exchange over `proto'(i.e. "udp" or "tcp") rather than the protocol of the request, see: Exchange()
+// It's only effective if the host follows protocol of the request, i.e. "dns://"
+// The transport fallback chain(if any) isn't tried, see: exchange()
+func (uh *UpstreamHost) exchangeOnce(ctx context.Context, state *request.Request, proto string, bootstrap []string, ipPref ipPreference) (*dns.Msg, error) {
+	readTimeout := maxReadTimeout
+	if uh.timeout != 0 {
+		readTimeout = uh.timeout
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, uh.timeout)
+		defer cancel()
+	}
+
 	if uh.IsDOH() {
 		return uh.dohExchange(ctx, state)
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	pc, cached, err := uh.Dial(state.Proto(), bootstrap, noIPv6)
+	pc, cached, err := uh.Dial(ctx, proto, bootstrap, ipPref)
 	if err != nil {
 		return nil, err
 	}
@@ -435,7 +686,7 @@ func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bo
 		pc.c.UDPSize = dns.MinMsgSize
 	}
 
-	_ = pc.c.SetWriteDeadline(time.Now().Add(maxWriteTimeout))
+	_ = pc.c.SetWriteDeadline(time.Now().Add(ctxTimeout(ctx, maxWriteTimeout)))
 	if err := pc.c.WriteMsg(state.Req); err != nil {
 		Close(pc.c)
 		if err == io.EOF && cached {
@@ -444,8 +695,9 @@ func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bo
 		return nil, err
 	}
 
-	_ = pc.c.SetReadDeadline(time.Now().Add(maxReadTimeout))
-	ret, err := pc.c.ReadMsg()
+	_ = pc.c.SetReadDeadline(time.Now().Add(ctxTimeout(ctx, readTimeout)))
+	// Read and unpack separately, so unpack errors can be distinguished from connection errors
+	p, err := readMsg(pc.c)
 	if err != nil {
 		Close(pc.c)
 		if err == io.EOF && cached {
@@ -453,6 +705,12 @@ func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bo
 		}
 		return nil, err
 	}
+	keepRawReply(ctx, p)
+	ret, err := unpackReply(p, uh.sanitize)
+	if err != nil {
+		Close(pc.c)
+		return nil, err
+	}
 	if state.Req.Id != ret.Id {
 		Close(pc.c)
 		// Unlike coredns/plugin/forward/connect.go drop out-of-order responses
@@ -471,18 +729,88 @@ func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bo
 // Dial timeouts and empty replies are considered fails
 // 	basically anything else constitutes a healthy upstream.
 func (uh *UpstreamHost) Check() error {
-	if err, rtt := uh.send(); err != nil {
+	if !atomic.CompareAndSwapInt32(&uh.checking, 0, 1) {
+		log.Debugf("hc: DNS %v skipped since last health check still in flight", uh.Name())
+		return nil
+	}
+	defer atomic.StoreInt32(&uh.checking, 0)
+	if uh.checkSem != nil {
+		// Health checks exceed the concurrency limit are queued, thus staggered
+		uh.checkSem <- struct{}{}
+		defer func() { <-uh.checkSem }()
+	}
+
+	err, rtt := uh.sendChain()
+	res := checkResult{time: time.Now(), rtt: rtt}
+	if err != nil {
+		res.err = err.Error()
+	}
+	uh.lastCheck.Store(res)
+
+	if err != nil {
 		HealthCheckFailureCount.WithLabelValues(uh.Name()).Inc()
 		atomic.AddInt32(&uh.fails, 1)
-		log.Warningf("hc: DNS %v failed  rtt: %v err: %v", uh.Name(), rtt, err)
+		backoff := uh.backoff()
+		log.Warningf("hc: DNS %v failed  rtt: %v err: %v next check after: %v", uh.Name(), rtt, err, backoff)
 		return err
 	} else {
-		// Reset failure counter once health check success
+		wasDown := uh.down()
+		// Reset failure counter and backoff once health check success
 		atomic.StoreInt32(&uh.fails, 0)
+		atomic.StoreInt64(&uh.checkBackoff, 0)
+		atomic.StoreInt64(&uh.nextCheck, 0)
+		if wasDown && !uh.down() {
+			uh.markRecovered()
+		}
 		return nil
 	}
 }
 
+// Double the health check backoff of a failing host(capped by maxCheckBackoff), return the new backoff
+// Concurrent failed health checks may double it more than once, which is harmless.
+func (uh *UpstreamHost) backoff() time.Duration {
+	backoff := 2 * time.Duration(atomic.LoadInt64(&uh.checkBackoff))
+	if backoff < minCheckBackoff {
+		backoff = minCheckBackoff
+	} else if backoff > maxCheckBackoff {
+		backoff = maxCheckBackoff
+	}
+	atomic.StoreInt64(&uh.checkBackoff, int64(backoff))
+	atomic.StoreInt64(&uh.nextCheck, time.Now().Add(backoff).UnixNano())
+	return backoff
+}
+
+// Check if the host is due for a health check, i.e. not backing off
+func (uh *UpstreamHost) checkDue() bool {
+	return time.Now().UnixNano() >= atomic.LoadInt64(&uh.nextCheck)
+}
+
+func (uh *UpstreamHost) markRecovered() {
+	atomic.StoreInt64(&uh.recoveredAt, time.Now().UnixNano())
+	log.Infof("%v recovered", uh.Name())
+}
+
+// Return fraction of full traffic share the host should receive in range (0, 1]
+// A just-recovered host ramps up linearly over `ramp' duration
+func (uh *UpstreamHost) rampFraction(ramp time.Duration) float64 {
+	if ramp <= 0 {
+		return 1
+	}
+	t := atomic.LoadInt64(&uh.recoveredAt)
+	if t == 0 {
+		return 1
+	}
+	elapsed := time.Since(time.Unix(0, t))
+	if elapsed >= ramp {
+		return 1
+	}
+	if elapsed <= 0 {
+		// Always let a tiny fraction through, so the ramp makes progress
+		return 1 / float64(ramp/time.Millisecond+1)
+	}
+	return float64(elapsed) / float64(ramp)
+}
+
 func (uh *UpstreamHost) send() (error, time.Duration) {
 	if uh.IsDOH() {
 		return uh.dohSend()
@@ -495,8 +823,11 @@ func (uh *UpstreamHost) dohSend() (error, time.Duration) {
 	req.SetQuestion(".", dns.TypeNS)
 	req.MsgHdr.RecursionDesired = uh.transport.recursionDesired
 	state := &request.Request{Req: req}
+	// Bound the whole HTTP request, the underlying HTTP client has no overall timeout
+	ctx, cancel := context.WithTimeout(context.Background(), uh.c.Timeout)
+	defer cancel()
 	t := time.Now()
-	msg, err := uh.dohExchange(context.Background(), state)
+	msg, err := uh.dohExchange(ctx, state)
 	rtt := time.Since(t)
 	if err != nil && msg != nil {
 		if msg.Response || msg.Opcode == dns.OpcodeQuery {
@@ -537,10 +868,9 @@ type UpstreamHostPool []*UpstreamHost
 func (uh *UpstreamHost) Down() bool {
 	if uh.downFunc == nil {
 		log.Warningf("Upstream host %v have no downFunc, fallback to default", uh.Name())
-		return atomic.LoadInt32(&uh.fails) > 0
 	}
 
-	down := uh.downFunc(uh)
+	down := uh.down()
 	if down {
 		log.Debugf("%v marked as down...", uh.Name())
 		HealthCheckAllDownCount.WithLabelValues(uh.Name()).Inc()
@@ -548,25 +878,93 @@ func (uh *UpstreamHost) Down() bool {
 	return down
 }
 
+func (uh *UpstreamHost) drained() bool {
+	return atomic.LoadInt32(&uh.draining) != 0
+}
+
+func (uh *UpstreamHost) setDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&uh.draining, v)
+}
+
+// Side-effect free version of Down(), i.e. no logging nor metrics
+func (uh *UpstreamHost) down() bool {
+	if uh.breaker != nil {
+		return uh.breaker.down()
+	}
+	if uh.downFunc == nil {
+		return atomic.LoadInt32(&uh.fails) > 0
+	}
+	return uh.downFunc(uh)
+}
+
 type HealthCheck struct {
 	wg   sync.WaitGroup // Wait until all running goroutines to stop
 	stop chan struct{}  // Signal health check worker to stop
 
-	hosts  UpstreamHostPool
+	hosts  UpstreamHostPool // Statically configured hosts
+	pool   atomic.Value     // Current UpstreamHostPool if hosts are discovered dynamically, see: srv.go
 	policy Policy
 	spray  Policy
+	// Policy swapped in at runtime(i.e. a policyHolder), which takes precedence over `policy', see: setPolicy()
+	swapped atomic.Value
 
 	// [PENDING]
 	//failTimeout time.Duration	// Single health check timeout
 
 	maxFails      int32         // Maximum fail count considered as down
 	checkInterval time.Duration // Health check interval
+	checkTimeout  time.Duration // Timeout of a single health check, including dial
+	checkSem      chan struct{} // Limit concurrent health checks, nil if unlimited
+	recoveryRamp  time.Duration // Duration to ramp up traffic to a recovered host, zero to disable
+
+	// Circuit breaker settings, zero threshold if disabled
+	breakerThreshold int32
+	breakerCooldown  time.Duration
+
+	// Number of last exchange errors kept per host, zero if disabled
+	errorHistory int
 
 	// A global transport since Caddy doesn't support over nested blocks
 	transport *Transport
 }
 
+// Return current hosts, the returned pool should be treated as read-only
+func (hc *HealthCheck) loadHosts() UpstreamHostPool {
+	if pool, ok := hc.pool.Load().(UpstreamHostPool); ok {
+		return pool
+	}
+	return hc.hosts
+}
+
+// atomic.Value requires values of the same concrete type
+type policyHolder struct {
+	Policy
+}
+
+// Current selection policy, nil if the default policy(i.e. random) is used
+func (hc *HealthCheck) loadPolicy() Policy {
+	if p, ok := hc.swapped.Load().(policyHolder); ok {
+		return p.Policy
+	}
+	return hc.policy
+}
+
+// Swap the selection policy in place, hosts and their connections are left intact
+// The swapped policy persists until the upstream is rebuilt by a Corefile reload.
+func (hc *HealthCheck) setPolicy(p Policy) {
+	hc.swapped.Store(policyHolder{p})
+}
+
 func (hc *HealthCheck) Start() {
+	// Shared transports are swapped in, before health checks use them
+	for _, host := range hc.hosts {
+		host.startTransport()
+	}
+
 	if hc.checkInterval != 0 {
 		hc.wg.Add(1)
 		go func() {
@@ -574,24 +972,44 @@ func (hc *HealthCheck) Start() {
 			hc.healthCheckWorker()
 		}()
 	}
-
-	for _, host := range hc.hosts {
-		host.transport.Start()
-	}
 }
 
 func (hc *HealthCheck) Stop() {
 	close(hc.stop)
 	hc.wg.Wait()
 
-	for _, host := range hc.hosts {
-		host.transport.Stop()
+	for _, host := range hc.loadHosts() {
+		host.stopTransport()
+	}
+}
+
+func (uh *UpstreamHost) startTransport() {
+	for _, link := range uh.fallbacks {
+		link.startTransport()
+	}
+	if uh.poolKey != "" {
+		uh.transport = acquireTransport(uh.poolKey, uh.transport)
+		return
 	}
+	uh.transport.Start()
+}
+
+func (uh *UpstreamHost) stopTransport() {
+	for _, link := range uh.fallbacks {
+		link.stopTransport()
+	}
+	if uh.poolKey != "" {
+		releaseTransport(uh.poolKey)
+		return
+	}
+	uh.transport.Stop()
 }
 
 func (hc *HealthCheck) healthCheck() {
-	for _, host := range hc.hosts {
-		go host.Check()
+	for _, host := range hc.loadHosts() {
+		if host.checkDue() {
+			go host.Check()
+		}
 	}
 }
 
@@ -610,10 +1028,209 @@ func (hc *HealthCheck) healthCheckWorker() {
 	}
 }
 
+// AllDown checks whether all upstream hosts are down, side-effect free
+// Draining hosts are considered as down, since they won't be selected
+func (hc *HealthCheck) AllDown() bool {
+	for _, host := range hc.loadHosts() {
+		if !host.down() && !host.drained() {
+			return false
+		}
+	}
+	return true
+}
+
+// Exclude draining hosts from the pool, which may be empty if all hosts are draining
+func undrainedPool(pool UpstreamHostPool) UpstreamHostPool {
+	var undrained UpstreamHostPool
+	for i, host := range pool {
+		if !host.drained() {
+			if undrained != nil {
+				undrained = append(undrained, host)
+			}
+			continue
+		}
+		if undrained == nil {
+			undrained = make(UpstreamHostPool, i, len(pool))
+			copy(undrained, pool[:i])
+		}
+	}
+	if undrained == nil {
+		return pool
+	}
+	return undrained
+}
+
+func (uh *UpstreamHost) saturated() bool {
+	return uh.maxInflight != 0 && atomic.LoadInt32(&uh.inflight) >= uh.maxInflight
+}
+
+// Exclude hosts reached their in-flight limit from the pool, which may be empty if all hosts are saturated
+func unsaturatedPool(pool UpstreamHostPool) UpstreamHostPool {
+	var unsaturated UpstreamHostPool
+	for i, host := range pool {
+		if !host.saturated() {
+			if unsaturated != nil {
+				unsaturated = append(unsaturated, host)
+			}
+			continue
+		}
+		if unsaturated == nil {
+			unsaturated = make(UpstreamHostPool, i, len(pool))
+			copy(unsaturated, pool[:i])
+		}
+	}
+	if unsaturated == nil {
+		return pool
+	}
+	return unsaturated
+}
+
+// Exclude ramping-up hosts from the pool probabilistically, so they receive a linearly increasing traffic share
+// The original pool will be returned if no up host left after exclusion
+func (hc *HealthCheck) rampedPool(pool UpstreamHostPool) UpstreamHostPool {
+	if hc.recoveryRamp == 0 || len(pool) <= 1 {
+		return pool
+	}
+
+	var ramped UpstreamHostPool
+	for i, host := range pool {
+		if rand.Float64() < host.rampFraction(hc.recoveryRamp) {
+			if ramped != nil {
+				ramped = append(ramped, host)
+			}
+			continue
+		}
+		if ramped == nil {
+			ramped = make(UpstreamHostPool, i, len(pool))
+			copy(ramped, pool[:i])
+		}
+	}
+	if ramped == nil {
+		return pool
+	}
+	for _, host := range ramped {
+		if !host.down() {
+			return ramped
+		}
+	}
+	return pool
+}
+
+// Return hosts of the most preferred(i.e. lowest) priority tier which has any up host
+// The original pool will be returned if all hosts are down
+func tieredPool(pool UpstreamHostPool) UpstreamHostPool {
+	if len(pool) <= 1 {
+		return pool
+	}
+	single := true
+	for _, host := range pool {
+		if host.priority != pool[0].priority {
+			single = false
+			break
+		}
+	}
+	if single {
+		return pool
+	}
+
+	found := false
+	var priority uint16
+	for _, host := range pool {
+		if (!found || host.priority < priority) && !host.down() {
+			found = true
+			priority = host.priority
+		}
+	}
+	if !found {
+		return pool
+	}
+
+	var tier UpstreamHostPool
+	for _, host := range pool {
+		if host.priority == priority {
+			tier = append(tier, host)
+		}
+	}
+	return tier
+}
+
 // Select an upstream host based on the policy and the health check result
 // Taken from proxy/healthcheck/healthcheck.go with modification
 func (hc *HealthCheck) Select() *UpstreamHost {
-	pool := hc.hosts
+	return hc.SelectClient("")
+}
+
+// Select an upstream host for the client(i.e. client IP), which is honored by client-aware policies
+//	e.g. client_affinity, empty if the client is unknown
+func (hc *HealthCheck) SelectClient(client string) *UpstreamHost {
+	return hc.selectTraced(client, nil)
+}
+
+// Equivalent to SelectClient(), why each host was selected or skipped is recorded in the trace
+func (hc *HealthCheck) selectTraced(client string, tr *queryTrace) *UpstreamHost {
+	hosts := hc.loadHosts()
+	undrained := undrainedPool(hosts)
+	unsaturated := unsaturatedPool(undrained)
+	tiered := tieredPool(unsaturated)
+	pool := hc.rampedPool(tiered)
+	h := hc.selectClient(pool, client)
+	tr.addf("policy: %v", policyName(hc.loadPolicy()))
+	countSelection(hosts, undrained, unsaturated, tiered, pool, h, tr)
+	return h
+}
+
+// Selection decision reasons, see: SelectionCount
+const (
+	selectionSelected         = "selected"
+	selectionSkippedUnhealthy = "skipped_unhealthy"
+	selectionSkippedThrottled = "skipped_throttled"
+	selectionSkippedTier      = "skipped_tier"
+	selectionSkippedDrained   = "skipped_drained"
+	selectionSkippedSaturated = "skipped_saturated"
+)
+
+func poolContains(pool UpstreamHostPool, host *UpstreamHost) bool {
+	for _, h := range pool {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Record why each host was selected or skipped
+// `undrained', `unsaturated', `tiered' and `pool' are the hosts left after draining, in-flight limit,
+//	priority tiering and recovery ramp respectively
+// Up hosts not chosen by the policy are not counted, as they're neither selected nor skipped.
+func countSelection(hosts, undrained, unsaturated, tiered, pool UpstreamHostPool, selected *UpstreamHost, tr *queryTrace) {
+	for _, host := range hosts {
+		var reason string
+		switch {
+		case host == selected:
+			reason = selectionSelected
+		case len(undrained) != len(hosts) && !poolContains(undrained, host):
+			reason = selectionSkippedDrained
+		case len(unsaturated) != len(undrained) && !poolContains(unsaturated, host):
+			reason = selectionSkippedSaturated
+		case len(tiered) != len(unsaturated) && !poolContains(tiered, host):
+			reason = selectionSkippedTier
+		case len(pool) != len(tiered) && !poolContains(pool, host):
+			reason = selectionSkippedThrottled
+		case host.down():
+			reason = selectionSkippedUnhealthy
+		default:
+			tr.addf("host %v not chosen by policy", host.Name())
+			continue
+		}
+		tr.addf("host %v %v", host.Name(), reason)
+		SelectionCount.WithLabelValues(host.Name(), reason).Inc()
+	}
+}
+
+func (hc *HealthCheck) selectClient(pool UpstreamHostPool, client string) *UpstreamHost {
+	if len(pool) == 0 {
+		return nil
+	}
 	if len(pool) == 1 {
 		if pool[0].Down() && hc.spray == nil {
 			return nil
@@ -635,7 +1252,8 @@ func (hc *HealthCheck) Select() *UpstreamHost {
 		return hc.spray.Select(pool)
 	}
 
-	if hc.policy == nil {
+	policy := hc.loadPolicy()
+	if policy == nil {
 		// Default policy is random
 		h := (&Random{}).Select(pool)
 		if h != nil {
@@ -647,7 +1265,12 @@ func (hc *HealthCheck) Select() *UpstreamHost {
 		return hc.spray.Select(pool)
 	}
 
-	h := hc.policy.Select(pool)
+	var h *UpstreamHost
+	if p, ok := policy.(clientPolicy); ok && client != "" {
+		h = p.SelectClient(pool, client)
+	} else {
+		h = policy.Select(pool)
+	}
 	if h != nil {
 		return h
 	}
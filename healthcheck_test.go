@@ -1,9 +1,28 @@
 package dnsredir
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	coretest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"math/big"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -85,3 +104,780 @@ func TestSend(t *testing.T) {
 		}
 	}
 }
+
+func TestHealthCheckTimeout(t *testing.T) {
+	// A blackholed host which never replies
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() failed: %v", err)
+	}
+	defer pc.Close()
+
+	input := fmt.Sprintf("dnsredir . {\n to udp://%v \n health_check_timeout 100ms \n}", pc.LocalAddr())
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+	uh := up.(*reloadableUpstream).hosts[0]
+
+	start := time.Now()
+	if err := uh.Check(); err == nil {
+		t.Fatalf("Expected health check to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected health check to time out after 100ms, took %v", elapsed)
+	}
+	if atomic.LoadInt32(&uh.fails) != 1 || atomic.LoadInt64(&uh.checkBackoff) == 0 {
+		t.Errorf("Expected timed out health check counted as a failure and backed off")
+	}
+
+	// Health check in flight isn't repeated
+	atomic.StoreInt32(&uh.checking, 1)
+	if err := uh.Check(); err != nil || atomic.LoadInt32(&uh.fails) != 1 {
+		t.Errorf("Expected health check skipped, got err: %v fails: %v", err, atomic.LoadInt32(&uh.fails))
+	}
+
+	c = caddy.NewTestController("dns", "dnsredir . {\n to 1.1.1.1 \n health_check_timeout 10ms \n}")
+	if _, err := newReloadableUpstream(c); err == nil {
+		t.Errorf("Expected error for timeout less than %v", minHcTimeout)
+	}
+}
+
+func TestHealthCheckConcurrency(t *testing.T) {
+	var inflight, maxInflight int32
+	handler := func(w dns.ResponseWriter, req *dns.Msg) {
+		n := atomic.AddInt32(&inflight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInflight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&inflight, -1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		_ = w.WriteMsg(m)
+	}
+	var addrs []string
+	for i := 0; i < 4; i++ {
+		s := dnstest.NewServer(handler)
+		defer s.Close()
+		addrs = append(addrs, "udp://"+s.Addr)
+	}
+
+	input := fmt.Sprintf("dnsredir . {\n to %v \n health_check_concurrency 2 \n}", strings.Join(addrs, " "))
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+
+	var wg sync.WaitGroup
+	for _, uh := range up.(*reloadableUpstream).hosts {
+		wg.Add(1)
+		go func(uh *UpstreamHost) {
+			defer wg.Done()
+			if err := uh.Check(); err != nil {
+				t.Errorf("Check() failed: %v", err)
+			}
+		}(uh)
+	}
+	wg.Wait()
+	if max := atomic.LoadInt32(&maxInflight); max != 2 {
+		t.Errorf("Expected at most 2 health checks in flight, got %v", max)
+	}
+}
+
+func TestRecoveryRamp(t *testing.T) {
+	ramp := 10 * s
+	uh := &UpstreamHost{proto: "udp", addr: "127.0.0.1:53"}
+	if f := uh.rampFraction(ramp); f != 1 {
+		t.Fatalf("Never recovered host should have full share, got %v", f)
+	}
+
+	atomic.StoreInt64(&uh.recoveredAt, time.Now().Add(-ramp/2).UnixNano())
+	if f := uh.rampFraction(ramp); f < 0.45 || f > 0.55 {
+		t.Fatalf("Expected about half share in the middle of ramp, got %v", f)
+	}
+	if f := uh.rampFraction(0); f != 1 {
+		t.Fatalf("Expected full share with ramp disabled, got %v", f)
+	}
+
+	atomic.StoreInt64(&uh.recoveredAt, time.Now().Add(-ramp).UnixNano())
+	if f := uh.rampFraction(ramp); f != 1 {
+		t.Fatalf("Expected full share after ramp, got %v", f)
+	}
+
+	// A just-recovered host should be excluded, unless no other host is up
+	other := &UpstreamHost{proto: "udp", addr: "127.0.0.2:53"}
+	hc := &HealthCheck{hosts: UpstreamHostPool{uh, other}, recoveryRamp: time.Hour}
+	atomic.StoreInt64(&uh.recoveredAt, time.Now().UnixNano())
+	for i := 0; i < 100; i++ {
+		if pool := hc.rampedPool(hc.hosts); len(pool) != 1 || pool[0] != other {
+			t.Fatalf("Expected the recovered host to be excluded, got %v", pool)
+		}
+	}
+	atomic.StoreInt32(&other.fails, 1)
+	if pool := hc.rampedPool(hc.hosts); len(pool) != 2 {
+		t.Fatalf("Expected the original pool if no other host is up, got %v", pool)
+	}
+}
+
+func TestCheckBackoff(t *testing.T) {
+	uh := &UpstreamHost{proto: "udp", addr: "127.0.0.1:53"}
+	if !uh.checkDue() {
+		t.Fatalf("Expected a never checked host to be due")
+	}
+
+	expected := minCheckBackoff
+	for i := 0; i < 10; i++ {
+		if backoff := uh.backoff(); backoff != expected {
+			t.Fatalf("Backoff#%v expected %v, got %v", i, expected, backoff)
+		}
+		if uh.checkDue() {
+			t.Fatalf("Backoff#%v expected the host not to be due", i)
+		}
+		if expected *= 2; expected > maxCheckBackoff {
+			expected = maxCheckBackoff
+		}
+	}
+
+	atomic.StoreInt64(&uh.nextCheck, time.Now().Add(-time.Millisecond).UnixNano())
+	if !uh.checkDue() {
+		t.Fatalf("Expected the host to be due after backoff")
+	}
+}
+
+func TestExchangeUnpackError(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() failed: %v", err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 2 {
+				continue
+			}
+			// Keep the ID, QR set, one question with a truncated label
+			reply := []byte{buf[0], buf[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0, 0x3f, 'a'}
+			_, _ = pc.WriteTo(reply, addr)
+		}
+	}()
+
+	input := fmt.Sprintf("dnsredir . {\n to %v \n}", pc.LocalAddr())
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+	u := up.(*reloadableUpstream)
+	u.checkInterval = 0
+	u.HealthCheck.Start()
+	defer u.HealthCheck.Stop()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	state := &request.Request{W: &coretest.ResponseWriter{}, Req: req}
+	_, err = u.hosts[0].Exchange(context.Background(), state, nil, ipAny)
+	var ue *unpackError
+	if !errors.As(err, &ue) {
+		t.Fatalf("Expected unpack error, got %v", err)
+	}
+}
+
+func TestTransportFallback(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{coretest.A("example.com. 60 IN A 192.0.2.1")}
+		_ = w.WriteMsg(m)
+	})
+	defer s.Close()
+	// A closed port, which refuses connections
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	closed := ln.Addr().String()
+	_ = ln.Close()
+
+	input := fmt.Sprintf("dnsredir . {\n to tcp://%v|udp://%v 1.2.3.4 \n}", closed, s.Addr)
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+	u := up.(*reloadableUpstream)
+	if len(u.hosts) != 2 || len(u.hosts[0].fallbacks) != 1 || len(u.hosts[1].fallbacks) != 0 {
+		t.Fatalf("Unexpected hosts %v", u.hosts)
+	}
+	u.checkInterval = 0
+	u.HealthCheck.Start()
+	defer u.HealthCheck.Stop()
+	host := u.hosts[0]
+
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		state := &request.Request{W: &coretest.ResponseWriter{}, Req: req}
+		reply, err := host.Exchange(context.Background(), state, nil, ipAny)
+		if err != nil || len(reply.Answer) != 1 {
+			t.Fatalf("Exchange#%v failed  reply: %v error: %v", i, reply, err)
+		}
+		if p := atomic.LoadInt32(&host.preferred); p != 1 {
+			t.Errorf("Exchange#%v expected the fallback preferred, got %v", i, p)
+		}
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n to 1.1.1.1| \n}",
+		"dnsredir . {\n to |1.1.1.1 \n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := newReloadableUpstream(c); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestUnpackReply(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Response = true
+	m.Answer = newTestRRs(t, "example.com. 60 IN A 192.0.2.1")
+	m.Ns = newTestRRs(t, "example.com. 60 IN NS ns.example.com.")
+	m.Extra = newTestRRs(t, "ns.example.com. 60 IN A 192.0.2.53")
+	p, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Pack() failed: %v", err)
+	}
+	// Cut RDATA of the additional record
+	extra := p[:len(p)-2]
+	// Cut the answer record right after the owner name, which is a compression pointer
+	answer := p[:dnsHeaderSize+len("\x07example\x03com\x00")+4+2]
+
+	tests := []struct {
+		p         []byte
+		sanitize  bool
+		shouldErr bool
+		extras    int
+	}{
+		{p, false, false, 1},
+		{p, true, false, 1},
+		{extra, false, true, 0},
+		{extra, true, false, 0},
+		{answer, true, true, 0},
+	}
+	for i, test := range tests {
+		reply, err := unpackReply(test.p, test.sanitize)
+		var ue *unpackError
+		if test.shouldErr {
+			if !errors.As(err, &ue) {
+				t.Errorf("Test#%v failed  expected unpack error, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test#%v failed  unexpected error: %v", i, err)
+			continue
+		}
+		if len(reply.Answer) != 1 || len(reply.Ns) != 1 || len(reply.Extra) != test.extras {
+			t.Errorf("Test#%v failed  unexpected reply: %v", i, reply)
+		}
+	}
+}
+
+func TestStaticPriority(t *testing.T) {
+	input := `dnsredir . {
+	to priority=0 weight=3 1.1.1.1
+	to weight=1 priority=0 8.8.8.8
+	to priority=10 9.9.9.9
+}`
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+	u := up.(*reloadableUpstream)
+	if len(u.hosts) != 3 {
+		t.Fatalf("Expected 3 hosts, got %v", u.hosts)
+	}
+	a, b, z := u.hosts[0], u.hosts[1], u.hosts[2]
+	if a.priority != 0 || a.weight != 3 || b.priority != 0 || b.weight != 1 || z.priority != 10 || z.weight != 0 {
+		t.Fatalf("Unexpected priority or weight: %v %v %v", a.status(), b.status(), z.status())
+	}
+
+	counts := make(map[*UpstreamHost]int)
+	for i := 0; i < 4000; i++ {
+		counts[u.Select()]++
+	}
+	if counts[z] != 0 {
+		t.Errorf("Higher priority host shouldn't be selected if any lower priority host is up")
+	}
+	if counts[a] < 2700 || counts[a] > 3300 {
+		t.Errorf("Expected about 3000 selections of weight 3 host, got %v", counts[a])
+	}
+
+	atomic.StoreInt32(&a.fails, u.maxFails)
+	atomic.StoreInt32(&b.fails, u.maxFails)
+	if host := u.Select(); host != z {
+		t.Errorf("Expected failover to higher priority host, got %v", host)
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n to priority=65536 1.1.1.1\n}",
+		"dnsredir . {\n to weight=-1 1.1.1.1\n}",
+		"dnsredir . {\n to priority=1\n}",
+		"dnsredir . {\n to priority=1 srv://_dns._udp.example.com\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := newReloadableUpstream(c); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestSelectionCount(t *testing.T) {
+	input := `dnsredir . {
+	to priority=0 192.0.2.1 192.0.2.2
+	to priority=10 192.0.2.3
+}`
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+	u := up.(*reloadableUpstream)
+	a, b, z := u.hosts[0], u.hosts[1], u.hosts[2]
+	count := func(host *UpstreamHost, reason string) float64 {
+		return testutil.ToFloat64(SelectionCount.WithLabelValues(host.Name(), reason))
+	}
+
+	atomic.StoreInt32(&b.fails, u.maxFails)
+	for i := 0; i < 10; i++ {
+		if host := u.Select(); host != a {
+			t.Fatalf("Expected the only up host in lowest tier, got %v", host)
+		}
+	}
+	if n := count(a, selectionSelected); n != 10 {
+		t.Errorf("Expected 10 selected, got %v", n)
+	}
+	if n := count(b, selectionSkippedUnhealthy); n != 10 {
+		t.Errorf("Expected 10 skipped_unhealthy, got %v", n)
+	}
+	if n := count(z, selectionSkippedTier); n != 10 {
+		t.Errorf("Expected 10 skipped_tier, got %v", n)
+	}
+
+	// Pretend b just recovered, it should be throttled by the recovery ramp
+	atomic.StoreInt32(&b.fails, 0)
+	atomic.StoreInt64(&b.recoveredAt, time.Now().UnixNano())
+	u.recoveryRamp = time.Hour
+	for i := 0; i < 10; i++ {
+		u.Select()
+	}
+	if n := count(b, selectionSkippedThrottled) + count(b, selectionSelected); n != 10 {
+		t.Errorf("Expected 10 skipped_throttled or selected, got %v", n)
+	}
+	if n := count(b, selectionSkippedThrottled); n == 0 {
+		t.Errorf("Expected recovering host to be throttled")
+	}
+	if n := count(z, selectionSkippedTier); n != 20 {
+		t.Errorf("Expected 20 skipped_tier, got %v", n)
+	}
+}
+
+func TestMaxInflight(t *testing.T) {
+	input := `dnsredir . {
+	max_inflight 2
+	to priority=0 192.0.2.11
+	to priority=10 192.0.2.12
+}`
+	r := newTestDnsredir(t, input)
+	u := (*r.Upstreams)[0].(*reloadableUpstream)
+	a, b := u.hosts[0], u.hosts[1]
+
+	atomic.StoreInt32(&a.inflight, 1)
+	if host := u.Select(); host != a {
+		t.Fatalf("Expected the host below its limit selected, got %v", host)
+	}
+
+	// Saturated host is skipped, even in favor of a higher priority host
+	atomic.StoreInt32(&a.inflight, 2)
+	before := testutil.ToFloat64(SelectionCount.WithLabelValues(a.Name(), selectionSkippedSaturated))
+	if host := u.Select(); host != b {
+		t.Fatalf("Expected the unsaturated host selected, got %v", host)
+	}
+	if n := testutil.ToFloat64(SelectionCount.WithLabelValues(a.Name(), selectionSkippedSaturated)) - before; n != 1 {
+		t.Errorf("Expected 1 skipped_saturated, got %v", n)
+	}
+
+	atomic.StoreInt32(&b.inflight, 2)
+	if host := u.Select(); host != nil {
+		t.Errorf("Expected no host selected with all hosts saturated, got %v", host)
+	}
+
+	// Replied with SERVFAIL rather than overloading a saturated host
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	rcode, err := r.ServeDNS(context.Background(), dnstest.NewRecorder(&coretest.ResponseWriter{}), req)
+	if rcode != dns.RcodeServerFailure || err != errNoHealthy {
+		t.Errorf("Expected SERVFAIL with %v, got rcode: %v err: %v", errNoHealthy, rcode, err)
+	}
+}
+
+// Start a mock TCP upstream, which replies each query with raw bytes(including the length prefix) returned by reply()
+// The connection will be closed after the reply if close is true
+func newTestTcpUpstream(t *testing.T, reply func(req *dns.Msg) (p []byte, close bool)) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				co := &dns.Conn{Conn: conn}
+				for {
+					req, err := co.ReadMsg()
+					if err != nil {
+						return
+					}
+					p, close := reply(req)
+					if _, err := conn.Write(p); err != nil || close {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func newTestTcpHost(t *testing.T, addr net.Addr) (*reloadableUpstream, *UpstreamHost) {
+	input := fmt.Sprintf("dnsredir . {\n to tcp://%v \n}", addr)
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+	u := up.(*reloadableUpstream)
+	u.checkInterval = 0
+	u.HealthCheck.Start()
+	return u, u.hosts[0]
+}
+
+func TestExchangeTcpMaxSize(t *testing.T) {
+	ln := newTestTcpUpstream(t, func(req *dns.Msg) ([]byte, bool) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{strings.Repeat("x", 255)},
+		}}
+		p, _ := m.Pack()
+		// Pad the reply to the maximal size, OPT RR and padding option header take 11 + 4 bytes
+		opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, dns.MaxMsgSize-len(p)-11-4)})
+		m.Extra = append(m.Extra, opt)
+		p, err := m.Pack()
+		if err != nil || len(p) != dns.MaxMsgSize {
+			panic(fmt.Sprintf("Unexpected reply size %v, error: %v", len(p), err))
+		}
+		return append([]byte{byte(len(p) >> 8), byte(len(p))}, p...), false
+	})
+	defer ln.Close()
+
+	u, host := newTestTcpHost(t, ln.Addr())
+	defer u.HealthCheck.Stop()
+
+	// Subsequent exchanges reuse the cached connection
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeTXT)
+		state := &request.Request{W: &coretest.ResponseWriter{}, Req: req}
+		reply, err := host.Exchange(context.Background(), state, nil, ipAny)
+		if err != nil {
+			t.Fatalf("Exchange#%v failed: %v", i, err)
+		}
+		if len(reply.Answer) != 1 || reply.IsEdns0() == nil {
+			t.Fatalf("Exchange#%v unexpected reply: %v", i, reply.MsgHdr)
+		}
+	}
+}
+
+func TestConnectDuration(t *testing.T) {
+	ln := newTestTcpUpstream(t, func(req *dns.Msg) ([]byte, bool) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		p, _ := m.Pack()
+		return append([]byte{byte(len(p) >> 8), byte(len(p))}, p...), false
+	})
+	defer ln.Close()
+
+	u, host := newTestTcpHost(t, ln.Addr())
+	defer u.HealthCheck.Stop()
+
+	count := func() uint64 {
+		var m dto.Metric
+		if err := ConnectDuration.WithLabelValues(host.Name(), tcpProto).(prometheus.Histogram).Write(&m); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		state := &request.Request{W: &coretest.ResponseWriter{}, Req: req}
+		if _, err := host.Exchange(context.Background(), state, nil, ipAny); err != nil {
+			t.Fatalf("Exchange() failed: %v", err)
+		}
+		// Only the first exchange establishes a new connection, later ones reuse the cached connection
+		if n := count(); n != 1 {
+			t.Errorf("Exchange#%v expected 1 connection observed, got %v", i, n)
+		}
+	}
+}
+
+func TestExchangeTcpShortRead(t *testing.T) {
+	tests := []struct {
+		p      []byte
+		length uint16
+	}{
+		// Claim 1000 bytes, yet deliver a header only
+		{[]byte{0x03, 0xe8, 0, 0, 0x81, 0x80, 0, 0, 0, 0, 0, 0, 0, 0}, 1000},
+		// Claim 1000 bytes, yet deliver nothing
+		{[]byte{0x03, 0xe8}, 1000},
+		// Claimed length is shorter than a header
+		{[]byte{0x00, 0x02, 0, 0}, 2},
+		// Half of the length prefix
+		{[]byte{0x03}, 0},
+	}
+	for i, test := range tests {
+		ln := newTestTcpUpstream(t, func(req *dns.Msg) ([]byte, bool) {
+			p := append([]byte(nil), test.p...)
+			if len(p) >= 4 {
+				p[2], p[3] = byte(req.Id>>8), byte(req.Id)
+			}
+			return p, true
+		})
+		u, host := newTestTcpHost(t, ln.Addr())
+
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		state := &request.Request{W: &coretest.ResponseWriter{}, Req: req}
+		_, err := host.Exchange(context.Background(), state, nil, ipAny)
+		var se *shortReadError
+		if !errors.As(err, &se) || se.length != test.length {
+			t.Errorf("Test#%v expected short read error of %v bytes, got %v", i, test.length, err)
+		}
+
+		u.HealthCheck.Stop()
+		_ = ln.Close()
+	}
+}
+
+// Return a self-signed certificate of `name' and a CA pool trusting it
+func newTestCert(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() failed: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTlsSessionCache(t *testing.T) {
+	cert, pool := newTestCert(t, "dns.example")
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	server := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	defer server.Shutdown()
+
+	for _, size := range []int{0, 16} {
+		input := fmt.Sprintf("dnsredir . {\n to tls://%v@dns.example\n tls_session_cache %v\n}", ln.Addr(), size)
+		c := caddy.NewTestController("dns", input)
+		up, err := newReloadableUpstream(c)
+		if err != nil {
+			t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+		}
+		host := up.(*reloadableUpstream).hosts[0]
+		host.transport.tlsConfig.RootCAs = pool
+
+		for i := 0; i < 2; i++ {
+			conn, err := dialTimeoutWithTLS(tcpTlsProto, host.addr, host.transport.tlsConfig, 2*time.Second, nil, ipAny)
+			if err != nil {
+				t.Fatalf("dialTimeoutWithTLS() failed: %v", err)
+			}
+			// Read a reply, so session tickets sent after TLS 1.3 handshake are received
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			if err := conn.WriteMsg(req); err != nil {
+				t.Fatalf("WriteMsg() failed: %v", err)
+			}
+			if _, err := conn.ReadMsg(); err != nil {
+				t.Fatalf("ReadMsg() failed: %v", err)
+			}
+			resumed := conn.Conn.(*tls.Conn).ConnectionState().DidResume
+			_ = conn.Close()
+			if expected := size != 0 && i == 1; resumed != expected {
+				t.Errorf("Connection#%v expected resumed: %v with cache size %v, got %v", i, expected, size, resumed)
+			}
+		}
+	}
+}
+
+func TestIPPreferenceNetwork(t *testing.T) {
+	tests := []struct {
+		pref     ipPreference
+		network  string
+		expected string
+	}{
+		{ipAny, "udp", "udp"},
+		{ipv4Only, "udp", "udp4"},
+		{ipv4Only, "tcp-tls", "tcp4-tls"},
+		{ipv6Only, "tcp", "tcp6"},
+		{ipv6Only, "tcp-tls", "tcp6-tls"},
+		{preferIPv6, "tcp", "tcp"},
+	}
+	for i, test := range tests {
+		if network := test.pref.network(test.network); network != test.expected {
+			t.Errorf("Test#%v failed  %v %q expected %q, got %q", i, test.pref, test.network, test.expected, network)
+		}
+	}
+}
+
+func TestBootstrapIPPreference(t *testing.T) {
+	// The name only has an IPv4 address
+	bs := dnstest.NewServer(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Qtype == dns.TypeA {
+			m.Answer = []dns.RR{coretest.A(req.Question[0].Name + " 60 IN A 127.0.0.1")}
+		}
+		_ = w.WriteMsg(m)
+	})
+	defer bs.Close()
+
+	tests := []struct {
+		pref     ipPreference
+		shouldOk bool
+	}{
+		{ipAny, true},
+		{ipv4Only, true},
+		{ipv6Only, false},
+		{preferIPv4, true},
+		// Fallback to IPv4 since there is no IPv6 address
+		{preferIPv6, true},
+	}
+	for i, test := range tests {
+		conn, err := dialTimeout("udp", "v4.example.:53", 2*time.Second, []string{bs.Addr}, test.pref, nil)
+		if conn != nil {
+			Close(conn)
+		}
+		if (err == nil) != test.shouldOk {
+			t.Errorf("Test#%v failed  %v expected ok: %v, got error: %v", i, test.pref, test.shouldOk, err)
+		}
+	}
+}
+
+func TestTcpProbeRatio(t *testing.T) {
+	var udp, tcp int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.Question[0].Qtype != dns.TypeNS {
+			// Health checks aren't counted
+			if w.RemoteAddr().Network() == "tcp" {
+				atomic.AddInt32(&tcp, 1)
+			} else {
+				atomic.AddInt32(&udp, 1)
+			}
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		_ = w.WriteMsg(m)
+	})
+	defer s.Close()
+
+	tests := []struct {
+		ratio    string
+		udp, tcp int32
+	}{
+		{"0", 10, 0},
+		{"100%", 0, 10},
+	}
+	for i, test := range tests {
+		atomic.StoreInt32(&udp, 0)
+		atomic.StoreInt32(&tcp, 0)
+		input := fmt.Sprintf("dnsredir . {\n tcp_probe_ratio %v\n to %v\n}", test.ratio, s.Addr)
+		c := caddy.NewTestController("dns", input)
+		up, err := newReloadableUpstream(c)
+		if err != nil {
+			t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+		}
+		u := up.(*reloadableUpstream)
+		u.HealthCheck.Start()
+		host := u.hosts[0]
+		for j := 0; j < 10; j++ {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			state := &request.Request{W: &coretest.ResponseWriter{}, Req: req}
+			if _, err := host.Exchange(context.Background(), state, nil, ipAny); err != nil {
+				t.Fatalf("Test#%v Exchange() failed: %v", i, err)
+			}
+		}
+		u.HealthCheck.Stop()
+		if nu, nt := atomic.LoadInt32(&udp), atomic.LoadInt32(&tcp); nu != test.udp || nt != test.tcp {
+			t.Errorf("Test#%v tcp_probe_ratio %v expected udp: %v tcp: %v, got %v %v", i, test.ratio, test.udp, test.tcp, nu, nt)
+		}
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n tcp_probe_ratio\n to 1.1.1.1\n}",
+		"dnsredir . {\n tcp_probe_ratio 101\n to 1.1.1.1\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := newReloadableUpstream(c); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package dnsredir
+
+import (
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"strconv"
+	"strings"
+)
+
+// Return a reply synthesized locally without contacting upstream hosts, nil if the request should be forwarded
+func (u *reloadableUpstream) localReply(server string, state *request.Request) *dns.Msg {
+	if u.cookieTc && !hasCookie(state) {
+		log.Debugf("Truncated cookie-less request %q", state.Name())
+		m := new(dns.Msg)
+		m.SetReply(state.Req)
+		m.Truncated = true
+		return m
+	}
+	if u.strictNames && !isValidName(state.QName()) {
+		log.Debugf("Invalid query name %q", state.QName())
+		InvalidNameCount.WithLabelValues(server).Inc()
+		return newRcodeReply(state.Req, dns.RcodeFormatError)
+	}
+	if u.failNames != nil {
+		// Names in failNames are lower cased and without trailing dot, see: domainSet.Add()
+		if name := state.Name(); len(name) > 1 && u.failNames.Match(removeTrailingDot(name)) {
+			log.Debugf("%q is in fail list", name)
+			return newRcodeReply(state.Req, u.failRcode)
+		}
+	}
+	if u.maxLabels != 0 {
+		if n := dns.CountLabel(state.QName()); n > u.maxLabels {
+			log.Debugf("Too many labels %v for %q, max: %v", n, state.Name(), u.maxLabels)
+			return newRcodeReply(state.Req, u.maxLabelsRcode)
+		}
+	}
+	if u.maxNameLength != 0 {
+		// Length in presentation format, excluding the trailing dot
+		if n := len(removeTrailingDot(state.QName())); n > u.maxNameLength {
+			log.Debugf("Name too long %v for %q, max: %v", n, state.Name(), u.maxNameLength)
+			return newRcodeReply(state.Req, u.maxNameLengthRcode)
+		}
+	}
+	if qtype := state.QType(); qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		log.Debugf("Zone transfer %v isn't forwarded for %q", dns.TypeToString[qtype], state.Name())
+		return newRcodeReply(state.Req, u.xfrRcode)
+	}
+	if u.overrides != nil {
+		if reply := u.overrideReply(state); reply != nil {
+			log.Debugf("%q %v is overridden", state.Name(), dns.TypeToString[state.QType()])
+			return reply
+		}
+	}
+	if u.delegations != nil {
+		if reply := u.delegateReply(state); reply != nil {
+			log.Debugf("%q %v is referred to delegated name servers", state.Name(), dns.TypeToString[state.QType()])
+			return reply
+		}
+	}
+	return nil
+}
+
+// Check if the name(in presentation format) conforms to hostname syntax, see: https://tools.ietf.org/html/rfc1123#section-2.1
+// Underscores are allowed as well, since they're widely used in service names, e.g. `_dmarc.example.com'
+// Names with escaped characters(e.g. embedded nulls, dots inside a label) are always invalid.
+func isValidName(name string) bool {
+	if name == "." {
+		return true
+	}
+	if strings.IndexByte(name, '\\') >= 0 {
+		return false
+	}
+	for _, label := range strings.Split(removeTrailingDot(name), ".") {
+		if len(label) == 0 || len(label) > maxLabelLength {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// CHAOS query names answered by chaos_version and chaos_hostname, see: https://tools.ietf.org/html/rfc4892#section-2.2
+var chaosTxtNames = map[string][]string{
+	"chaos_version":  {"version.bind.", "version.server."},
+	"chaos_hostname": {"hostname.bind.", "id.server."},
+}
+
+// Syntax: chaos_version|chaos_hostname STRING|refuse
+func parseChaosTxt(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+
+	txt := args[0]
+	if strings.ToLower(txt) == "refuse" {
+		txt = ""
+	} else if len(txt) > 255 {
+		// Maximum length of a TXT character-string, see: https://tools.ietf.org/html/rfc1035#section-3.3
+		return c.Errf("%v: string too long: %v", dir, len(txt))
+	}
+	if u.chaosNames == nil {
+		u.chaosNames = make(map[string]string)
+		// Known CHAOS names not configured explicitly are refused
+		for _, names := range chaosTxtNames {
+			for _, name := range names {
+				u.chaosNames[name] = ""
+			}
+		}
+	}
+	for _, name := range chaosTxtNames[dir] {
+		u.chaosNames[name] = txt
+	}
+	log.Infof("%v: %q", dir, args[0])
+	return nil
+}
+
+// Return a reply for CHAOS TXT queries of known names, nil if the request should be handled as usual
+// It's checked before name list matching, thus CHAOS queries never reach upstream hosts once configured.
+func (r *Dnsredir) chaosReply(state *request.Request) *dns.Msg {
+	if r.chaosNames == nil || state.QClass() != dns.ClassCHAOS || state.QType() != dns.TypeTXT {
+		return nil
+	}
+	txt, ok := r.chaosNames[strings.ToLower(state.QName())]
+	if !ok {
+		return nil
+	}
+	if txt == "" {
+		return newRcodeReply(state.Req, dns.RcodeRefused)
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+	m.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: []string{txt},
+	}}
+	return m
+}
+
+// Return a reply of requests with disallowed opcodes, which is checked before routing, nil if the opcode is allowed
+func (r *Dnsredir) opcodeReply(state *request.Request) *dns.Msg {
+	if r.opcodes == nil {
+		return nil
+	}
+	if _, ok := r.opcodes[state.Req.Opcode]; ok {
+		return nil
+	}
+	log.Debugf("Opcode %v isn't allowed for %q", dns.OpcodeToString[state.Req.Opcode], state.Name())
+	return newRcodeReply(state.Req, r.opcodeRcode)
+}
+
+func newRcodeReply(req *dns.Msg, rcode int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	return m
+}
+
+func stringToOpcode(s string) (int, bool) {
+	if opcode, ok := dns.StringToOpcode[strings.ToUpper(s)]; ok {
+		return opcode, true
+	}
+	// Opcode is 4-bit, see: https://tools.ietf.org/html/rfc1035#section-4.1.1
+	opcode, err := strconv.Atoi(s)
+	if err != nil || opcode < 0 || opcode > 0xf {
+		return 0, false
+	}
+	return opcode, true
+}
+
+// Syntax: max_labels|max_name_length INTEGER [RCODE]
+func parseNameLimit(c *caddy.Controller) (int, int, error) {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 1 && len(args) != 2 {
+		return 0, 0, c.ArgErr()
+	}
+
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 || n > maxDomainNameLength {
+		return 0, 0, c.Errf("%v: invalid limit %q", dir, args[0])
+	}
+	rcode := dns.RcodeRefused
+	if len(args) == 2 {
+		var ok bool
+		if rcode, ok = stringToRcode(args[1]); !ok {
+			return 0, 0, c.Errf("%v: unknown RCODE %q", dir, args[1])
+		}
+	}
+	log.Infof("%v: %v %v", dir, n, dns.RcodeToString[rcode])
+	return n, rcode, nil
+}
+
+// Syntax: opcode OPCODE... [RCODE]
+func parseOpcode(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+
+	opcodes := make(map[int]struct{})
+	rcode := dns.RcodeNotImplemented
+	for i, arg := range args {
+		if opcode, ok := stringToOpcode(arg); ok {
+			opcodes[opcode] = struct{}{}
+			continue
+		}
+		if i != len(args)-1 || len(opcodes) == 0 {
+			return c.Errf("%v: unknown opcode %q", dir, arg)
+		}
+		var ok bool
+		if rcode, ok = stringToRcode(arg); !ok {
+			return c.Errf("%v: unknown opcode or RCODE %q", dir, arg)
+		}
+	}
+	u.opcodes = opcodes
+	u.opcodeRcode = rcode
+	log.Infof("%v: %v", dir, args)
+	return nil
+}
+
+// Maximum length of a domain name in wire format, see: https://tools.ietf.org/html/rfc1035#section-3.1
+const maxDomainNameLength = 255
+
+// Maximum length of a label, see: https://tools.ietf.org/html/rfc1035#section-2.3.4
+const maxLabelLength = 63
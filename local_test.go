@@ -0,0 +1,318 @@
+package dnsredir
+
+import (
+	"context"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	coretest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+)
+
+func TestLocalReply(t *testing.T) {
+	input := `dnsredir . {
+	fail telemetry.example.com
+	max_labels 4
+	max_name_length 32 NXDOMAIN
+	to 1.2.3.4
+}`
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+	u := up.(*reloadableUpstream)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int // -1 if the request should be forwarded
+	}{
+		{"example.com.", dns.TypeA, -1},
+		{".", dns.TypeNS, -1},
+		{"example.com.", dns.TypeAXFR, dns.RcodeRefused},
+		{"example.com.", dns.TypeIXFR, dns.RcodeRefused},
+		{"telemetry.example.com.", dns.TypeA, dns.RcodeServerFailure},
+		{"A.Telemetry.Example.Com.", dns.TypeAAAA, dns.RcodeServerFailure},
+		{"xtelemetry.example.com.", dns.TypeA, -1},
+		{"a.b.c.d.", dns.TypeA, -1},
+		{"a.b.c.d.e.", dns.TypeA, dns.RcodeRefused},
+		{"abcdefghijklmnopqrstuvwxyz.com.", dns.TypeA, -1},
+		{"abcdefghijklmnopqrstuvwxyz.ab.com.", dns.TypeA, dns.RcodeNameError},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+		reply := u.localReply("", &request.Request{Req: req})
+		if test.rcode < 0 {
+			if reply != nil {
+				t.Errorf("Test#%v failed  %q should be forwarded, got %v", i, test.name, dns.RcodeToString[reply.Rcode])
+			}
+			continue
+		}
+		if reply == nil || reply.Rcode != test.rcode {
+			t.Errorf("Test#%v failed  %q expected %v, got %v", i, test.name, dns.RcodeToString[test.rcode], reply)
+		}
+	}
+}
+
+func TestOpcodeReply(t *testing.T) {
+	r := newTestDnsredir(t, `
+dnsredir nonexistent.conf {
+	example.com
+	opcode QUERY REFUSED
+	to 1.2.3.4
+}`)
+	// newTestDnsredir() doesn't copy plugin level options, see: setup()
+	u := (*r.Upstreams)[0].(*reloadableUpstream)
+	r.opcodes, r.opcodeRcode = u.opcodes, u.opcodeRcode
+
+	tests := []struct {
+		name   string
+		opcode int
+		rcode  int // -1 if the request should be routed
+	}{
+		{"www.example.com.", dns.OpcodeQuery, -1},
+		{"www.example.com.", dns.OpcodeNotify, dns.RcodeRefused},
+		{"www.example.com.", dns.OpcodeUpdate, dns.RcodeRefused},
+		// Checked before routing, thus names not matched are refused too
+		{"example.net.", dns.OpcodeNotify, dns.RcodeRefused},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, dns.TypeSOA)
+		req.Opcode = test.opcode
+		reply := r.opcodeReply(&request.Request{Req: req})
+		if test.rcode < 0 {
+			if reply != nil {
+				t.Errorf("Test#%v failed  %v should be routed, got %v", i, dns.OpcodeToString[test.opcode], reply)
+			}
+			continue
+		}
+		if reply == nil || reply.Rcode != test.rcode || reply.Opcode != test.opcode {
+			t.Errorf("Test#%v failed  %v expected %v, got %v", i, dns.OpcodeToString[test.opcode], dns.RcodeToString[test.rcode], reply)
+		}
+	}
+
+	// Replied without routing, rather than passed to the next plugin
+	req := new(dns.Msg)
+	req.SetQuestion("example.net.", dns.TypeSOA)
+	req.Opcode = dns.OpcodeNotify
+	rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+	if _, err := r.ServeDNS(context.Background(), rec, req); err != nil || rec.Msg == nil || rec.Msg.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected NOTIFY refused, got %v error: %v", rec.Msg, err)
+	}
+}
+
+func TestIsValidName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{".", true},
+		{"example.com.", true},
+		{"Example-1.COM.", true},
+		{"_dmarc.example.com.", true},
+		{"xn--fiqs8s.", true},
+		{"-example.com.", false},
+		{"example-.com.", false},
+		{"exa\\000mple.com.", false},
+		{"exa\\.mple.com.", false},
+		{"exa mple.com.", false},
+		{"*.example.com.", false},
+		{strings.Repeat("a", 63) + ".com.", true},
+		{strings.Repeat("a", 64) + ".com.", false},
+	}
+	for i, test := range tests {
+		if valid := isValidName(test.name); valid != test.valid {
+			t.Errorf("Test#%v failed  %q valid: %v vs %v", i, test.name, valid, test.valid)
+		}
+	}
+}
+
+func TestChaosReply(t *testing.T) {
+	input := `dnsredir . {
+	chaos_version "dnsredir"
+	to 1.2.3.4
+}`
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+	r := &Dnsredir{chaosNames: up.(*reloadableUpstream).chaosNames}
+
+	tests := []struct {
+		name   string
+		qclass uint16
+		qtype  uint16
+		rcode  int // -1 if the request should be handled as usual
+		txt    string
+	}{
+		{"version.bind.", dns.ClassCHAOS, dns.TypeTXT, dns.RcodeSuccess, "dnsredir"},
+		{"Version.Server.", dns.ClassCHAOS, dns.TypeTXT, dns.RcodeSuccess, "dnsredir"},
+		{"hostname.bind.", dns.ClassCHAOS, dns.TypeTXT, dns.RcodeRefused, ""},
+		{"id.server.", dns.ClassCHAOS, dns.TypeTXT, dns.RcodeRefused, ""},
+		{"version.bind.", dns.ClassINET, dns.TypeTXT, -1, ""},
+		{"version.bind.", dns.ClassCHAOS, dns.TypeA, -1, ""},
+		{"authors.bind.", dns.ClassCHAOS, dns.TypeTXT, -1, ""},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+		req.Question[0].Qclass = test.qclass
+		reply := r.chaosReply(&request.Request{Req: req})
+		if test.rcode < 0 {
+			if reply != nil {
+				t.Errorf("Test#%v failed  %q should be handled as usual, got %v", i, test.name, reply)
+			}
+			continue
+		}
+		if reply == nil || reply.Rcode != test.rcode {
+			t.Errorf("Test#%v failed  %q expected %v, got %v", i, test.name, dns.RcodeToString[test.rcode], reply)
+			continue
+		}
+		if test.txt == "" {
+			continue
+		}
+		if len(reply.Answer) != 1 {
+			t.Errorf("Test#%v failed  %q expected one answer, got %v", i, test.name, reply)
+			continue
+		}
+		if txt := reply.Answer[0].(*dns.TXT); txt.Hdr.Class != dns.ClassCHAOS || len(txt.Txt) != 1 || txt.Txt[0] != test.txt {
+			t.Errorf("Test#%v failed  %q expected TXT %q, got %v", i, test.name, test.txt, txt)
+		}
+	}
+
+	if r := (&Dnsredir{}).chaosReply(&request.Request{Req: new(dns.Msg).SetQuestion("version.bind.", dns.TypeTXT)}); r != nil {
+		t.Errorf("Expected CHAOS queries to be handled as usual if not configured, got %v", r)
+	}
+}
+
+func TestOverride(t *testing.T) {
+	input := `dnsredir . {
+	override DB.example.com A 10.0.0.5
+	override db.example.com. A 10.0.0.6
+	override mail.example.com MX 10 mx.example.com.
+	override www.example.com CNAME web.example.net.
+	override_ttl 30
+	to 1.2.3.4
+}`
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+	u := up.(*reloadableUpstream)
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		answers int // -1 if the request should be forwarded
+	}{
+		{"db.example.com.", dns.TypeA, 2},
+		{"Db.Example.Com.", dns.TypeA, 2},
+		{"db.example.com.", dns.TypeAAAA, 0},
+		{"db.example.com.", dns.TypeTXT, -1},
+		{"x.db.example.com.", dns.TypeA, -1},
+		{"mail.example.com.", dns.TypeMX, 1},
+		{"mail.example.com.", dns.TypeA, -1},
+		{"www.example.com.", dns.TypeAAAA, 1},
+		{"example.com.", dns.TypeA, -1},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+		reply := u.localReply("", &request.Request{Req: req})
+		if test.answers < 0 {
+			if reply != nil {
+				t.Errorf("Test#%v failed  %q should be forwarded, got %v", i, test.name, reply)
+			}
+			continue
+		}
+		if reply == nil || reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != test.answers {
+			t.Errorf("Test#%v failed  %q expected %v answers, got %v", i, test.name, test.answers, reply)
+			continue
+		}
+		for _, rr := range reply.Answer {
+			if hdr := rr.Header(); hdr.Name != test.name || hdr.Ttl != 30 {
+				t.Errorf("Test#%v failed  unexpected answer %v", i, rr)
+			}
+		}
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n override example.com A\n to 1.2.3.4\n}",
+		"dnsredir . {\n override example.com BOGUS 1.2.3.4\n to 1.2.3.4\n}",
+		"dnsredir . {\n override example.com A not-an-ip\n to 1.2.3.4\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := newReloadableUpstream(c); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestDelegate(t *testing.T) {
+	input := `dnsredir . {
+	delegate Lab.example.com ns1.lab.example.com@192.0.2.53 ns1.lab.example.com@2001:db8::53 ns2.example.net
+	delegate deep.lab.example.com ns.deep.example.net.
+	override_ttl 60
+	to 1.2.3.4
+}`
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+	u := up.(*reloadableUpstream)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		ns    []string // nil if the request should be forwarded
+		glue  int
+	}{
+		{"lab.example.com.", dns.TypeA, []string{"ns1.lab.example.com.", "ns2.example.net."}, 2},
+		{"WWW.Lab.example.com.", dns.TypeAAAA, []string{"ns1.lab.example.com.", "ns2.example.net."}, 2},
+		{"x.deep.lab.example.com.", dns.TypeA, []string{"ns.deep.example.net."}, 0},
+		{"lab.example.com.", dns.TypeDS, nil, 0},
+		{"deep.lab.example.com.", dns.TypeDS, []string{"ns1.lab.example.com.", "ns2.example.net."}, 2},
+		{"example.com.", dns.TypeA, nil, 0},
+		{"badlab.example.com.", dns.TypeA, nil, 0},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+		reply := u.localReply("", &request.Request{Req: req})
+		if test.ns == nil {
+			if reply != nil {
+				t.Errorf("Test#%v failed  %q should be forwarded, got %v", i, test.name, reply)
+			}
+			continue
+		}
+		if reply == nil || reply.Rcode != dns.RcodeSuccess || reply.Authoritative || len(reply.Answer) != 0 ||
+			len(reply.Ns) != len(test.ns) || len(reply.Extra) != test.glue {
+			t.Errorf("Test#%v failed  %q unexpected referral %v", i, test.name, reply)
+			continue
+		}
+		for j, rr := range reply.Ns {
+			if ns, ok := rr.(*dns.NS); !ok || ns.Ns != test.ns[j] || rr.Header().Ttl != 60 {
+				t.Errorf("Test#%v failed  unexpected authority %v", i, rr)
+			}
+		}
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n delegate example.com\n to 1.2.3.4\n}",
+		"dnsredir . {\n delegate example.com ns.example.net@not-an-ip\n to 1.2.3.4\n}",
+		"dnsredir . {\n delegate example.com .\n to 1.2.3.4\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := newReloadableUpstream(c); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package dnsredir
+
+import (
+	"container/list"
+	"time"
+)
+
+// A bounded LRU whose entries expire individually, shared by caches and rate limiters of an upstream
+// The least recently used entry is evicted once full, thus adding an entry is O(1) regardless of the size.
+// MT-Unsafe, callers must serialize accesses.
+type expiringLru struct {
+	max int
+	// Front is the most recently used entry
+	ll    *list.List
+	items map[interface{}]*list.Element
+}
+
+type lruEntry struct {
+	key    interface{}
+	value  interface{}
+	expire time.Time
+}
+
+func newExpiringLru(max int) *expiringLru {
+	return &expiringLru{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[interface{}]*list.Element),
+	}
+}
+
+func (l *expiringLru) Len() int {
+	return l.ll.Len()
+}
+
+// Return value of the key and mark it most recently used, an expired entry is removed and never returned
+func (l *expiringLru) get(key interface{}, now time.Time) (interface{}, bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*lruEntry)
+	if now.After(entry.expire) {
+		l.remove(e)
+		return nil, false
+	}
+	l.ll.MoveToFront(e)
+	return entry.value, true
+}
+
+// Add or replace the entry and mark it most recently used, the least recently used entry is evicted if full
+func (l *expiringLru) add(key, value interface{}, expire time.Time) {
+	if e, ok := l.items[key]; ok {
+		entry := e.Value.(*lruEntry)
+		entry.value = value
+		entry.expire = expire
+		l.ll.MoveToFront(e)
+		return
+	}
+	if l.ll.Len() >= l.max {
+		l.remove(l.ll.Back())
+	}
+	l.items[key] = l.ll.PushFront(&lruEntry{key: key, value: value, expire: expire})
+}
+
+// Remove expired entries from the least recently used end, return true if it's still full
+// Unlike add(), callers may refuse to evict an unexpired entry, e.g. rate limiters failing closed.
+func (l *expiringLru) full(now time.Time) bool {
+	for l.ll.Len() >= l.max {
+		e := l.ll.Back()
+		if !now.After(e.Value.(*lruEntry).expire) {
+			return true
+		}
+		l.remove(e)
+	}
+	return false
+}
+
+func (l *expiringLru) remove(e *list.Element) {
+	l.ll.Remove(e)
+	delete(l.items, e.Value.(*lruEntry).key)
+}
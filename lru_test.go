@@ -0,0 +1,44 @@
+package dnsredir
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiringLru(t *testing.T) {
+	l := newExpiringLru(2)
+	now := time.Now()
+	l.add("a", 1, now.Add(time.Second))
+	l.add("b", 2, now.Add(time.Minute))
+	if !l.full(now) {
+		t.Fatalf("Expected full LRU of unexpired entries")
+	}
+
+	// "a" becomes the most recently used, thus "b" is evicted
+	if v, ok := l.get("a", now); !ok || v != 1 {
+		t.Fatalf("Expected value 1 of \"a\", got %v %v", v, ok)
+	}
+	l.add("c", 3, now.Add(time.Minute))
+	if _, ok := l.get("b", now); ok || l.Len() != 2 {
+		t.Fatalf("Expected least recently used entry evicted, %v entries left", l.Len())
+	}
+
+	// Replaced entry keeps its slot, with new value and expiration
+	l.add("c", 4, now.Add(time.Second))
+	if v, ok := l.get("c", now); !ok || v != 4 || l.Len() != 2 {
+		t.Fatalf("Expected value 4 of \"c\", got %v %v", v, ok)
+	}
+
+	now = now.Add(2 * time.Second)
+	if _, ok := l.get("c", now); ok {
+		t.Fatalf("Expected expired entry not returned")
+	}
+	if l.Len() != 1 || l.full(now) {
+		t.Fatalf("Expected expired entry removed, %v entries left", l.Len())
+	}
+	l.add("d", 5, now.Add(time.Minute))
+	// "a" expired at the least recently used end
+	if l.full(now) || l.Len() != 1 {
+		t.Fatalf("Expected expired entries removed once full, %v entries left", l.Len())
+	}
+}
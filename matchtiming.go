@@ -0,0 +1,99 @@
+package dnsredir
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Phases of reloadableUpstream.Match()
+const (
+	matchPhaseNames  = iota // Name list lookup, i.e. FROM...
+	matchPhaseInline        // INLINE names lookup
+	matchPhaseExcept        // Ignored names lookup, i.e. except IGNORED_NAMES...
+	// Phases of each domain set lookup within the phases above, see: domainSet.matchTimed()
+	matchPhaseExact  // Exact lookups of the name and its parents
+	matchPhaseSuffix // Suffix walks over domain set buckets
+	matchPhaseCount
+)
+
+var matchPhaseStrings = [matchPhaseCount]string{"names", "inline", "except", "exact", "suffix"}
+
+// Detailed timing of name matching phases, nil if disabled, see: match_timing
+// Methods are nil-safe, thus no clock is read unless enabled.
+type matchTiming struct {
+	count [matchPhaseCount]uint64
+	total [matchPhaseCount]int64 // In nanoseconds
+	max   [matchPhaseCount]int64
+}
+
+// Return start time of a phase, zero if disabled
+func (m *matchTiming) start() time.Time {
+	if m == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// Record duration of the phase began at `t', return end time of the phase, i.e. start time of next phase
+func (m *matchTiming) observe(phase int, t time.Time) time.Time {
+	if m == nil {
+		return t
+	}
+	now := time.Now()
+	m.record(phase, now.Sub(t))
+	return now
+}
+
+// Add time elapsed since `t' to `d', return current time, i.e. start time of next step
+func (m *matchTiming) elapse(d *time.Duration, t time.Time) time.Time {
+	if m == nil {
+		return t
+	}
+	now := time.Now()
+	*d += now.Sub(t)
+	return now
+}
+
+func (m *matchTiming) record(phase int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	d := int64(duration)
+	atomic.AddUint64(&m.count[phase], 1)
+	atomic.AddInt64(&m.total[phase], d)
+	for {
+		max := atomic.LoadInt64(&m.max[phase])
+		if d <= max || atomic.CompareAndSwapInt64(&m.max[phase], max, d) {
+			break
+		}
+	}
+}
+
+type matchPhaseStatus struct {
+	Count uint64 `json:"count"`
+	Total string `json:"total"`
+	Avg   string `json:"avg"`
+	Max   string `json:"max"`
+}
+
+func (m *matchTiming) status() map[string]matchPhaseStatus {
+	if m == nil {
+		return nil
+	}
+	st := make(map[string]matchPhaseStatus, matchPhaseCount)
+	for phase, name := range matchPhaseStrings {
+		count := atomic.LoadUint64(&m.count[phase])
+		total := time.Duration(atomic.LoadInt64(&m.total[phase]))
+		var avg time.Duration
+		if count != 0 {
+			avg = total / time.Duration(count)
+		}
+		st[name] = matchPhaseStatus{
+			Count: count,
+			Total: total.String(),
+			Avg:   avg.String(),
+			Max:   time.Duration(atomic.LoadInt64(&m.max[phase])).String(),
+		}
+	}
+	return st
+}
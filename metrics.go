@@ -31,6 +31,33 @@ var (
 		Help:      "Histogram of the time(in milliseconds) each request took.",
 	}, []string{"server", "to"})
 
+	// Time buckets used for connection establishment duration in seconds
+	connectBuckets = []float64{
+		.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5,
+	}
+	// Resolution(if any), dial and TLS handshake(if any) of new TCP/TLS/DoH connections, cached connections aren't observed
+	// XXX: currently server not embedded into connect duration label
+	ConnectDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "connect_duration_seconds",
+		Buckets:   connectBuckets,
+		Help:      "Histogram of the time(in seconds) each new connection establishment took.",
+	}, []string{"to", "transport"})
+
+	// Time buckets used for name list reload duration in seconds
+	reloadBuckets = []float64{
+		.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60,
+	}
+	// Fetch(if any), parse and swap-in of name lists, unchanged paths and failed reloads aren't observed
+	NameListReloadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "namelist_reload_duration_seconds",
+		Buckets:   reloadBuckets,
+		Help:      "Histogram of the time(in seconds) each name list reload took.",
+	}, []string{"source"})
+
 	RequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: pluginName,
@@ -45,6 +72,161 @@ var (
 		Help:      "Rcode counter of requests made per upstream.",
 	}, []string{"server", "to", "rcode"})
 
+	ChaosFaultCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "chaos_fault_count_total",
+		Help:      "Counter of faults injected per upstream.",
+	}, []string{"server", "to", "type"})
+
+	UnpackErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "unpack_error_total",
+		Help:      "Counter of replies failed to unpack per upstream.",
+	}, []string{"server", "to"})
+
+	ShortReadCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "short_read_total",
+		Help:      "Counter of TCP/TLS replies shorter than the claimed length per upstream.",
+	}, []string{"server", "to"})
+
+	ResponseMismatchCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "response_mismatch_total",
+		Help:      "Counter of replies mismatching the query per upstream.",
+	}, []string{"server", "to"})
+
+	LoopCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "loop_detected_total",
+		Help:      "Counter of looped back queries refused.",
+	}, []string{"server"})
+
+	AnswerCacheHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "answer_cache_hits_total",
+		Help:      "Counter of requests replied with answers cached by cache_min_ttl.",
+	}, []string{"server"})
+
+	ServfailCacheHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "servfail_cache_hits_total",
+		Help:      "Counter of requests replied with cached resolution failures.",
+	}, []string{"server"})
+
+	OversizedReplyCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "oversized_reply_total",
+		Help:      "Counter of replies larger than max_upstream_msg_size per upstream.",
+	}, []string{"server", "to"})
+
+	NameListExpiredCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "name_list_expired_total",
+		Help:      "Counter of name lists dropped due to persistent fetch failures.",
+	}, []string{"source"})
+
+	UnreadyCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "unready_total",
+		Help:      "Counter of unmatched requests replied since name lists aren't ready.",
+	}, []string{"server"})
+
+	PrefetchAlternateCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "prefetch_alternate_total",
+		Help:      "Counter of alternate queries per upstream and result.",
+	}, []string{"server", "to", "result"})
+
+	TruncationCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "truncation_total",
+		Help:      "Counter of truncated UDP replies per upstream.",
+	}, []string{"server", "to"})
+
+	StreamTruncationCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "stream_truncation_total",
+		Help:      "Counter of truncated replies over stream(i.e. TCP, TLS, HTTPS) per upstream.",
+	}, []string{"server", "to"})
+
+	WouldMatchCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "would_match_total",
+		Help:      "Counter of requests matched by dryrun upstreams, which aren't routed to them.",
+	}, []string{"server", "upstream"})
+
+	MaxQueryTimeCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "max_query_time_exceeded_total",
+		Help:      "Counter of requests exceeded max_query_time.",
+	}, []string{"server"})
+
+	TcpFallbackCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "tcp_fallback_total",
+		Help:      "Counter of truncated UDP replies retried over TCP per upstream.",
+	}, []string{"server", "to"})
+
+	RateLimitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "ratelimited_total",
+		Help:      "Counter of requests rejected by per-client rate limiting.",
+	}, []string{"server"})
+
+	InvalidNameCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "invalid_name_total",
+		Help:      "Counter of requests rejected due to invalid query names.",
+	}, []string{"server"})
+
+	NameOverlapCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "name_overlap_total",
+		Help:      "Counter of names shadowed by an earlier upstream found at startup.",
+	}, []string{"server"})
+
+	InflightGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "inflight_requests",
+		Help:      "Gauge of requests in-flight toward upstream hosts.",
+	}, []string{"server"})
+
+	CircuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "circuit_breaker_state",
+		Help:      "State of circuit breaker per upstream, 0 for closed, 1 for open, 2 for half-open.",
+	}, []string{"to"})
+
+	// XXX: currently server not embedded into selection count label
+	SelectionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "selection_count_total",
+		Help:      "Counter of host selection decisions per upstream.",
+	}, []string{"to", "reason"})
+
 	// XXX: currently server not embedded into hc failure count label
 	HealthCheckFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
@@ -5,11 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
 	"golang.org/x/net/idna"
 	"io"
+	"net"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -63,11 +66,12 @@ func domainToIndex(s string) uint16 {
 // Return true if name added successfully, false otherwise
 func (d *domainSet) Add(str string) bool {
 	// To reduce memory, we don't use full qualified name
+	// Names are lower cased so they can be matched case-insensitively
 
 	name, ok := stringToDomain(str)
 	if !ok {
 		var err error
-		name, err = idna.ToASCII(str)
+		name, err = idna.ToASCII(strings.ToLower(str))
 		// idna.ToASCII("") return no error
 		if err != nil || len(name) == 0 {
 			return false
@@ -101,24 +105,38 @@ func (d *domainSet) ForEachDomain(f func(name string) error) error {
 }
 
 // Assume `child' is lower cased and without trailing dot
+// A name matches itself and its subdomains, suffixes are compared at label boundaries,
+//	e.g. "example.com" matches "foo.example.com", yet never "badexample.com".
 func (d *domainSet) Match(child string) bool {
+	return d.matchTimed(child, nil)
+}
+
+// Ditto, time spent on exact lookups and suffix walks is recorded into `m'(if any) separately
+func (d *domainSet) matchTimed(child string, m *matchTiming) bool {
 	if len(child) == 0 {
 		panic(fmt.Sprintf("Why child is an empty string?!"))
 	}
 
-	for {
+	var exact, suffix time.Duration
+	t := m.start()
+	matched := false
+	for !matched {
 		s := (*d)[domainToIndex(child)]
 		// Fast lookup for a full match
-		if s.Contains(child) {
-			return true
+		matched = s.Contains(child)
+		t = m.elapse(&exact, t)
+		if matched {
+			break
 		}
 
 		// Fallback to iterate the whole set
 		for parent := range s {
 			if plugin.Name(parent).Matches(child) {
-				return true
+				matched = true
+				break
 			}
 		}
+		t = m.elapse(&suffix, t)
 
 		i := strings.Index(child, ".")
 		if i <= 0 {
@@ -127,20 +145,33 @@ func (d *domainSet) Match(child string) bool {
 		child = child[i+1:]
 	}
 
-	return false
+	m.record(matchPhaseExact, exact)
+	m.record(matchPhaseSuffix, suffix)
+	return matched
+}
+
+// Check if `name' itself is in the domain set, unlike Match() its parents aren't looked up
+func (d *domainSet) contains(name string) bool {
+	s := (*d)[domainToIndex(name)]
+	return s.Contains(name)
 }
 
 const (
 	NameItemTypePath = iota
 	NameItemTypeUrl
+	// TXT records of a domain name, each TXT record holds lines separated by commas, see: getTxtContent()
+	NameItemTypeTxt
+	// Members of a Redis set, see: redisSource
+	NameItemTypeRedis
 	NameItemTypeLast // Dummy
 )
 
 type NameItem struct {
+	// Protect metadata below, names is swapped atomically thus lookups are lock-free
 	sync.RWMutex
 
-	// Domain name set for lookups
-	names domainSet
+	// Domain name set for lookups, see: nameSnapshot
+	names atomic.Value
 
 	whichType int
 
@@ -150,6 +181,57 @@ type NameItem struct {
 
 	url         string
 	contentHash uint64
+	// Validators of the last fetched content of an HTTPS URL, see: getUrlContentIfModified()
+	validators urlValidators
+	redis      *redisSource
+	// Time of the last successful fetch, see: NameList.expireStale()
+	fetched time.Time
+
+	// Number of names per trailing tag of the last parse, see: parseLine()
+	tags map[string]uint64
+}
+
+// Domain name set and its Bloom filter(nil if disabled), swapped together so they're always consistent
+type nameSnapshot struct {
+	names domainSet
+	bloom *bloomFilter
+}
+
+func (item *NameItem) loadSnapshot() nameSnapshot {
+	snapshot, _ := item.names.Load().(nameSnapshot)
+	return snapshot
+}
+
+// Return current domain name set, nil if not populated yet
+func (item *NameItem) loadNames() domainSet {
+	return item.loadSnapshot().names
+}
+
+// Swap in a fully populated domain name set with a single atomic store
+func (item *NameItem) storeNames(names domainSet, bloom *bloomFilter) {
+	item.names.Store(nameSnapshot{names: names, bloom: bloom})
+}
+
+// Assume `child' is lower cased and without trailing dot
+// Time spent on domain set lookups is recorded into `m'(if any), see: domainSet.matchTimed()
+func (item *NameItem) match(child string, m *matchTiming) bool {
+	if item.redis != nil && item.redis.query {
+		return item.redis.match(child)
+	}
+	snapshot := item.loadSnapshot()
+	if snapshot.bloom != nil {
+		return snapshot.names.matchBloom(child, snapshot.bloom, m)
+	}
+	return snapshot.names.matchTimed(child, m)
+}
+
+// Check if `name' itself is in the name item, see: domainSet.contains()
+func (item *NameItem) contains(name string) bool {
+	if item.redis != nil && item.redis.query {
+		return item.redis.contains(name)
+	}
+	names := item.loadNames()
+	return names.contains(name)
 }
 
 func NewNameItemsWithForms(forms []string) ([]*NameItem, error) {
@@ -161,6 +243,29 @@ func NewNameItemsWithForms(forms []string) ([]*NameItem, error) {
 				log.Warningf("Due to security reasons, URL %q is prohibited", from)
 				continue
 			}
+			if proto == "txt" {
+				if _, ok := dns.IsDomainName(from[j+3:]); !ok || from[j+3:] == "" {
+					return nil, errors.New(fmt.Sprintf("%q isn't a domain name", from))
+				}
+				items[i] = &NameItem{
+					whichType: NameItemTypeTxt,
+					url:       from,
+				}
+				continue
+			}
+			if proto == "redis" {
+				redis, err := newRedisSource(from)
+				if err != nil {
+					return nil, err
+				}
+				// Password is redacted, since the URL is logged and exported via admin endpoint
+				items[i] = &NameItem{
+					whichType: NameItemTypeRedis,
+					url:       redis.String(),
+					redis:     redis,
+				}
+				continue
+			}
 			if proto != "https" {
 				return nil, errors.New(fmt.Sprintf("Unsupport URL %q", from))
 			}
@@ -190,25 +295,134 @@ type NameList struct {
 	urlReload      time.Duration
 	urlReadTimeout time.Duration
 	stopUrlReload  chan struct{}
+	// Limit concurrent URL fetches, nil if unlimited
+	urlFetchSem chan struct{}
+	// User-Agent of URL fetches, empty to use the default
+	urlUserAgent string
+	// Maximum number of names per name item, zero if unlimited
+	maxNames uint64
+	// Names of URLs failed to fetch for longer than it are dropped, zero to keep serving stale names
+	maxStale time.Duration
+	// Only lines tagged with one of them are loaded, nil if all lines are loaded, see: parseLine()
+	loadTags StringSet
+	// False positive rate of Bloom filters of name items, zero if disabled
+	bloomRate float64
+
+	// Closed once initial population of all name items finished(either succeeded or gave up), see: initialized()
+	initDone chan struct{}
+	initWg   sync.WaitGroup
+}
+
+// Return nil if Bloom filter disabled
+func (n *NameList) newBloomFilter(names domainSet) *bloomFilter {
+	if n.bloomRate == 0 {
+		return nil
+	}
+	t := time.Now()
+	b := newBloomFilterFromSet(names, n.bloomRate)
+	log.Debugf("Built Bloom filter of %v names, size: %v bytes, hashes: %v, time spent: %v",
+		names.Len(), b.size(), b.k, time.Since(t))
+	return b
+}
+
+// Return true if initial population finished, or name list never populated(e.g. upstream not started)
+func (n *NameList) initialized() bool {
+	if n.initDone == nil {
+		return true
+	}
+	select {
+	case <-n.initDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// Return true if initial population finished, and every name item holds names
+// A name item may hold no names since its initial population failed, or its stale names dropped, see: expireStale()
+// Redis sources in query mode are always considered as ready.
+func (n *NameList) ready() bool {
+	if !n.initialized() {
+		return false
+	}
+	for _, item := range n.items {
+		if item.redis != nil && item.redis.query {
+			continue
+		}
+		if names := item.loadNames(); names.Len() == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Wait until initial population finished or timed out, return true if finished
+func (n *NameList) waitInitialized(timeout time.Duration) bool {
+	if n.initialized() {
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-n.initDone:
+		return true
+	case <-timer.C:
+		return false
+	}
 }
 
 // Assume `child' is lower cased and without trailing dot
 func (n *NameList) Match(child string) bool {
+	return n.matchTimed(child, nil)
+}
+
+// Ditto, time spent on domain set lookups is recorded into `m'(if any)
+func (n *NameList) matchTimed(child string, m *matchTiming) bool {
 	for _, item := range n.items {
-		item.RLock()
-		if item.names.Match(child) {
-			item.RUnlock()
+		if item.match(child, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if `name' itself is in the name list, see: domainSet.contains()
+func (n *NameList) contains(name string) bool {
+	for _, item := range n.items {
+		if item.contains(name) {
 			return true
 		}
-		item.RUnlock()
 	}
 	return false
 }
 
+// Query mode Redis sources cache membership for a URL reload interval
+func (n *NameList) initRedis() {
+	for _, item := range n.items {
+		if item.redis != nil {
+			item.redis.ttl = n.urlReload
+		}
+	}
+}
+
+func (n *NameList) closeRedis() {
+	for _, item := range n.items {
+		if item.redis != nil {
+			item.redis.close()
+		}
+	}
+}
+
 // MT-Unsafe
 func (n *NameList) periodicUpdate(bootstrap []string) {
+	n.initRedis()
 	// Kick off initial name list content population
+	n.initDone = make(chan struct{})
 	n.updateList(NameItemTypeLast, bootstrap)
+	go func() {
+		n.initWg.Wait()
+		close(n.initDone)
+	}()
 
 	if n.pathReload > 0 {
 		go func() {
@@ -240,14 +454,31 @@ func (n *NameList) periodicUpdate(bootstrap []string) {
 }
 
 func (n *NameList) updateList(whichType int, bootstrap []string) {
+	var wg sync.WaitGroup
 	for _, item := range n.items {
-		if whichType == NameItemTypeLast || whichType == item.whichType {
-			switch item.whichType {
+		itemType := item.whichType
+		if itemType == NameItemTypeRedis && item.redis.query {
+			// Nothing to populate, membership is looked up on demand
+			continue
+		}
+		if itemType == NameItemTypeTxt || itemType == NameItemTypeRedis {
+			// TXT records and Redis sets are fetched along with URLs, thus share the same reload interval
+			itemType = NameItemTypeUrl
+		}
+		if whichType == NameItemTypeLast || whichType == itemType {
+			switch itemType {
 			case NameItemTypePath:
 				n.updateItemFromPath(item)
 			case NameItemTypeUrl:
 				if whichType == NameItemTypeLast {
 					n.initialUpdateFromUrl(item, bootstrap)
+				} else if n.urlFetchSem != nil {
+					// Fetches exceed the concurrency limit will be queued in updateItemFromUrl()
+					wg.Add(1)
+					go func(item *NameItem) {
+						defer wg.Done()
+						_ = n.updateItemFromUrl(item, bootstrap)
+					}(item)
 				} else {
 					_ = n.updateItemFromUrl(item, bootstrap)
 				}
@@ -256,6 +487,7 @@ func (n *NameList) updateList(whichType int, bootstrap []string) {
 			}
 		}
 	}
+	wg.Wait()
 }
 
 func (n *NameList) updateItemFromPath(item *NameItem) {
@@ -287,65 +519,201 @@ func (n *NameList) updateItemFromPath(item *NameItem) {
 	}
 
 	t1 := time.Now()
-	names, totalLines := n.parse(file)
+	names, tags, totalLines, err := n.parse(file)
 	t2 := time.Since(t1)
+	if err != nil {
+		// Keep serving the old name set, mtime and size untouched so it'll be parsed again on next reload
+		log.Warningf("Failed to parse %v: %v", file.Name(), err)
+		return
+	}
 	log.Debugf("Parsed %v  time spent: %v name added: %v / %v",
 		file.Name(), t2, names.Len(), totalLines)
 
+	// The new name set is built off to the side, and swapped in as a whole
+	//	in-flight lookups see either the old or the new set, never a partial one
+	item.storeNames(names, n.newBloomFilter(names))
 	item.Lock()
-	item.names = names
 	item.mtime = stat.ModTime()
 	item.size = stat.Size()
+	item.tags = tags
 	item.Unlock()
+	NameListReloadDuration.WithLabelValues(item.path).Observe(time.Since(t1).Seconds())
 }
 
-func (n *NameList) parse(r io.Reader) (domainSet, uint64) {
-	names := make(domainSet)
+// Line format of name list files:
+//	DOMAIN [TAG] [# comment]
+//	server=/DOMAIN/... [TAG] [# comment]
+// Text after `#' or `;' is comment, leading and trailing whitespaces are trimmed.
+// Return ok false for blank lines and comment-only lines, malformed lines return a non-nil error.
+func parseLine(line string) (name, tag string, ok bool, err error) {
+	if i := strings.IndexAny(line, "#;"); i >= 0 {
+		line = line[:i]
+	}
 
-	var totalLines uint64
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		totalLines++
+	f := strings.Fields(line)
+	switch len(f) {
+	case 0:
+		return "", "", false, nil
+	case 1:
+	case 2:
+		tag = f[1]
+	default:
+		return "", "", false, fmt.Errorf("too many fields %q", line)
+	}
 
-		line := scanner.Text()
-		if i := strings.IndexByte(line, '#'); i >= 0 {
-			line = line[:i]
+	name = f[0]
+	if g := strings.Split(name, "/"); len(g) == 3 {
+		// Format: server=/<domain>/<?>
+		if g[0] != "server=" {
+			return "", "", false, fmt.Errorf("unknown directive %q", g[0])
 		}
+		// Don't check g[2], see: http://manpages.ubuntu.com/manpages/bionic/man8/dnsmasq.8.html
+		// Thus server=/<domain>/<ip>, server=/<domain>/, server=/<domain>/# won't be honored
+		name = g[1]
+	} else if len(g) != 1 {
+		return "", "", false, fmt.Errorf("malformed line %q", line)
+	}
+	if net.ParseIP(name) != nil {
+		// Most likely a hosts(5) file line, which isn't supported
+		return "", "", false, fmt.Errorf("%q is an IP address", name)
+	}
+	return name, tag, true, nil
+}
 
-		f := strings.Split(line, "/")
-		if len(f) != 3 {
-			// Treat the whole line as a domain name
-			_ = names.Add(line)
-			continue
+// Maximum length of a name list line, longer lines are skipped as malformed
+const maxLineLength = 64 * 1024
+
+// Read a line without the trailing line break
+// Lines longer than the buffer size of `rd' are discarded without being buffered, ok false will be returned.
+// io.EOF will be returned only if there is nothing left.
+func readLine(rd *bufio.Reader) (line string, ok bool, err error) {
+	p, err := rd.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = rd.ReadSlice('\n')
+		}
+		if err == io.EOF {
+			err = nil
 		}
+		return "", false, err
+	}
+	if err == io.EOF && len(p) != 0 {
+		// Last line without a line break
+		err = nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(p), "\n"), "\r"), true, nil
+}
 
-		// Format: server=/<domain>/<?>
-		if f[0] != "server=" {
+// Parse name list content, malformed lines are skipped thus a bad line won't poison the whole list
+// Content is streamed line by line into the domain name set, thus it's never buffered as a whole.
+// Return the domain name set, number of names per tag and total lines
+// The whole content is rejected if it has more names than maxNames(if any), or failed to read.
+func (n *NameList) parse(r io.Reader) (domainSet, map[string]uint64, uint64, error) {
+	names := make(domainSet)
+	var tags map[string]uint64
+
+	var totalLines, badLines uint64
+	// Upper bound of names.Len(), since duplicated names are counted too
+	var added uint64
+	rd := bufio.NewReaderSize(r, maxLineLength)
+	for {
+		line, ok, err := readLine(rd)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A partially read list is never swapped in
+			return nil, nil, totalLines, err
+		}
+		totalLines++
+		if !ok {
+			badLines++
+			log.Debugf("Line %v: longer than %v bytes", totalLines, maxLineLength)
 			continue
 		}
 
-		// Don't check f[2], see: http://manpages.ubuntu.com/manpages/bionic/man8/dnsmasq.8.html
-		// Thus server=/<domain>/<ip>, server=/<domain>/, server=/<domain>/# won't be honored
+		name, tag, ok, err := parseLine(line)
+		if err != nil {
+			badLines++
+			log.Debugf("Line %v: %v", totalLines, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if n.loadTags != nil && !n.loadTags.Contains(tag) {
+			continue
+		}
 
-		if !names.Add(f[1]) {
-			log.Warningf("%q isn't a domain name", f[1])
+		if !names.Add(name) {
+			badLines++
+			log.Debugf("Line %v: %q isn't a domain name", totalLines, name)
+			continue
+		}
+		if added++; n.maxNames != 0 && added > n.maxNames {
+			// Recount only if the bound may be exceeded
+			if added = names.Len(); added > n.maxNames {
+				return nil, nil, totalLines, fmt.Errorf("more than %v names at line %v", n.maxNames, totalLines)
+			}
 		}
+		if tag != "" {
+			if tags == nil {
+				tags = make(map[string]uint64)
+			}
+			tags[tag]++
+		}
+	}
+	if badLines != 0 {
+		log.Warningf("%v / %v malformed lines skipped", badLines, totalLines)
 	}
 
-	return names, totalLines
+	return names, tags, totalLines, nil
 }
 
 // Return true if NameItem updated
+// TXT and Redis name items are updated likewise, see: NameItemTypeTxt, NameItemTypeRedis
 func (n *NameList) updateItemFromUrl(item *NameItem, bootstrap []string) bool {
-	if item.whichType != NameItemTypeUrl || len(item.url) == 0 {
+	if (item.whichType != NameItemTypeUrl && item.whichType != NameItemTypeTxt && item.whichType != NameItemTypeRedis) || len(item.url) == 0 {
 		panic("Function call misuse or bad URL config")
 	}
 
+	item.RLock()
+	validators := item.validators
+	item.RUnlock()
+
+	if n.urlFetchSem != nil {
+		n.urlFetchSem <- struct{}{}
+	}
 	t1 := time.Now()
-	content, err := getUrlContent(item.url, "text/plain", bootstrap, n.urlReadTimeout)
+	var content string
+	var err error
+	switch item.whichType {
+	case NameItemTypeTxt:
+		content, err = getTxtContent(item.url[len("txt://"):], bootstrap, n.urlReadTimeout)
+	case NameItemTypeRedis:
+		content, err = item.redis.content(n.urlReadTimeout)
+	default:
+		content, err = getUrlContentIfModified(item.url, "text/plain", bootstrap, n.urlReadTimeout, n.urlUserAgent, &validators)
+	}
 	t2 := time.Since(t1)
+	if n.urlFetchSem != nil {
+		<-n.urlFetchSem
+	}
+	if err == errNotModified {
+		// Only changed sources are downloaded and parsed again, other name items are untouched either way
+		log.Debugf("%v not modified, time spent: %v", item.url, t2)
+		item.Lock()
+		item.fetched = time.Now()
+		item.Unlock()
+		NameListReloadDuration.WithLabelValues(item.url).Observe(time.Since(t1).Seconds())
+		return true
+	}
 	if err != nil {
 		log.Warningf("Failed to update %q, err: %v", item.url, err)
+		n.expireStale(item)
 		return false
 	}
 
@@ -354,50 +722,69 @@ func (n *NameList) updateItemFromUrl(item *NameItem, bootstrap []string) bool {
 	item.RUnlock()
 	contentHash1 := stringHash(content)
 	if contentHash1 == contentHash {
+		item.Lock()
+		item.validators = validators
+		item.fetched = time.Now()
+		item.Unlock()
+		NameListReloadDuration.WithLabelValues(item.url).Observe(time.Since(t1).Seconds())
 		return true
 	}
 
-	names := make(domainSet)
-	var totalLines uint64
 	t3 := time.Now()
-	lines := strings.Split(content, "\n")
-	for _, line := range lines {
-		totalLines++
-
-		if i := strings.IndexByte(line, '#'); i >= 0 {
-			line = line[:i]
-		}
-
-		f := strings.Split(line, "/")
-		if len(f) != 3 {
-			_ = names.Add(line)
-			continue
-		}
-
-		if f[0] != "server=" {
-			continue
-		}
-
-		if !names.Add(f[1]) {
-			log.Warningf("%q isn't a domain name", f[1])
-		}
-	}
+	names, tags, totalLines, err := n.parse(strings.NewReader(content))
 	t4 := time.Since(t3)
+	if err != nil {
+		log.Warningf("Failed to update %q, err: %v", item.url, err)
+		n.expireStale(item)
+		return false
+	}
 	log.Debugf("Fetched %v, time spent: %v %v, added: %v / %v, hash: %#x",
 		item.url, t2, t4, names.Len(), totalLines, contentHash1)
 
+	// Ditto. Failed fetch keeps serving the old name set
+	item.storeNames(names, n.newBloomFilter(names))
 	item.Lock()
-	item.names = names
 	item.contentHash = contentHash1
+	item.validators = validators
+	item.tags = tags
+	item.fetched = time.Now()
 	item.Unlock()
+	NameListReloadDuration.WithLabelValues(item.url).Observe(time.Since(t1).Seconds())
 
 	return true
 }
 
+// Drop names of the item if it failed to fetch for longer than reload_max_stale, i.e. fail closed
+// Names are loaded again once a fetch succeeds.
+func (n *NameList) expireStale(item *NameItem) {
+	if n.maxStale == 0 {
+		return
+	}
+	item.Lock()
+	stale := !item.fetched.IsZero() && time.Since(item.fetched) > n.maxStale
+	if stale {
+		// Reset, so the same content is parsed again on next successful fetch
+		item.fetched = time.Time{}
+		item.contentHash = 0
+		item.validators = urlValidators{}
+		item.tags = nil
+	}
+	item.Unlock()
+	if !stale {
+		return
+	}
+
+	item.storeNames(make(domainSet), nil)
+	log.Errorf("%q failed to update for more than %v, its names are dropped", item.url, n.maxStale)
+	NameListExpiredCount.WithLabelValues(item.url).Inc()
+}
+
 // Initial name list population needs a working DNS upstream
 //	thus we need to fallback to it(if any) in case of population failure
 func (n *NameList) initialUpdateFromUrl(item *NameItem, bootstrap []string) {
+	n.initWg.Add(1)
 	go func() {
+		defer n.initWg.Done()
 		// Fast retry in case of unstable network
 		retryIntervals := []time.Duration{
 			500 * time.Millisecond,
@@ -0,0 +1,590 @@
+package dnsredir
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseCaseInsensitive(t *testing.T) {
+	content := strings.Join([]string{
+		"ExAmPlE.CoM",
+		"server=/FOO.Example.NET/114.114.114.114",
+		"BAR.org.",
+	}, "\n")
+
+	n := &NameList{}
+	names, _, totalLines, _ := n.parse(strings.NewReader(content))
+	if totalLines != 3 {
+		t.Errorf("Expected 3 lines, got %v", totalLines)
+	}
+	if names.Len() != 3 {
+		t.Errorf("Expected 3 names, got %v: %v", names.Len(), names)
+	}
+
+	for _, name := range []string{"example.com", "foo.example.net", "bar.org", "www.bar.org"} {
+		if !names.Match(name) {
+			t.Errorf("Expected %q to be matched in %v", name, names)
+		}
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		name string
+		tag  string
+		ok   bool
+		err  bool
+	}{
+		{"", "", "", false, false},
+		{"   \t ", "", "", false, false},
+		{"# comment", "", "", false, false},
+		{"; comment", "", "", false, false},
+		{"example.com", "example.com", "", true, false},
+		{"  example.com\t", "example.com", "", true, false},
+		{"example.com # ads", "example.com", "", true, false},
+		{"example.com;ads", "example.com", "", true, false},
+		{"example.com ads", "example.com", "ads", true, false},
+		{"example.com\tads # curated", "example.com", "ads", true, false},
+		{"server=/example.org/114.114.114.114", "example.org", "", true, false},
+		{"server=/example.org/# tracker", "example.org", "", true, false},
+		{"server=/example.org/ tracker", "example.org", "tracker", true, false},
+		{"address=/example.org/127.0.0.1", "", "", false, true},
+		{"example.com ads tracker", "", "", false, true},
+		{"0.0.0.0 example.com", "", "", false, true},
+		{"server=/example.org/1.2.3.4/5", "", "", false, true},
+	}
+	for _, test := range tests {
+		name, tag, ok, err := parseLine(test.line)
+		if name != test.name || tag != test.tag || ok != test.ok || (err != nil) != test.err {
+			t.Errorf("parseLine(%q) = %q, %q, %v, %v, expected %q, %q, %v, error: %v",
+				test.line, name, tag, ok, err, test.name, test.tag, test.ok, test.err)
+		}
+	}
+}
+
+func TestParseMalformedLines(t *testing.T) {
+	content := strings.Join([]string{
+		"# curated list",
+		"",
+		"example.com ads",
+		"0.0.0.0 bad.example",
+		"server=/bad.example/x/y ads",
+		"too many fields here",
+		"address=/bad.test/127.0.0.1",
+		"example.net tracker ; inline comment",
+		"server=/example.org/ ads",
+		"last.example.com",
+	}, "\n")
+
+	n := &NameList{}
+	names, tags, totalLines, _ := n.parse(strings.NewReader(content))
+	if totalLines != 10 {
+		t.Errorf("Expected 10 lines, got %v", totalLines)
+	}
+	if names.Len() != 4 {
+		t.Errorf("Expected 4 names, got %v: %v", names.Len(), names)
+	}
+	for _, name := range []string{"example.com", "example.net", "example.org", "last.example.com"} {
+		if !names.Match(name) {
+			t.Errorf("Expected %q to be matched in %v", name, names)
+		}
+	}
+	for _, name := range []string{"bad.example", "bad.test", "too", "0.0.0.0"} {
+		if names.Match(name) {
+			t.Errorf("Expected %q not to be matched in %v", name, names)
+		}
+	}
+	if len(tags) != 2 || tags["ads"] != 2 || tags["tracker"] != 1 {
+		t.Errorf("Unexpected tags: %v", tags)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("read failure")
+}
+
+func TestParseLongLine(t *testing.T) {
+	content := strings.Join([]string{
+		"example.com",
+		strings.Repeat("a", maxLineLength*3) + ".com",
+		"example.net\r",
+		"last.example.com",
+	}, "\n")
+
+	n := &NameList{}
+	names, _, totalLines, err := n.parse(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("parse() failed, error: %v", err)
+	}
+	if totalLines != 4 {
+		t.Errorf("Expected 4 lines, got %v", totalLines)
+	}
+	if names.Len() != 3 {
+		t.Errorf("Expected 3 names, got %v: %v", names.Len(), names)
+	}
+	for _, name := range []string{"example.com", "example.net", "last.example.com"} {
+		if !names.Match(name) {
+			t.Errorf("Expected %q to be matched in %v", name, names)
+		}
+	}
+
+	r := io.MultiReader(strings.NewReader("example.com\nexample.net\n"), errReader{})
+	if _, _, _, err := n.parse(r); err == nil {
+		t.Errorf("Expected parse() to fail on read failure")
+	}
+}
+
+func TestMaxNames(t *testing.T) {
+	file, err := ioutil.TempFile("", "dnsredir-*.conf")
+	if err != nil {
+		t.Fatalf("TempFile() failed, error: %v", err)
+	}
+	path := file.Name()
+	Close(file)
+	defer os.Remove(path)
+
+	item := &NameItem{whichType: NameItemTypePath, path: path}
+	n := &NameList{items: []*NameItem{item}, maxNames: 3}
+
+	// Duplicated names don't count
+	content := "example.com\nexample.com\nEXAMPLE.COM\nexample.net\nexample.org\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile() failed, error: %v", err)
+	}
+	n.updateItemFromPath(item)
+	if names := item.loadNames(); names.Len() != 3 {
+		t.Fatalf("Expected 3 names, got %v", names)
+	}
+
+	// Content exceeds the bound rejected as a whole, previous names kept
+	content = "example.com\nexample.net\nexample.org\nexample.edu\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile() failed, error: %v", err)
+	}
+	n.updateItemFromPath(item)
+	if n.Match("example.edu") || !n.Match("example.net") {
+		t.Errorf("Expected the previous names kept, got %v", item.loadNames())
+	}
+
+	if _, _, _, err := n.parse(strings.NewReader(content)); err == nil {
+		t.Errorf("Expected error since names exceed the bound")
+	}
+}
+
+func TestReloadDuration(t *testing.T) {
+	file, err := ioutil.TempFile("", "dnsredir-*.conf")
+	if err != nil {
+		t.Fatalf("TempFile() failed, error: %v", err)
+	}
+	path := file.Name()
+	Close(file)
+	defer os.Remove(path)
+
+	item := &NameItem{whichType: NameItemTypePath, path: path}
+	n := &NameList{items: []*NameItem{item}}
+	reloads := func() uint64 {
+		var m dto.Metric
+		if err := NameListReloadDuration.WithLabelValues(path).(prometheus.Histogram).Write(&m); err != nil {
+			t.Fatalf("Write() failed, error: %v", err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+
+	if err := ioutil.WriteFile(path, []byte("example.com\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() failed, error: %v", err)
+	}
+	n.updateItemFromPath(item)
+	if n := reloads(); n != 1 {
+		t.Errorf("Expected 1 reload observed, got %v", n)
+	}
+	// Unchanged file isn't reloaded
+	n.updateItemFromPath(item)
+	if n := reloads(); n != 1 {
+		t.Errorf("Expected 1 reload observed, got %v", n)
+	}
+}
+
+// Run with -race to detect data race between reload and lookup
+func TestReloadWhileMatching(t *testing.T) {
+	file, err := ioutil.TempFile("", "dnsredir-*.conf")
+	if err != nil {
+		t.Fatalf("TempFile() failed, error: %v", err)
+	}
+	path := file.Name()
+	Close(file)
+	defer os.Remove(path)
+
+	contents := []string{
+		"example.com\nexample.net\n",
+		"example.com\nexample.org\nfoo.example.net\n",
+	}
+	item := &NameItem{whichType: NameItemTypePath, path: path}
+	n := &NameList{items: []*NameItem{item}}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := ioutil.WriteFile(path, []byte(contents[i%len(contents)]), 0644); err != nil {
+				t.Errorf("WriteFile() failed, error: %v", err)
+				return
+			}
+			n.updateItemFromPath(item)
+		}
+	}()
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		// example.com present in every revision of the list, once the list populated
+		if item.loadNames() != nil && !n.Match("www.example.com") {
+			t.Errorf("Expected %q to be matched", "www.example.com")
+			break
+		}
+		_ = n.Match("example.org")
+		_ = n.Match("example.invalid")
+	}
+	close(stop)
+	<-done
+}
+
+func TestBloomFilter(t *testing.T) {
+	names := make(domainSet)
+	for i := 0; i < 1000; i++ {
+		names.Add(fmt.Sprintf("host%v.example.com", i))
+	}
+	names.Add("example.net")
+
+	b := newBloomFilterFromSet(names, defaultBloomRate)
+	var falsePositives int
+	for i := 0; i < 10000; i++ {
+		if i < 1000 && !b.mayContain(fmt.Sprintf("host%v.example.com", i)) {
+			t.Fatalf("Bloom filter must not have false negatives")
+		}
+		if b.mayContain(fmt.Sprintf("host%v.example.org", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("Expected about 1%% false positives, got %v / 10000", falsePositives)
+	}
+
+	item := &NameItem{}
+	item.storeNames(names, b)
+	n := &NameList{items: []*NameItem{item}}
+	for _, child := range []string{
+		"host1.example.com", "www.host999.example.com", "host1000.example.com",
+		"example.net", "a.b.example.net", "net", "example.com", "xexample.net",
+	} {
+		if n.Match(child) != names.Match(child) {
+			t.Errorf("Bloom filter backed match of %q differs from domain set", child)
+		}
+	}
+}
+
+func TestTxtNameList(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() failed: %v", err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Name == "_dnsredir-policy.example.org." && req.Question[0].Qtype == dns.TypeTXT {
+			m.Answer = newTestRRs(t,
+				`_dnsredir-policy.example.org. 60 IN TXT "example.com corp,example.net vpn"`,
+				`_dnsredir-policy.example.org. 60 IN TXT "foo.org " "corp"`,
+			)
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	defer server.Shutdown()
+
+	items, err := NewNameItemsWithForms([]string{"txt://_dnsredir-policy.example.org"})
+	if err != nil {
+		t.Fatalf("NewNameItemsWithForms() failed: %v", err)
+	}
+	n := &NameList{items: items, urlReadTimeout: 2 * time.Second, loadTags: StringSet{"corp": {}}}
+	if !n.updateItemFromUrl(items[0], []string{pc.LocalAddr().String()}) {
+		t.Fatalf("Failed to fetch TXT records")
+	}
+	for name, matched := range map[string]bool{
+		"example.com": true,
+		"foo.org":     true,
+		"example.net": false,
+	} {
+		if n.Match(name) != matched {
+			t.Errorf("Expected %q matched: %v, names: %v", name, matched, items[0].loadNames())
+		}
+	}
+
+	for _, from := range []string{"txt://", "txt://example..org"} {
+		if _, err := NewNameItemsWithForms([]string{from}); err == nil {
+			t.Errorf("Expected error for %q", from)
+		}
+	}
+}
+
+// A minimal Redis server serving a single set, which only understands AUTH, SMEMBERS and SISMEMBER
+func newTestRedisServer(t *testing.T, password string, members ...string) (net.Listener, *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	set := make(map[string]bool)
+	for _, member := range members {
+		set[member] = true
+	}
+	lookups := new(int32)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				authed := password == ""
+				for {
+					reply, err := readRedisReply(rd)
+					if err != nil {
+						return
+					}
+					var cmd []string
+					for _, arg := range reply.([]interface{}) {
+						cmd = append(cmd, arg.(string))
+					}
+					var resp string
+					switch {
+					case cmd[0] == "AUTH":
+						authed = cmd[len(cmd)-1] == password
+						resp = "+OK\r\n"
+						if !authed {
+							resp = "-WRONGPASS invalid password\r\n"
+						}
+					case !authed:
+						resp = "-NOAUTH Authentication required.\r\n"
+					case cmd[0] == "SMEMBERS":
+						resp = fmt.Sprintf("*%v\r\n", len(members))
+						for _, member := range members {
+							resp += fmt.Sprintf("$%v\r\n%v\r\n", len(member), member)
+						}
+					case cmd[0] == "SISMEMBER":
+						atomic.AddInt32(lookups, 1)
+						resp = ":0\r\n"
+						if set[cmd[2]] {
+							resp = ":1\r\n"
+						}
+					default:
+						resp = "-ERR unknown command\r\n"
+					}
+					if _, err := conn.Write([]byte(resp)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln, lookups
+}
+
+func TestRedisNameList(t *testing.T) {
+	ln, lookups := newTestRedisServer(t, "secret", "example.com", "foo.org corp", "example.net vpn")
+	defer ln.Close()
+
+	for _, mode := range []string{"pull", "query"} {
+		from := fmt.Sprintf("redis://:secret@%v/dnsredir?mode=%v", ln.Addr(), mode)
+		items, err := NewNameItemsWithForms([]string{from})
+		if err != nil {
+			t.Fatalf("NewNameItemsWithForms() failed: %v", err)
+		}
+		if strings.Contains(items[0].url, "secret") {
+			t.Errorf("Expected password redacted, got %q", items[0].url)
+		}
+		n := &NameList{items: items, urlReload: time.Minute, urlReadTimeout: 2 * time.Second}
+		n.initRedis()
+		if mode == "pull" && !n.updateItemFromUrl(items[0], nil) {
+			t.Fatalf("Failed to fetch Redis set")
+		}
+		matches := map[string]bool{
+			"example.com":     true,
+			"www.example.com": true,
+			"example.org":     false,
+		}
+		if mode == "pull" {
+			// Lines of pulled members are parsed as usual
+			matches["foo.org"] = true
+		}
+		for name, matched := range matches {
+			if n.Match(name) != matched {
+				t.Errorf("Expected %q matched: %v in %v mode", name, matched, mode)
+			}
+		}
+		if mode == "query" {
+			// Membership is cached
+			n0 := atomic.LoadInt32(lookups)
+			if !n.Match("www.example.com") || atomic.LoadInt32(lookups) != n0 {
+				t.Errorf("Expected cached lookup, got %v lookups", atomic.LoadInt32(lookups)-n0)
+			}
+		}
+		n.closeRedis()
+	}
+
+	// Wrong password
+	items, _ := NewNameItemsWithForms([]string{fmt.Sprintf("redis://:wrong@%v/dnsredir", ln.Addr())})
+	n := &NameList{items: items, urlReadTimeout: 2 * time.Second}
+	if n.updateItemFromUrl(items[0], nil) {
+		t.Errorf("Expected failure with wrong password")
+	}
+
+	for _, from := range []string{"redis://127.0.0.1", "redis://127.0.0.1/key?mode=push", "redis://127.0.0.1/key?db=x"} {
+		if _, err := NewNameItemsWithForms([]string{from}); err == nil {
+			t.Errorf("Expected error for %q", from)
+		}
+	}
+}
+
+func TestRedisQueryFailure(t *testing.T) {
+	ln, lookups := newTestRedisServer(t, "", "example.com")
+	defer ln.Close()
+	s, err := newRedisSource(fmt.Sprintf("redis://%v/dnsredir?mode=query&timeout=50ms", ln.Addr()))
+	if err != nil {
+		t.Fatalf("newRedisSource() failed: %v", err)
+	}
+	defer s.close()
+
+	// Lookups wait for a connection at most the lookup timeout, which isn't a failure of the server
+	for i := 0; i < maxRedisConns; i++ {
+		s.conns <- struct{}{}
+	}
+	start := time.Now()
+	if s.match("example.com") || time.Since(start) > time.Second || atomic.LoadInt64(&s.retryAfter) != 0 {
+		t.Fatalf("Expected lookup timed out waiting for connection, took %v", time.Since(start))
+	}
+	for i := 0; i < maxRedisConns; i++ {
+		<-s.conns
+	}
+
+	// Lookups are skipped for a while once failed
+	s.addr = "127.0.0.1:1"
+	if s.match("example.com") || atomic.LoadInt64(&s.retryAfter) == 0 {
+		t.Fatalf("Expected failed lookup")
+	}
+	s.addr = ln.Addr().String()
+	if s.match("example.com") || atomic.LoadInt32(lookups) != 0 {
+		t.Fatalf("Expected lookup skipped after failure, got %v lookups", atomic.LoadInt32(lookups))
+	}
+	atomic.StoreInt64(&s.retryAfter, 0)
+	if !s.match("example.com") {
+		t.Fatalf("Expected lookup retried")
+	}
+
+	for _, from := range []string{"redis://127.0.0.1/key?timeout=1s", "redis://127.0.0.1/key?mode=query&timeout=0s"} {
+		if _, err := newRedisSource(from); err == nil {
+			t.Errorf("Expected error for %q", from)
+		}
+	}
+}
+
+func TestReadRedisReplyLimits(t *testing.T) {
+	for _, reply := range []string{
+		fmt.Sprintf("$%v\r\n", maxRedisBulkSize+1),
+		"*1\r\n*1\r\n*1\r\n:1\r\n",
+		fmt.Sprintf("*%v\r\n", maxRedisArraySize+1),
+		// Truncated array of bogus size
+		"*1000000\r\n:1\r\n",
+	} {
+		if v, err := readRedisReply(bufio.NewReader(strings.NewReader(reply))); err == nil {
+			t.Errorf("Expected error for %q, got %v", reply, v)
+		}
+	}
+	v, err := readRedisReply(bufio.NewReader(strings.NewReader("*2\r\n*1\r\n:1\r\n$3\r\nfoo\r\n")))
+	if err != nil || len(v.([]interface{})) != 2 {
+		t.Errorf("Expected nested array within limits, got %v %v", v, err)
+	}
+}
+
+func TestReloadMaxStale(t *testing.T) {
+	for _, maxStale := range []time.Duration{0, time.Minute} {
+		ln, _ := newTestRedisServer(t, "", "example.com")
+		items, err := NewNameItemsWithForms([]string{fmt.Sprintf("redis://%v/dnsredir", ln.Addr())})
+		if err != nil {
+			t.Fatalf("NewNameItemsWithForms() failed: %v", err)
+		}
+		item := items[0]
+		n := &NameList{items: items, urlReadTimeout: 2 * time.Second, maxStale: maxStale}
+		if !n.updateItemFromUrl(item, nil) || !n.Match("example.com") {
+			t.Fatalf("Failed to fetch Redis set")
+		}
+		_ = ln.Close()
+
+		// Failures within the grace period keep serving stale names
+		if n.updateItemFromUrl(item, nil) || !n.Match("example.com") {
+			t.Fatalf("Expected stale names kept serving")
+		}
+		item.Lock()
+		item.fetched = item.fetched.Add(-2 * time.Minute)
+		item.Unlock()
+		_ = n.updateItemFromUrl(item, nil)
+		if expired := maxStale != 0; n.Match("example.com") == expired {
+			t.Errorf("Expected names expired: %v with reload_max_stale %v", expired, maxStale)
+		}
+	}
+}
+
+func TestMatchLabelBoundary(t *testing.T) {
+	names := make(domainSet)
+	for _, name := range []string{"example.com", "e.x", "co"} {
+		names.Add(name)
+	}
+	b := newBloomFilterFromSet(names, defaultBloomRate)
+
+	for _, test := range []struct {
+		name    string
+		matched bool
+	}{
+		{"example.com", true},
+		{"foo.example.com", true},
+		{"a.b.c.example.com", true},
+		{"badexample.com", false},
+		{"notexample.com", false},
+		{"foo.badexample.com", false},
+		{"example.com.cn", false},
+		{"example.co", true},
+		{"com", false},
+		{"e.x", true},
+		{"ae.x", false},
+		{"b.e.x", true},
+		{"e.xy", false},
+		{"x", false},
+	} {
+		if matched := names.Match(test.name); matched != test.matched {
+			t.Errorf("Expected %q matched: %v, got %v", test.name, test.matched, matched)
+		}
+		if matched := names.matchBloom(test.name, b, nil); matched != test.matched {
+			t.Errorf("Expected %q matched: %v with Bloom filter, got %v", test.name, test.matched, matched)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package dnsredir
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// Overlapping names across upstreams aren't checked
+	overlapIgnore = iota
+	// Overlapping names are logged at warning level
+	overlapWarn
+	// Overlapping names fail the startup
+	overlapError
+)
+
+var overlapActions = map[string]int{
+	"warn":  overlapWarn,
+	"error": overlapError,
+}
+
+// Maximum number of overlapping names logged
+const overlapSamples = 10
+
+// Assume `name' is lower cased and without trailing dot
+// Side-effect free version of Match() regarding name sets only, i.e. no root zone handling, timing nor logging
+func (u *reloadableUpstream) matchNames(name string) bool {
+	if !u.matchAny && !u.NameList.Match(name) && !u.inline.Match(name) {
+		return false
+	}
+	return !u.ignored.Match(name)
+}
+
+// Iterate names of the upstream, i.e. names of FROM... and INLINE, names not populated yet are skipped
+func (u *reloadableUpstream) forEachName(f func(name string) error) error {
+	for _, item := range u.items {
+		names := item.loadNames()
+		if err := names.ForEachDomain(f); err != nil {
+			return err
+		}
+	}
+	return u.inline.ForEachDomain(f)
+}
+
+// Find names routed to an earlier upstream, thus never routed to the later upstream listing them
+// Return number of overlapping names and samples of them
+func findOverlaps(ups []Upstream) (uint64, []string) {
+	var n uint64
+	var samples []string
+	for j := 1; j < len(ups); j++ {
+		later := ups[j].(*reloadableUpstream)
+		_ = later.forEachName(func(name string) error {
+			if later.ignored.Match(name) {
+				return nil
+			}
+			for i := 0; i < j; i++ {
+				earlier := ups[i].(*reloadableUpstream)
+				if earlier.matchNames(name) {
+					n++
+					if len(samples) < overlapSamples {
+						samples = append(samples, fmt.Sprintf("%v(%v shadowed by %v)",
+							name, strings.Join(later.from, " "), strings.Join(earlier.from, " ")))
+					}
+					break
+				}
+			}
+			return nil
+		})
+	}
+	return n, samples
+}
+
+// Check overlapping names across upstreams according to the action
+func (r *Dnsredir) checkOverlaps() error {
+	if r.overlap == overlapIgnore {
+		return nil
+	}
+
+	n, samples := findOverlaps(*r.Upstreams)
+	if n == 0 {
+		return nil
+	}
+	NameOverlapCount.WithLabelValues(r.serverBlock).Add(float64(n))
+	msg := fmt.Sprintf("%v names overlap across upstreams, e.g. %v", n, strings.Join(samples, ", "))
+	if r.overlap == overlapError {
+		return errors.New(msg)
+	}
+	log.Warning(msg)
+	return nil
+}
@@ -0,0 +1,85 @@
+package dnsredir
+
+import (
+	"fmt"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// Locally answered records keyed by lower cased FQDN and record type, see: override
+type overrideSet map[string]map[uint16][]dns.RR
+
+// Syntax: override NAME TYPE VALUE...
+func parseOverride(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) < 3 {
+		return c.ArgErr()
+	}
+
+	name := strings.ToLower(dns.Fqdn(args[0]))
+	if _, ok := dns.IsDomainName(name); !ok {
+		return c.Errf("%v: %q isn't a domain name", dir, args[0])
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(args[1])]
+	if !ok {
+		return c.Errf("%v: unknown type %q", dir, args[1])
+	}
+	// TTL is filled at reply time, see: overrideReply()
+	rr, err := dns.NewRR(fmt.Sprintf("%v 0 IN %v %v", name, dns.TypeToString[qtype], strings.Join(args[2:], " ")))
+	if err != nil || rr == nil {
+		return c.Errf("%v: invalid %v record value %q: %v", dir, dns.TypeToString[qtype], strings.Join(args[2:], " "), err)
+	}
+
+	if u.overrides == nil {
+		u.overrides = make(overrideSet)
+	}
+	if u.overrides[name] == nil {
+		u.overrides[name] = make(map[uint16][]dns.RR)
+	}
+	u.overrides[name][qtype] = append(u.overrides[name][qtype], rr)
+	log.Infof("%v: %v", dir, rr)
+	return nil
+}
+
+// Return a reply of overridden records of the query name, nil if the request should be forwarded
+// Types other than the overridden ones are forwarded, except A and AAAA:
+//	once either is overridden, the other is replied with NODATA, so clients won't bypass the pinned address.
+func (u *reloadableUpstream) overrideReply(state *request.Request) *dns.Msg {
+	if state.QClass() != dns.ClassINET {
+		return nil
+	}
+	rrsets, ok := u.overrides[strings.ToLower(state.QName())]
+	if !ok {
+		return nil
+	}
+
+	qtype := state.QType()
+	rrs, ok := rrsets[qtype]
+	if !ok {
+		rrs, ok = rrsets[dns.TypeCNAME]
+	}
+	if !ok {
+		_, a := rrsets[dns.TypeA]
+		_, aaaa := rrsets[dns.TypeAAAA]
+		if !(qtype == dns.TypeA && aaaa || qtype == dns.TypeAAAA && a) {
+			return nil
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		// Owner name in client's original case
+		rr.Header().Name = state.QName()
+		rr.Header().Ttl = u.overrideTTL
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+const defaultOverrideTTL = 3600
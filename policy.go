@@ -5,16 +5,22 @@
 package dnsredir
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
 	"math/rand"
+	"sync"
 	"sync/atomic"
 )
 
 // SupportedPolicies is the collection of policies registered
 var SupportedPolicies = map[string]Policy{
-	"random":      &Random{},
-	"round_robin": &RoundRobin{},
-	"sequential":  &Sequential{},
-	"spray":       &Spray{},
+	"random":          &Random{},
+	"client_affinity": &ClientAffinity{},
+	"round_robin":     &RoundRobin{},
+	"sequential":      &Sequential{},
+	"spray":           &Spray{},
 }
 
 // Policy decides how a host will be selected from a pool.
@@ -27,13 +33,77 @@ type Policy interface {
 	Select(pool UpstreamHostPool) *UpstreamHost
 }
 
+// Source of randomness of selection policies, which is injectable(e.g. a seeded one) for deterministic tests
+// It must be safe for concurrent use, nil to use the global source of math/rand.
+type RandSource interface {
+	// Return a pseudo-random number in [0, n)
+	Intn(n int) int
+}
+
+func randIntn(rnd RandSource, n int) int {
+	if rnd == nil {
+		return rand.Intn(n)
+	}
+	return rnd.Intn(n)
+}
+
+// A RandSource of a seeded math/rand source, which is safe for concurrent use
+type lockedRand struct {
+	sync.Mutex
+	r *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.Lock()
+	defer l.Unlock()
+	return l.r.Intn(n)
+}
+
+// Seed from crypto/rand, so processes restarted at the same time don't share the same sequence
+func randomSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		log.Warningf("Cannot read random seed: %v", err)
+		return rand.Int63()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+// Source of initial selection indexes of `random_start' policies, replaceable by a seeded one for tests
+var startRand RandSource = newLockedRand(randomSeed())
+
+// Return a new instance of policy `name' whose initial selection index is randomized, thus a fleet of CoreDNS
+//	restarted at the same time spread their starting points across the host pool.
+// false will be returned if the policy has no initial selection index, i.e. other than round_robin and sequential.
+func newRandomStartPolicy(name string) (Policy, bool) {
+	start := randIntn(startRand, math.MaxInt32)
+	switch name {
+	case "round_robin":
+		return &RoundRobin{robin: uint32(start)}, true
+	case "sequential":
+		return &Sequential{start: start}, true
+	}
+	return nil, false
+}
+
 // Random is a policy that selects up hosts from a pool at random.
-type Random struct{}
+type Random struct {
+	rnd RandSource
+}
 
 func (r *Random) String() string { return "random" }
 
 // Select selects an up host at random from the specified pool.
+// If any up host has a nonzero weight(e.g. discovered via SRV), hosts are selected proportionally to their weights.
 func (r *Random) Select(pool UpstreamHostPool) *UpstreamHost {
+	if h := weightedSelect(pool, r.rnd); h != nil {
+		return h
+	}
+
 	// Instead of just generating a random index
 	// this is done to prevent selecting a down host
 	var randHost *UpstreamHost
@@ -46,8 +116,7 @@ func (r *Random) Select(pool UpstreamHostPool) *UpstreamHost {
 		if count == 1 {
 			randHost = host
 		} else {
-			r := rand.Int() % count
-			if r == (count - 1) {
+			if randIntn(r.rnd, count) == count-1 {
 				randHost = host
 			}
 		}
@@ -55,6 +124,69 @@ func (r *Random) Select(pool UpstreamHostPool) *UpstreamHost {
 	return randHost
 }
 
+// Select an up host proportionally to weights, see: https://tools.ietf.org/html/rfc2782
+// nil will be returned if total weight of up hosts is zero
+func weightedSelect(pool UpstreamHostPool, rnd RandSource) *UpstreamHost {
+	total := 0
+	for _, host := range pool {
+		if host.weight != 0 && !host.Down() {
+			total += int(host.weight)
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := randIntn(rnd, total)
+	for _, host := range pool {
+		if host.weight == 0 || host.Down() {
+			continue
+		}
+		if n -= int(host.weight); n < 0 {
+			return host
+		}
+	}
+	// Hosts went down concurrently
+	return nil
+}
+
+// ClientAffinity is a policy that selects the same up host for the same client consistently.
+// Rendezvous hashing is used, thus only clients of a down host are remapped, and they're mapped back once it recovered.
+// see: https://en.wikipedia.org/wiki/Rendezvous_hashing
+type ClientAffinity struct{}
+
+func (a *ClientAffinity) String() string { return "client_affinity" }
+
+// Select selects an up host at random, since the client is unknown
+func (a *ClientAffinity) Select(pool UpstreamHostPool) *UpstreamHost {
+	return (&Random{}).Select(pool)
+}
+
+// SelectClient selects the up host with the highest hash of client(i.e. client IP) and host name
+func (a *ClientAffinity) SelectClient(pool UpstreamHostPool, client string) *UpstreamHost {
+	var selected *UpstreamHost
+	var max uint64
+	for _, host := range pool {
+		if host.Down() {
+			continue
+		}
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(client))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(host.Name()))
+		if sum := h.Sum64(); selected == nil || sum > max {
+			selected = host
+			max = sum
+		}
+	}
+	return selected
+}
+
+// Policies aware of clients, which select hosts by client IP
+type clientPolicy interface {
+	SelectClient(pool UpstreamHostPool, client string) *UpstreamHost
+}
+
 // RoundRobin is a policy that selects hosts based on round robin ordering.
 type RoundRobin struct {
 	robin uint32
@@ -79,14 +211,21 @@ func (r *RoundRobin) Select(pool UpstreamHostPool) *UpstreamHost {
 }
 
 // Sequential is a policy that selects always the first healthy host in the list order.
-type Sequential struct{}
+type Sequential struct {
+	// Index of the host the list order starts from, hosts before it are wrapped around
+	start int
+}
 
 func (s *Sequential) String() string { return "sequential" }
 
 // Select always the first that is not Down, nil if all hosts are down
 func (s *Sequential) Select(pool UpstreamHostPool) *UpstreamHost {
+	if len(pool) == 0 {
+		return nil
+	}
+	start := s.start % len(pool)
 	for i := 0; i < len(pool); i++ {
-		host := pool[i]
+		host := pool[(start+i)%len(pool)]
 		if host.Down() {
 			continue
 		}
@@ -98,13 +237,15 @@ func (s *Sequential) Select(pool UpstreamHostPool) *UpstreamHost {
 // Spray is a policy that selects a host from a pool at random.
 // This should be used as a last ditch attempt to get
 //	a host when all hosts are reporting unhealthy.
-type Spray struct{}
+type Spray struct {
+	rnd RandSource
+}
 
 func (s *Spray) String() string { return "spray" }
 
 // Select selects an up host at random from the specified pool.
 func (s *Spray) Select(pool UpstreamHostPool) *UpstreamHost {
-	i := rand.Int() % len(pool)
+	i := randIntn(s.rnd, len(pool))
 	randHost := pool[i]
 	log.Warningf("All hosts reported as down, spraying to target: %s", randHost.Name())
 	return randHost
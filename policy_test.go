@@ -0,0 +1,156 @@
+package dnsredir
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func countSelections(p Policy, pool UpstreamHostPool, n int) map[*UpstreamHost]int {
+	counts := make(map[*UpstreamHost]int)
+	for i := 0; i < n; i++ {
+		counts[p.Select(pool)]++
+	}
+	return counts
+}
+
+func TestSeededSelect(t *testing.T) {
+	a := &UpstreamHost{addr: "a", weight: 3}
+	b := &UpstreamHost{addr: "b", weight: 1}
+	weighted := UpstreamHostPool{a, b}
+	x := &UpstreamHost{addr: "x"}
+	y := &UpstreamHost{addr: "y"}
+	z := &UpstreamHost{addr: "z"}
+	unweighted := UpstreamHostPool{x, y, z}
+
+	const n = 4000
+	for _, test := range []struct {
+		policy func(rnd RandSource) Policy
+		pool   UpstreamHostPool
+		shares map[*UpstreamHost]float64
+	}{
+		{func(rnd RandSource) Policy { return &Random{rnd: rnd} }, weighted, map[*UpstreamHost]float64{a: 0.75, b: 0.25}},
+		{func(rnd RandSource) Policy { return &Random{rnd: rnd} }, unweighted, map[*UpstreamHost]float64{x: 1. / 3, y: 1. / 3, z: 1. / 3}},
+		{func(rnd RandSource) Policy { return &Spray{rnd: rnd} }, unweighted, map[*UpstreamHost]float64{x: 1. / 3, y: 1. / 3, z: 1. / 3}},
+	} {
+		counts := countSelections(test.policy(newLockedRand(1)), test.pool, n)
+		// The same seed yields exactly the same selections
+		if counts1 := countSelections(test.policy(newLockedRand(1)), test.pool, n); len(counts1) != len(counts) {
+			t.Fatalf("Expected the same selections with the same seed, got %v vs %v", counts, counts1)
+		} else {
+			for host, count := range counts {
+				if counts1[host] != count {
+					t.Fatalf("Expected the same selections with the same seed, got %v vs %v", counts, counts1)
+				}
+			}
+		}
+		for host, share := range test.shares {
+			if f := float64(counts[host]) / n; f < share-0.05 || f > share+0.05 {
+				t.Errorf("%T expected share %.2f of %v, got %.2f", test.policy(nil), share, host.addr, f)
+			}
+		}
+	}
+}
+
+func TestClientAffinity(t *testing.T) {
+	var pool UpstreamHostPool
+	for _, addr := range []string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53", "10.0.0.4:53"} {
+		pool = append(pool, &UpstreamHost{proto: "dns", addr: addr, downFunc: func(uh *UpstreamHost) bool {
+			return atomic.LoadInt32(&uh.fails) > 0
+		}})
+	}
+	hc := &HealthCheck{hosts: pool, policy: SupportedPolicies["client_affinity"]}
+
+	clients := make(map[string]*UpstreamHost)
+	counts := make(map[*UpstreamHost]int)
+	for i := 0; i < 1000; i++ {
+		client := fmt.Sprintf("192.0.%v.%v", i/250, i%250)
+		host := hc.SelectClient(client)
+		clients[client] = host
+		counts[host]++
+		if hc.SelectClient(client) != host {
+			t.Fatalf("Expected the same host for the same client %v", client)
+		}
+	}
+	for _, host := range pool {
+		if counts[host] < 150 {
+			t.Errorf("Expected clients distributed evenly, got %v for %v", counts[host], host.Name())
+		}
+	}
+
+	// Only clients of the down host are remapped
+	down := pool[0]
+	atomic.StoreInt32(&down.fails, 1)
+	for client, host := range clients {
+		host1 := hc.SelectClient(client)
+		if host1 == down || (host != down && host1 != host) {
+			t.Fatalf("Unexpected remapping of client %v: %v -> %v", client, host.Name(), host1.Name())
+		}
+	}
+	atomic.StoreInt32(&down.fails, 0)
+	for client, host := range clients {
+		if hc.SelectClient(client) != host {
+			t.Fatalf("Expected client %v mapped back to %v", client, host.Name())
+		}
+	}
+}
+
+func TestRandomStart(t *testing.T) {
+	defer func(rnd RandSource) { startRand = rnd }(startRand)
+
+	pool := UpstreamHostPool{
+		&UpstreamHost{addr: "a"},
+		&UpstreamHost{addr: "b"},
+		&UpstreamHost{addr: "c"},
+		&UpstreamHost{addr: "d"},
+	}
+	if _, ok := newRandomStartPolicy("random"); ok {
+		t.Fatalf("Expected random policy has no initial selection")
+	}
+
+	// Initial selections spread across the pool with different seeds
+	firsts := make(map[string]map[*UpstreamHost]bool)
+	for seed := int64(0); seed < 32; seed++ {
+		for _, name := range []string{"round_robin", "sequential"} {
+			startRand = newLockedRand(seed)
+			p, ok := newRandomStartPolicy(name)
+			if !ok {
+				t.Fatalf("Expected %v has initial selection", name)
+			}
+			startRand = newLockedRand(seed)
+			p1, _ := newRandomStartPolicy(name)
+			host := p.Select(pool)
+			if host1 := p1.Select(pool); host1 != host {
+				t.Fatalf("Expected the same initial selection with the same seed, got %v vs %v", host.Name(), host1.Name())
+			}
+			if firsts[name] == nil {
+				firsts[name] = make(map[*UpstreamHost]bool)
+			}
+			firsts[name][host] = true
+		}
+	}
+	for name, hosts := range firsts {
+		if len(hosts) != len(pool) {
+			t.Errorf("Expected initial selections of %v spread across all hosts, got %v", name, len(hosts))
+		}
+	}
+
+	// Sequential sticks to the start host until it's down
+	startRand = newLockedRand(1)
+	p, _ := newRandomStartPolicy("sequential")
+	start := p.Select(pool)
+	if p.Select(pool) != start {
+		t.Fatalf("Expected sequential selects %v again", start.Name())
+	}
+	atomic.StoreInt32(&start.fails, 1)
+	next := p.Select(pool)
+	atomic.StoreInt32(&start.fails, 0)
+	if next == start || next == nil {
+		t.Fatalf("Expected sequential skips down host %v", start.Name())
+	}
+	for i, host := range pool {
+		if host == start && pool[(i+1)%len(pool)] != next {
+			t.Fatalf("Expected sequential wraps to the next host of %v, got %v", start.Name(), next.Name())
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package dnsredir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"sync"
+)
+
+// Package-level registry of transports, so upstream hosts with identical endpoints(possibly in different
+// 	dnsredir blocks) share the same connection pool, rather than each maintaining a separate one.
+// Transports are reference counted, the connection manager stops once the last reference is released.
+type sharedTransport struct {
+	t    *Transport
+	refs int
+}
+
+var (
+	transportsMu sync.Mutex
+	transports   = make(map[string]*sharedTransport)
+)
+
+// Return the shared transport for `key', `t' will be registered and started if there isn't one
+func acquireTransport(key string, t *Transport) *Transport {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	if st, ok := transports[key]; ok {
+		st.refs++
+		return st.t
+	}
+	transports[key] = &sharedTransport{t: t, refs: 1}
+	t.Start()
+	return t
+}
+
+func releaseTransport(key string) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	st, ok := transports[key]
+	if !ok {
+		// Never acquired, e.g. setup failed before OnStartup
+		return
+	}
+	st.refs--
+	if st.refs == 0 {
+		delete(transports, key)
+		st.t.Stop()
+	}
+}
+
+// Return the key identifying the connection pool of the upstream host, empty if it shouldn't be shared
+// Hosts share a connection pool only if all settings affecting connections are identical.
+func transportKey(uh *UpstreamHost, bootstrap []string, ipPref ipPreference) string {
+	if uh.IsDOH() {
+		// DNS-over-HTTPS uses HTTP client's own connection pool
+		return ""
+	}
+
+	t := uh.transport
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%v|%v|%v|%v|%v|%v|%v|%v|%v|%v",
+		uh.proto, uh.addr, t.recursionDesired, t.expire, t.fixedDialTimeout,
+		t.tcpProbePercent, t.udpSndbuf, t.udpRcvbuf, bootstrap, ipPref)
+	if c := t.tlsConfig; c != nil && uh.proto == transport.TLS {
+		// CA pools are compared by identity, thus hosts with CAs loaded by different `tls' directives never share
+		_, _ = fmt.Fprintf(h, "|%v|%v|%v|%p|%v", c.ServerName, c.MinVersion, c.CipherSuites, c.RootCAs, t.tlsSessionCache)
+		for _, cert := range c.Certificates {
+			for _, der := range cert.Certificate {
+				_, _ = h.Write(der)
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
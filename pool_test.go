@@ -0,0 +1,75 @@
+package dnsredir
+
+import (
+	"github.com/coredns/caddy"
+	"testing"
+)
+
+func TestSharedTransport(t *testing.T) {
+	input := `
+dnsredir a.conf {
+	to tls://1.1.1.1 dns://8.8.8.8
+	tls_servername cloudflare-dns.com
+}
+dnsredir b.conf {
+	to tls://1.1.1.1 dns://8.8.8.8
+	tls_servername cloudflare-dns.com
+}
+dnsredir c.conf {
+	to tls://1.1.1.1 dns://8.8.8.8
+	tls_servername one.one.one.one
+	expire 30s
+}`
+	c := caddy.NewTestController("dns", input)
+	ups, err := NewReloadableUpstreams(c)
+	if err != nil {
+		t.Fatalf("NewReloadableUpstreams() failed, input: %q error: %v", input, err)
+	}
+	var hcs []*HealthCheck
+	for _, up := range ups {
+		hc := up.(*reloadableUpstream).HealthCheck
+		// Don't send health checks
+		hc.checkInterval = 0
+		hc.Start()
+		hcs = append(hcs, hc)
+	}
+
+	for i := range hcs[0].hosts {
+		if hcs[0].hosts[i].transport != hcs[1].hosts[i].transport {
+			t.Errorf("Host %v should share transport", hcs[0].hosts[i].Name())
+		}
+	}
+	if hcs[0].hosts[0].transport == hcs[2].hosts[0].transport {
+		t.Errorf("Hosts with different TLS server names shouldn't share transport")
+	}
+	if hcs[0].hosts[1].transport == hcs[2].hosts[1].transport {
+		t.Errorf("Hosts with different expire shouldn't share transport")
+	}
+
+	for _, hc := range hcs {
+		hc.Stop()
+	}
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if len(transports) != 0 {
+		t.Errorf("All shared transports should be released, %v left", len(transports))
+	}
+}
+
+func TestStopUnstarted(t *testing.T) {
+	input := `
+dnsredir a.conf {
+	to tls://1.1.1.1
+	tls_servername cloudflare-dns.com
+}`
+	c := caddy.NewTestController("dns", input)
+	ups, err := NewReloadableUpstreams(c)
+	if err != nil {
+		t.Fatalf("NewReloadableUpstreams() failed, input: %q error: %v", input, err)
+	}
+	// Setup may fail before OnStartup, shared transports are released without being acquired
+	for _, host := range ups[0].(*reloadableUpstream).hosts {
+		host.stopTransport()
+	}
+	releaseTransport("nonexistent")
+}
@@ -0,0 +1,86 @@
+package dnsredir
+
+import (
+	"context"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Maximum number of alternate queries in flight per upstream, alternate queries beyond it are skipped
+const maxPrefetchAlternate = 64
+
+// Results of alternate queries, see: PrefetchAlternateCount
+const (
+	prefetchMatch    = "match"
+	prefetchMismatch = "mismatch"
+	prefetchError    = "error"
+)
+
+// Answers of the reply in a comparable form, owner names and TTLs are ignored
+//	since they may be rewritten, e.g. append_suffix, force_ttl
+func answerDigest(reply *dns.Msg) string {
+	answers := make([]string, 0, len(reply.Answer))
+	for _, rr := range reply.Answer {
+		answers = append(answers, dns.TypeToString[rr.Header().Rrtype]+rdataString(rr))
+	}
+	sort.Strings(answers)
+	return dns.RcodeToString[reply.Rcode] + "\n" + strings.ToLower(strings.Join(answers, "\n"))
+}
+
+// Select a random host other than `used', which is neither down nor draining, nil if none
+func (u *reloadableUpstream) alternateHost(used *UpstreamHost) *UpstreamHost {
+	var candidates []*UpstreamHost
+	for _, host := range u.loadHosts() {
+		if host != used && !host.down() && !host.drained() {
+			candidates = append(candidates, host)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// Query an alternate host asynchronously with the same query answered by `used', so caches of upstream hosts
+//	are warmed for failover, and the answer is validated against the one replied to the client, see: prefetch_alternate
+// `reply' is the reply of `used' before it's transformed, it's never retained.
+func (u *reloadableUpstream) prefetch(server string, ustate *request.Request, used *UpstreamHost, reply *dns.Msg) {
+	select {
+	case <-u.stop:
+		return
+	case u.prefetchSem <- struct{}{}:
+	default:
+		log.Debugf("Too many alternate queries in flight, skip %q", ustate.QName())
+		return
+	}
+	host := u.alternateHost(used)
+	if host == nil {
+		<-u.prefetchSem
+		return
+	}
+
+	digest := answerDigest(reply)
+	// The request of the client may be modified once replied, e.g. by other plugins
+	state := &request.Request{W: ustate.W, Req: ustate.Req.Copy()}
+	proto := ustate.Proto()
+	go func() {
+		defer func() { <-u.prefetchSem }()
+		// A fresh context, which isn't cancelled once the client is replied
+		ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+		defer cancel()
+
+		result := prefetchMatch
+		alt, err := host.exchange(ctx, state, proto, u.bootstrap, u.ipPref)
+		if err != nil {
+			log.Debugf("Alternate query of %q to %v failed: %v", state.QName(), host.Name(), err)
+			result = prefetchError
+		} else if answerDigest(alt) != digest {
+			log.Debugf("Alternate answer of %q from %v differs from %v's:\n%v", state.QName(), host.Name(), used.Name(), alt)
+			result = prefetchMismatch
+		}
+		PrefetchAlternateCount.WithLabelValues(server, host.Name(), result).Inc()
+	}()
+}
@@ -0,0 +1,82 @@
+package dnsredir
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// Prepare the query to be sent to upstream hosts
+// The incoming request will be copied if any modification needed, i.e. it's never modified in place
+func (u *reloadableUpstream) prepareRequest(state *request.Request) *request.Request {
+	var req *dns.Msg
+	if u.appendSuffix != "" && dns.CountLabel(state.QName()) == 1 {
+		req = state.Req.Copy()
+		req.Question[0].Name = dns.Fqdn(req.Question[0].Name) + u.appendSuffix
+	}
+	if u.qnameCase != casePreserve {
+		qname := state.QName()
+		if req != nil {
+			qname = req.Question[0].Name
+		}
+		if qname1 := caseName(qname, u.qnameCase); qname1 != qname {
+			if req == nil {
+				req = state.Req.Copy()
+			}
+			req.Question[0].Name = qname1
+		}
+	}
+	if cd := u.cdBit == cdBitSet; u.cdBit != cdBitPreserve && state.Req.CheckingDisabled != cd {
+		if req == nil {
+			req = state.Req.Copy()
+		}
+		req.CheckingDisabled = cd
+	}
+	if rd := u.rdBit == rdBitSet; u.rdBit != rdBitPreserve && state.Req.RecursionDesired != rd {
+		if req == nil {
+			req = state.Req.Copy()
+		}
+		req.RecursionDesired = rd
+	}
+	if u.tcpKeepalive != 0 && findEdns0Option(state.Req, dns.EDNS0TCPKEEPALIVE) != nil {
+		// Keepalive is negotiated with the client by ourselves, don't leak it to upstream hosts
+		if req == nil {
+			req = state.Req.Copy()
+		}
+		removeEdns0Option(req, dns.EDNS0TCPKEEPALIVE)
+	}
+	if u.forwardEdns != nil && hasEdns0OptionExcept(state.Req, u.forwardEdns) {
+		if req == nil {
+			req = state.Req.Copy()
+		}
+		keepEdns0Options(req, u.forwardEdns)
+	}
+	if u.loopDetect {
+		if req == nil {
+			req = state.Req.Copy()
+		}
+		addLoopNonce(req)
+	}
+	if opt := state.Req.IsEdns0(); u.maxMsgSize != 0 && opt != nil && int(opt.UDPSize()) > u.maxMsgSize {
+		// Don't let clients ask upstream hosts for arbitrarily large UDP replies
+		if req == nil {
+			req = state.Req.Copy()
+		}
+		req.IsEdns0().SetUDPSize(uint16(u.maxMsgSize))
+	}
+
+	if req == nil {
+		return state
+	}
+	return &request.Request{W: state.W, Req: req}
+}
+
+func caseName(name string, action int) string {
+	switch action {
+	case caseLower:
+		return strings.ToLower(name)
+	case caseUpper:
+		return strings.ToUpper(name)
+	}
+	return name
+}
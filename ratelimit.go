@@ -0,0 +1,119 @@
+package dnsredir
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+const (
+	// Reply REFUSED to rate limited clients
+	rateLimitRefused = iota
+	// Reply SERVFAIL to rate limited clients
+	rateLimitServfail
+	// Reply UDP requests with TC bit set, so clients retry over TCP which naturally rate limits them
+	rateLimitTruncated
+)
+
+var rateLimitResponses = map[string]int{
+	"refused":   rateLimitRefused,
+	"servfail":  rateLimitServfail,
+	"truncated": rateLimitTruncated,
+}
+
+// Maximum number of clients tracked by a rate limiter, new clients beyond it are limited until idle buckets evicted
+const maxRateLimitClients = 65536
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A per-client token bucket rate limiter
+type rateLimiter struct {
+	rate  float64 // Tokens refilled per second
+	burst float64 // Capacity of a bucket
+	// Action taken on rate limited clients, see: rateLimitRefused
+	response int
+
+	sync.Mutex
+	// Buckets expire once refilled to full, which are equivalent to buckets never created
+	buckets *expiringLru
+}
+
+func newRateLimiter(rate, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(rate),
+		burst:   float64(burst),
+		buckets: newExpiringLru(maxRateLimitClients),
+	}
+}
+
+// Refill the bucket up to burst according to time elapsed since last refill
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+	}
+	b.last = now
+}
+
+// Return the time the bucket will be refilled to full
+func (l *rateLimiter) refilled(b *tokenBucket) time.Time {
+	return b.last.Add(time.Duration((l.burst - b.tokens) / l.rate * float64(time.Second)))
+}
+
+// Consume a token of the client, return false if the client exceeded its limit
+// A new client is limited if all tracked clients are active, so a flood of spoofed client IPs can't bypass limits.
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	var b *tokenBucket
+	if v, ok := l.buckets.get(client, now); ok {
+		b = v.(*tokenBucket)
+		l.refill(b, now)
+	} else {
+		if l.buckets.full(now) {
+			return false
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+	}
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	l.buckets.add(client, b, l.refilled(b))
+	return allowed
+}
+
+// Reply to a rate limited request, no record is carried thus nothing is cached by the client
+// TC bit is meaningless over TCP, REFUSED will be replied instead.
+func (l *rateLimiter) reply(state *request.Request) *dns.Msg {
+	switch l.response {
+	case rateLimitServfail:
+		return newRcodeReply(state.Req, dns.RcodeServerFailure)
+	case rateLimitTruncated:
+		if state.Proto() == "udp" {
+			m := new(dns.Msg)
+			m.SetReply(state.Req)
+			m.Truncated = true
+			return m
+		}
+	}
+	return newRcodeReply(state.Req, dns.RcodeRefused)
+}
+
+// Return the reply if the client is rate limited, nil otherwise
+func (u *reloadableUpstream) rateLimitReply(server, client string, state *request.Request) *dns.Msg {
+	if u.rateLimit == nil || u.rateLimit.allow(client, time.Now()) {
+		return nil
+	}
+	log.Debugf("Client %v is rate limited, qname: %v", client, state.QName())
+	RateLimitCount.WithLabelValues(server).Inc()
+	return u.rateLimit.reply(state)
+}
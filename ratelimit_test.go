@@ -0,0 +1,95 @@
+package dnsredir
+
+import (
+	"fmt"
+	"github.com/coredns/caddy"
+	coretest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.allow("192.0.2.1", now) {
+			t.Fatalf("Expected request #%v allowed within burst", i)
+		}
+	}
+	if l.allow("192.0.2.1", now) {
+		t.Fatalf("Expected request exceeding burst limited")
+	}
+	// Other clients have their own buckets
+	if !l.allow("192.0.2.2", now) {
+		t.Fatalf("Expected another client allowed")
+	}
+	// Refilled 2 tokens per second
+	now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		if !l.allow("192.0.2.1", now) {
+			t.Fatalf("Expected request #%v allowed after refill", i)
+		}
+	}
+	if l.allow("192.0.2.1", now) {
+		t.Fatalf("Expected request exceeding refilled tokens limited")
+	}
+
+	// New clients are limited once all tracked clients are active
+	for i := 0; !l.buckets.full(now); i++ {
+		l.allow(fmt.Sprintf("client#%v", i), now)
+	}
+	if l.allow("192.0.2.3", now) {
+		t.Fatalf("Expected new client limited if too many clients tracked")
+	}
+	// Idle buckets are evicted
+	now = now.Add(time.Minute)
+	if !l.allow("192.0.2.3", now) {
+		t.Fatalf("Expected new client allowed once idle buckets evicted")
+	}
+}
+
+func TestRateLimitReply(t *testing.T) {
+	for _, test := range []struct {
+		response  string
+		proto     string
+		rcode     int
+		truncated bool
+	}{
+		{"", "udp", dns.RcodeRefused, false},
+		{"servfail", "udp", dns.RcodeServerFailure, false},
+		{"truncated", "udp", dns.RcodeSuccess, true},
+		{"truncated", "tcp", dns.RcodeRefused, false},
+	} {
+		input := "dnsredir . {\n to 1.1.1.1\n ratelimit 1\n}"
+		if test.response != "" {
+			input = "dnsredir . {\n ratelimit_response " + test.response + "\n to 1.1.1.1\n ratelimit 1\n}"
+		}
+		r := newTestDnsredir(t, input)
+		u := (*r.Upstreams)[0].(*reloadableUpstream)
+
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		state := &request.Request{W: &coretest.ResponseWriter{TCP: test.proto == "tcp"}, Req: req}
+		if reply := u.rateLimitReply("", "192.0.2.1", state); reply != nil {
+			t.Fatalf("Expected first request allowed, got %v", reply)
+		}
+		reply := u.rateLimitReply("", "192.0.2.1", state)
+		if reply == nil || reply.Rcode != test.rcode || reply.Truncated != test.truncated || len(reply.Answer) != 0 {
+			t.Errorf("Expected rcode %v truncated %v for %q over %v, got %v",
+				dns.RcodeToString[test.rcode], test.truncated, test.response, test.proto, reply)
+		}
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n to 1.1.1.1\n ratelimit 0\n}",
+		"dnsredir . {\n to 1.1.1.1\n ratelimit 1 -1\n}",
+		"dnsredir . {\n to 1.1.1.1\n ratelimit_response drop\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := NewReloadableUpstreams(c); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
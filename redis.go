@@ -0,0 +1,455 @@
+package dnsredir
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRedisPort = "6379"
+	// Maximum number of names whose membership is cached by a query mode Redis source
+	maxRedisCache = 65536
+	// Query mode lookups block requests on cache miss, thus they time out much earlier than URL reads
+	defaultRedisLookupTimeout = 500 * time.Millisecond
+	// Maximum number of connections used by query mode lookups concurrently
+	maxRedisConns = 4
+	// Query mode lookups are skipped(i.e. not matched) for a while since a lookup failed
+	redisRetryInterval = 5 * time.Second
+	// Replies sizing beyond these are considered malformed, members are domain names or lines of name lists
+	maxRedisBulkSize  = 64 * 1024
+	maxRedisArraySize = 1 << 24
+	// Only flat arrays are expected, e.g. SMEMBERS replies and commands
+	maxRedisReplyDepth = 2
+)
+
+// Returned by query mode lookups if all connections are busy, which isn't considered as a failure of the server
+var errRedisBusy = errors.New("all connections are busy")
+
+// A name list backed by a Redis set, in form of `redis://[[USER]:PASSWORD@]HOST[:PORT]/KEY[?db=N&mode=query]'
+// The set is pulled into memory along with URLs by default(i.e. mode=pull), query mode checks membership
+//	of each query name against the set on cache miss instead, which keeps memory low for huge sets.
+type redisSource struct {
+	addr     string
+	user     string
+	password string
+	db       int
+	key      string
+	query    bool
+
+	// Cache TTL of query mode, zero TTL disables the cache, see: NameList.initRedis()
+	ttl time.Duration
+	// Timeout of each query mode lookup, including dialing a new connection
+	lookupTimeout time.Duration
+
+	// Semaphore of connections used by query mode lookups and idle connections reused by them
+	conns  chan struct{}
+	idle   chan *redisConn
+	closed int32
+	// Time(in unix nanoseconds) until which query mode lookups are skipped, see: redisRetryInterval
+	retryAfter int64
+
+	// Membership of names looked up, values are bool
+	cacheMu sync.Mutex
+	cache   *expiringLru
+}
+
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func newRedisSource(from string) (*redisSource, error) {
+	u, err := url.Parse(from)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("%q expected form redis://HOST[:PORT]/KEY", from)
+	}
+	s := &redisSource{
+		addr: u.Host,
+		key:  key,
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), defaultRedisPort)
+	}
+	if u.User != nil {
+		s.user = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	q := u.Query()
+	if db := q.Get("db"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil || s.db < 0 {
+			return nil, fmt.Errorf("%q invalid db %q", from, db)
+		}
+	}
+	switch mode := q.Get("mode"); mode {
+	case "", "pull":
+	case "query":
+		s.query = true
+		s.lookupTimeout = defaultRedisLookupTimeout
+		s.conns = make(chan struct{}, maxRedisConns)
+		s.idle = make(chan *redisConn, maxRedisConns)
+		s.cache = newExpiringLru(maxRedisCache)
+	default:
+		return nil, fmt.Errorf("%q unknown mode %q, expected pull or query", from, mode)
+	}
+	if timeout := q.Get("timeout"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if !s.query || err != nil || d <= 0 {
+			return nil, fmt.Errorf("%q invalid timeout %q, expected a positive duration of query mode", from, timeout)
+		}
+		s.lookupTimeout = d
+	}
+	return s, nil
+}
+
+// Source form with password redacted
+func (s *redisSource) String() string {
+	var sb strings.Builder
+	sb.WriteString("redis://")
+	if s.password != "" {
+		sb.WriteString(s.user + ":xxxxx@")
+	}
+	sb.WriteString(s.addr + "/" + s.key)
+	var params []string
+	if s.db != 0 {
+		params = append(params, fmt.Sprintf("db=%v", s.db))
+	}
+	if s.query {
+		params = append(params, "mode=query")
+		if s.lookupTimeout != defaultRedisLookupTimeout {
+			params = append(params, fmt.Sprintf("timeout=%v", s.lookupTimeout))
+		}
+	}
+	if len(params) != 0 {
+		sb.WriteString("?" + strings.Join(params, "&"))
+	}
+	return sb.String()
+}
+
+// Reply of Redis server with error type, see: https://redis.io/topics/protocol
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// Write a command as an array of bulk strings
+func writeRedisCommand(w io.Writer, args ...string) error {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("*%v\r\n", len(args)))
+	for _, arg := range args {
+		sb.WriteString(fmt.Sprintf("$%v\r\n%v\r\n", len(arg), arg))
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// Read a reply, which is one of string, redisError, int64, []interface{}, or nil for null bulk string and null array
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	return readRedisReply0(rd, 1)
+}
+
+func readRedisReply0(rd *bufio.Reader, depth int) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	body := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return redisError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		if n > maxRedisBulkSize {
+			return nil, fmt.Errorf("bulk string of %v bytes exceeds %v", n, maxRedisBulkSize)
+		}
+		p := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, p); err != nil {
+			return nil, err
+		}
+		return string(p[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		if depth > maxRedisReplyDepth || n > maxRedisArraySize {
+			return nil, fmt.Errorf("array of %v elements nested %v levels exceeds limits", n, depth)
+		}
+		// Grow as elements arrive, so a bogus size doesn't allocate much
+		size := n
+		if size > 1024 {
+			size = 1024
+		}
+		arr := make([]interface{}, 0, size)
+		for i := 0; i < n; i++ {
+			v, err := readRedisReply0(rd, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", line[0])
+}
+
+// Read a reply and return it as error if it's an error reply
+func readRedisResult(rd *bufio.Reader) (interface{}, error) {
+	reply, err := readRedisReply(rd)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(redisError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+// Dial the Redis server, authenticate and select the database if specified
+func (s *redisSource) dial(timeout time.Duration) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", s.addr, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	rd := bufio.NewReader(conn)
+	var cmds [][]string
+	if s.password != "" {
+		if s.user != "" {
+			cmds = append(cmds, []string{"AUTH", s.user, s.password})
+		} else {
+			cmds = append(cmds, []string{"AUTH", s.password})
+		}
+	}
+	if s.db != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	for _, cmd := range cmds {
+		if err := writeRedisCommand(conn, cmd...); err != nil {
+			Close(conn)
+			return nil, nil, err
+		}
+		if _, err := readRedisResult(rd); err != nil {
+			Close(conn)
+			return nil, nil, err
+		}
+	}
+	return conn, rd, nil
+}
+
+// Return members of the set as name list content, one member per line
+func (s *redisSource) content(timeout time.Duration) (string, error) {
+	conn, rd, err := s.dial(timeout)
+	if err != nil {
+		return "", err
+	}
+	defer Close(conn)
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if err := writeRedisCommand(conn, "SMEMBERS", s.key); err != nil {
+		return "", err
+	}
+	reply, err := readRedisResult(rd)
+	if err != nil {
+		return "", err
+	}
+	arr, ok := reply.([]interface{})
+	if !ok {
+		return "", fmt.Errorf("unexpected SMEMBERS reply %v", reply)
+	}
+	members := make([]string, 0, len(arr))
+	for _, v := range arr {
+		if member, ok := v.(string); ok {
+			members = append(members, member)
+		}
+	}
+	// Sort members since their order is undefined, which changes content hash otherwise
+	sort.Strings(members)
+	return strings.Join(members, "\n"), nil
+}
+
+// Check membership of names with pipelined SISMEMBER commands over an idle connection(if any)
+// Up to maxRedisConns lookups run concurrently, others wait for a connection until the lookup times out.
+func (s *redisSource) isMembers(names []string) ([]bool, error) {
+	deadline := time.Now().Add(s.lookupTimeout)
+	timer := time.NewTimer(s.lookupTimeout)
+	defer timer.Stop()
+	select {
+	case s.conns <- struct{}{}:
+	case <-timer.C:
+		return nil, errRedisBusy
+	}
+	defer func() { <-s.conns }()
+
+	var c *redisConn
+	select {
+	case c = <-s.idle:
+	default:
+		conn, rd, err := s.dial(time.Until(deadline))
+		if err != nil {
+			return nil, err
+		}
+		c = &redisConn{conn, rd}
+	}
+	members, err := c.isMembers(s.key, names, deadline)
+	if err != nil {
+		// Connection state is unknown, never reuse it
+		Close(c.conn)
+		return nil, err
+	}
+	s.yield(c)
+	return members, nil
+}
+
+// Put the connection back for reuse, it's closed if the source is closed
+func (s *redisSource) yield(c *redisConn) {
+	select {
+	case s.idle <- c:
+	default:
+		Close(c.conn)
+	}
+	if atomic.LoadInt32(&s.closed) != 0 {
+		s.closeIdle()
+	}
+}
+
+func (c *redisConn) isMembers(key string, names []string, deadline time.Time) ([]bool, error) {
+	_ = c.conn.SetDeadline(deadline)
+	for _, name := range names {
+		if err := writeRedisCommand(c.conn, "SISMEMBER", key, name); err != nil {
+			return nil, err
+		}
+	}
+	members := make([]bool, len(names))
+	for i := range names {
+		reply, err := readRedisResult(c.rd)
+		if err != nil {
+			return nil, err
+		}
+		n, ok := reply.(int64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected SISMEMBER reply %v", reply)
+		}
+		members[i] = n == 1
+	}
+	return members, nil
+}
+
+func (s *redisSource) cached(name string, now time.Time) (member, ok bool) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	v, ok := s.cache.get(name, now)
+	if !ok {
+		return false, false
+	}
+	return v.(bool), true
+}
+
+func (s *redisSource) store(names []string, members []bool, now time.Time) {
+	if s.ttl == 0 {
+		return
+	}
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	for i, name := range names {
+		s.cache.add(name, members[i], now.Add(s.ttl))
+	}
+}
+
+// Assume `child' is lower cased and without trailing dot
+// Equivalent to domainSet.Match(), each suffix of `child' not cached is looked up in the Redis set.
+// Lookup failure is considered as not matched, lookups are skipped for redisRetryInterval since then.
+func (s *redisSource) match(child string) bool {
+	now := time.Now()
+	var misses []string
+	for {
+		if member, ok := s.cached(child, now); !ok {
+			misses = append(misses, child)
+		} else if member {
+			return true
+		}
+		i := strings.IndexByte(child, '.')
+		if i <= 0 {
+			break
+		}
+		child = child[i+1:]
+	}
+	return s.lookup(misses, now)
+}
+
+// Check if `name' itself is in the Redis set, unlike match() its parents aren't looked up
+// It's mostly cached, since match() looked up all suffixes of the query name.
+func (s *redisSource) contains(name string) bool {
+	now := time.Now()
+	if member, ok := s.cached(name, now); ok {
+		return member
+	}
+	return s.lookup([]string{name}, now)
+}
+
+// Look up names not cached and cache the results, return true if any of them is a member
+func (s *redisSource) lookup(misses []string, now time.Time) bool {
+	if len(misses) == 0 || now.UnixNano() < atomic.LoadInt64(&s.retryAfter) {
+		return false
+	}
+
+	members, err := s.isMembers(misses)
+	if err == errRedisBusy {
+		log.Debugf("Failed to look up %q in redis://%v/%v, err: %v", misses[0], s.addr, s.key, err)
+		return false
+	}
+	if err != nil {
+		atomic.StoreInt64(&s.retryAfter, now.Add(redisRetryInterval).UnixNano())
+		log.Warningf("Failed to look up %q in redis://%v/%v, retry after %v  err: %v", misses[0], s.addr, s.key, redisRetryInterval, err)
+		return false
+	}
+	s.store(misses, members, now)
+	for _, member := range members {
+		if member {
+			return true
+		}
+	}
+	return false
+}
+
+// Close idle connections, connections of in-flight lookups are closed once they finished
+func (s *redisSource) close() {
+	if !s.query {
+		return
+	}
+	atomic.StoreInt32(&s.closed, 1)
+	s.closeIdle()
+}
+
+func (s *redisSource) closeIdle() {
+	for {
+		select {
+		case c := <-s.idle:
+			Close(c.conn)
+		default:
+			return
+		}
+	}
+}
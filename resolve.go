@@ -0,0 +1,127 @@
+package dnsredir
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Address family preference used to dial upstream hosts specified by domain name
+type ipPreference int
+
+const (
+	ipAny ipPreference = iota
+	ipv4Only
+	ipv6Only
+	preferIPv4
+	preferIPv6
+)
+
+var ipPreferences = map[string]ipPreference{
+	"ipv4_only":   ipv4Only,
+	"ipv6_only":   ipv6Only,
+	"prefer_ipv4": preferIPv4,
+	"prefer_ipv6": preferIPv6,
+}
+
+func (p ipPreference) String() string {
+	for s, pref := range ipPreferences {
+		if pref == p {
+			return s
+		}
+	}
+	return "any"
+}
+
+// Restrict the network to a specific address family for ipv4_only and ipv6_only
+// e.g. "tcp" becomes "tcp4", "tcp-tls" becomes "tcp4-tls"
+func (p ipPreference) network(network string) string {
+	var suffix string
+	switch p {
+	case ipv4Only:
+		suffix = "4"
+	case ipv6Only:
+		suffix = "6"
+	default:
+		return network
+	}
+
+	isTls := strings.HasSuffix(network, "-tls")
+	network = strings.TrimSuffix(network, "-tls")
+	if network == "tcp" || network == "udp" {
+		network += suffix
+	}
+	if isTls {
+		network += "-tls"
+	}
+	return network
+}
+
+func (p ipPreference) preferred(ip net.IP) bool {
+	isIPv4 := ip.To4() != nil
+	return (p == preferIPv4 && isIPv4) || (p == preferIPv6 && !isIPv4)
+}
+
+// Resolve `hostport' and return addresses ordered by the preference, the preferred address family comes first.
+// nil will be returned if there is no preference or the host part is already an IP address,
+//	in which case `hostport' should be dialed directly.
+func (p ipPreference) resolve(ctx context.Context, resolver *net.Resolver, hostport string) ([]string, error) {
+	if p != preferIPv4 && p != preferIPv6 {
+		return nil, nil
+	}
+	if hostPortIsIpPort(hostport) {
+		return nil, nil
+	}
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address found for %q", host)
+	}
+
+	sort.SliceStable(ips, func(i, j int) bool {
+		return p.preferred(ips[i].IP) && !p.preferred(ips[j].IP)
+	})
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs, nil
+}
+
+// Return a resolver which randomly chooses a bootstrap DNS for each lookup, nil if there's no bootstrap DNS
+// Record types looked up follow the network dialed, see: ipPreference.network()
+//	thus ipv4_only and ipv6_only only look up A and AAAA records respectively.
+func bootstrapResolver(bootstrap []string, ipPref ipPreference) *net.Resolver {
+	if len(bootstrap) == 0 {
+		return nil
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if ipPref == ipv4Only {
+				if strings.HasPrefix(network, "tcp") {
+					network = "tcp4"
+				}
+				if strings.HasPrefix(network, "udp") {
+					network = "udp4"
+				}
+			}
+			var d net.Dialer
+			addr := bootstrap[rand.Intn(len(bootstrap))]
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
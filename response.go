@@ -0,0 +1,189 @@
+package dnsredir
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Return CNAME chain depth in the answer section, which starts from `name'
+// A CNAME loop is considered infinitely deep, i.e. -1 will be returned
+func cnameChainDepth(answer []dns.RR, name string) int {
+	depth := 0
+	seen := make(map[string]struct{})
+	for {
+		name = strings.ToLower(name)
+		if _, ok := seen[name]; ok {
+			return -1
+		}
+		seen[name] = struct{}{}
+
+		target := ""
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target = cname.Target
+				break
+			}
+		}
+		if target == "" {
+			return depth
+		}
+		depth++
+		name = target
+	}
+}
+
+// Check if the reply's question section exactly matches the query, names are compared case-insensitively
+// Unlike request.Request.Match(), question class is checked too
+func questionMatch(state *request.Request, reply *dns.Msg) bool {
+	return state.Match(reply) && reply.Question[0].Qclass == state.QClass()
+}
+
+// Check if any question of the reply exactly matches the query, names are compared case-insensitively
+func containsQuestion(state *request.Request, reply *dns.Msg) bool {
+	for _, q := range reply.Question {
+		if strings.EqualFold(q.Name, state.QName()) && q.Qtype == state.QType() && q.Qclass == state.QClass() {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the reply matches the query, see: questionMatch()
+// With normalize_question, a reply is matched as long as transaction ID is the same and any of its questions
+//	matches the query, e.g. extra questions echoed back, its question section is normalized to the client's.
+// With lenient_match, a reply is matched as long as transaction ID and question type(if any) are the same,
+//	and its question section is therefore restored to the client's.
+func (u *reloadableUpstream) replyMatch(state *request.Request, reply *dns.Msg) bool {
+	if questionMatch(state, reply) {
+		return true
+	}
+	if !reply.Response || reply.Id != state.Req.Id {
+		return false
+	}
+	if u.normalizeQuestion && containsQuestion(state, reply) {
+		log.Debugf("Normalized reply  question: %v qname: %v", reply.Question, state.QName())
+		reply.Question = []dns.Question{state.Req.Question[0]}
+		return true
+	}
+	if !u.lenientMatch {
+		return false
+	}
+	if len(reply.Question) != 0 && reply.Question[0].Qtype != state.QType() {
+		return false
+	}
+	log.Debugf("Leniently matched reply  question: %v qname: %v", reply.Question, state.QName())
+	reply.Question = []dns.Question{state.Req.Question[0]}
+	return true
+}
+
+// Mismatched replies of an upstream are logged at most once per interval, see: log_mismatch
+const mismatchLogInterval = time.Second
+
+// Allow an event at most once per interval, events suppressed in between are counted
+type logLimiter struct {
+	next       int64 // In unix nanoseconds
+	suppressed uint64
+}
+
+// Return true along with number of events suppressed since the last allowed one if the event is allowed
+func (l *logLimiter) allow(now time.Time, interval time.Duration) (bool, uint64) {
+	next := atomic.LoadInt64(&l.next)
+	if now.UnixNano() < next || !atomic.CompareAndSwapInt64(&l.next, next, now.Add(interval).UnixNano()) {
+		atomic.AddUint64(&l.suppressed, 1)
+		return false, 0
+	}
+	return true, atomic.SwapUint64(&l.suppressed, 0)
+}
+
+// Log a mismatched reply at warning level with a hexdump of up to u.logMismatch bytes of `raw', see: replyMatch()
+// `raw' is wire format of the reply as received, nil if unavailable(e.g. DoH JSON).
+func (u *reloadableUpstream) logMismatchedReply(host *UpstreamHost, state *request.Request, reply *dns.Msg, raw []byte) {
+	if u.logMismatch == 0 {
+		return
+	}
+	ok, suppressed := u.mismatchLog.allow(time.Now(), mismatchLogInterval)
+	if !ok {
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Mismatched reply  host: %v client: %v id: %v/%v qname: %v qtype: %v question: %v",
+		host.Name(), state.RemoteAddr(), reply.Id, state.Req.Id, state.QName(), dns.TypeToString[state.QType()], reply.Question))
+	if suppressed != 0 {
+		sb.WriteString(fmt.Sprintf(" suppressed: %v", suppressed))
+	}
+	if raw == nil {
+		sb.WriteString(" (wire format unavailable)")
+	} else {
+		n := len(raw)
+		if n > u.logMismatch {
+			raw = raw[:u.logMismatch]
+		}
+		sb.WriteString(fmt.Sprintf(" size: %v\n%v", n, hex.Dump(raw)))
+	}
+	log.Warning(strings.TrimSuffix(sb.String(), "\n"))
+}
+
+// Check if the reply is larger than max_upstream_msg_size, the reply is truncated to fit if truncate action enabled
+// Size is measured in compressed wire format, thus the reply is compressed.
+func (u *reloadableUpstream) oversizedReply(reply *dns.Msg) bool {
+	if u.maxMsgSize == 0 {
+		return false
+	}
+	reply.Compress = true
+	if reply.Len() <= u.maxMsgSize {
+		return false
+	}
+	if u.maxMsgSizeTruncate {
+		reply.Truncate(u.maxMsgSize)
+	}
+	return true
+}
+
+// Restore the reply of a query modified by prepareRequest() to match the client's question
+func (u *reloadableUpstream) restoreReply(state, ustate *request.Request, reply *dns.Msg) {
+	if state == ustate {
+		return
+	}
+
+	// The client sees its own CD and RD bits, see: prepareRequest()
+	reply.CheckingDisabled = state.Req.CheckingDisabled
+	reply.RecursionDesired = state.Req.RecursionDesired
+	if u.loopDetect {
+		stripLoopNonce(state, reply)
+	}
+
+	// Name in client's original case
+	qname := state.Req.Question[0].Name
+	uqname := ustate.Req.Question[0].Name
+	if len(reply.Question) != 0 && strings.EqualFold(reply.Question[0].Name, uqname) {
+		reply.Question[0].Name = qname
+	}
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); strings.EqualFold(hdr.Name, uqname) {
+				// Strip the appended suffix from owner name
+				hdr.Name = qname
+			}
+		}
+	}
+}
+
+// Rewrite TTL of answer and authority records in place
+func rewriteTTLs(reply *dns.Msg, f func(rr dns.RR) uint32) {
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns} {
+		for _, rr := range section {
+			rr.Header().Ttl = f(rr)
+		}
+	}
+}
+
+// Write a reply with given RCODE to the client
+func writeRcode(w dns.ResponseWriter, req *dns.Msg, rcode int) {
+	_ = w.WriteMsg(newRcodeReply(req, rcode))
+}
@@ -0,0 +1,617 @@
+package dnsredir
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	coretest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	stdlog "log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestRRs(t *testing.T, records ...string) []dns.RR {
+	var rrs []dns.RR
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("dns.NewRR(%q) failed, error: %v", s, err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func TestCnameChainDepth(t *testing.T) {
+	tests := []struct {
+		answer   []dns.RR
+		name     string
+		expected int
+	}{
+		{nil, "example.com.", 0},
+		{newTestRRs(t, "example.com. 60 IN A 1.2.3.4"), "example.com.", 0},
+		{newTestRRs(t,
+			"www.example.com. 60 IN CNAME a.example.net.",
+			"a.example.net. 60 IN CNAME b.example.org.",
+			"b.example.org. 60 IN A 1.2.3.4",
+		), "WWW.Example.COM.", 2},
+		// Order of the records doesn't matter
+		{newTestRRs(t,
+			"b.example.org. 60 IN CNAME c.example.org.",
+			"a.example.net. 60 IN CNAME b.example.org.",
+			"www.example.com. 60 IN CNAME a.example.net.",
+		), "www.example.com.", 3},
+		// Loop
+		{newTestRRs(t,
+			"a.example.com. 60 IN CNAME b.example.com.",
+			"b.example.com. 60 IN CNAME a.example.com.",
+		), "a.example.com.", -1},
+	}
+	for i, test := range tests {
+		if depth := cnameChainDepth(test.answer, test.name); depth != test.expected {
+			t.Errorf("Test#%v failed  depth: %v vs %v", i, depth, test.expected)
+		}
+	}
+}
+
+func TestAppendSuffix(t *testing.T) {
+	u := &reloadableUpstream{appendSuffix: "corp.example."}
+
+	req := new(dns.Msg)
+	req.SetQuestion("Host.", dns.TypeA)
+	state := &request.Request{Req: req}
+	ustate := u.prepareRequest(state)
+	if ustate == state || ustate.Req.Question[0].Name != "Host.corp.example." {
+		t.Fatalf("Unexpected outgoing question: %v", ustate.Req.Question)
+	}
+	if req.Question[0].Name != "Host." {
+		t.Errorf("Incoming request modified: %v", req.Question)
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(ustate.Req)
+	reply.Answer = newTestRRs(t, "host.corp.example. 60 IN A 10.0.0.1")
+	u.restoreReply(state, ustate, reply)
+	if !state.Match(reply) || reply.Answer[0].Header().Name != "Host." {
+		t.Errorf("Unexpected restored reply: %v", reply)
+	}
+
+	// Multi-label query is forwarded as-is
+	req = new(dns.Msg)
+	req.SetQuestion("host.example.", dns.TypeA)
+	state = &request.Request{Req: req}
+	if u.prepareRequest(state) != state {
+		t.Errorf("Multi-label query shouldn't be modified")
+	}
+}
+
+func TestCdBit(t *testing.T) {
+	tests := []struct {
+		action int
+		cd     bool
+		ucd    bool
+	}{
+		{cdBitPreserve, false, false},
+		{cdBitPreserve, true, true},
+		{cdBitSet, false, true},
+		{cdBitSet, true, true},
+		{cdBitClear, false, false},
+		{cdBitClear, true, false},
+	}
+	for i, test := range tests {
+		u := &reloadableUpstream{cdBit: test.action}
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.CheckingDisabled = test.cd
+		state := &request.Request{Req: req}
+		ustate := u.prepareRequest(state)
+		if ustate.Req.CheckingDisabled != test.ucd {
+			t.Errorf("Test#%v failed  outgoing CD bit expected %v, got %v", i, test.ucd, ustate.Req.CheckingDisabled)
+		}
+		if (ustate == state) != (test.cd == test.ucd) {
+			t.Errorf("Test#%v failed  request should be copied only if CD bit changed", i)
+		}
+		if req.CheckingDisabled != test.cd {
+			t.Errorf("Test#%v failed  incoming request modified", i)
+		}
+
+		reply := new(dns.Msg)
+		reply.SetReply(ustate.Req)
+		u.restoreReply(state, ustate, reply)
+		if reply.CheckingDisabled != test.cd {
+			t.Errorf("Test#%v failed  reply CD bit expected %v, got %v", i, test.cd, reply.CheckingDisabled)
+		}
+	}
+}
+
+func TestRdBit(t *testing.T) {
+	tests := []struct {
+		action int
+		rd     bool
+		urd    bool
+	}{
+		{rdBitPreserve, false, false},
+		{rdBitPreserve, true, true},
+		{rdBitSet, false, true},
+		{rdBitSet, true, true},
+		{rdBitClear, false, false},
+		{rdBitClear, true, false},
+	}
+	for i, test := range tests {
+		u := &reloadableUpstream{rdBit: test.action}
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.RecursionDesired = test.rd
+		state := &request.Request{Req: req}
+		ustate := u.prepareRequest(state)
+		if ustate.Req.RecursionDesired != test.urd {
+			t.Errorf("Test#%v failed  outgoing RD bit expected %v, got %v", i, test.urd, ustate.Req.RecursionDesired)
+		}
+		if (ustate == state) != (test.rd == test.urd) {
+			t.Errorf("Test#%v failed  request should be copied only if RD bit changed", i)
+		}
+		if req.RecursionDesired != test.rd {
+			t.Errorf("Test#%v failed  incoming request modified", i)
+		}
+
+		reply := new(dns.Msg)
+		reply.SetReply(ustate.Req)
+		u.restoreReply(state, ustate, reply)
+		if reply.RecursionDesired != test.rd {
+			t.Errorf("Test#%v failed  reply RD bit expected %v, got %v", i, test.rd, reply.RecursionDesired)
+		}
+	}
+}
+
+func TestForwardEdns(t *testing.T) {
+	c := caddy.NewTestController("dns", "dnsredir . {\n forward_edns ecs\n forward_edns 65001\n to 1.2.3.4\n}")
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed: %v", err)
+	}
+	u := up.(*reloadableUpstream)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0")},
+		&dns.EDNS0_NSID{Code: dns.EDNS0NSID},
+		&dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1}},
+		&dns.EDNS0_LOCAL{Code: 65002, Data: []byte{2}},
+	)
+	state := &request.Request{Req: req}
+	ustate := u.prepareRequest(state)
+	if ustate == state {
+		t.Fatalf("Request should be copied since options removed")
+	}
+	var codes []uint16
+	for _, o := range ustate.Req.IsEdns0().Option {
+		codes = append(codes, o.Option())
+	}
+	if len(codes) != 2 || codes[0] != dns.EDNS0SUBNET || codes[1] != 65001 {
+		t.Errorf("Expected ECS and 65001 forwarded, got %v", codes)
+	}
+	if len(req.IsEdns0().Option) != 4 || !ustate.Req.IsEdns0().Do() {
+		t.Errorf("Incoming request modified or DO bit lost")
+	}
+
+	// Nothing to remove
+	req.IsEdns0().Option = opt.Option[:1]
+	if u.prepareRequest(state) != state {
+		t.Errorf("Request shouldn't be copied if all options are forwarded")
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n forward_edns\n to 1.2.3.4\n}",
+		"dnsredir . {\n forward_edns BOGUS\n to 1.2.3.4\n}",
+		"dnsredir . {\n forward_edns 65536\n to 1.2.3.4\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := newReloadableUpstream(c); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestQnameCase(t *testing.T) {
+	tests := []struct {
+		action int
+		suffix string
+		qname  string
+		uqname string
+	}{
+		{casePreserve, "", "WwW.Example.com.", "WwW.Example.com."},
+		{caseLower, "", "WwW.Example.com.", "www.example.com."},
+		{caseUpper, "", "WwW.Example.com.", "WWW.EXAMPLE.COM."},
+		{caseLower, "", "www.example.com.", "www.example.com."},
+		{caseUpper, "Corp.Example.", "Host.", "HOST.CORP.EXAMPLE."},
+	}
+	for i, test := range tests {
+		u := &reloadableUpstream{qnameCase: test.action, appendSuffix: test.suffix}
+		req := new(dns.Msg)
+		req.SetQuestion(test.qname, dns.TypeA)
+		state := &request.Request{Req: req}
+		ustate := u.prepareRequest(state)
+		if uqname := ustate.Req.Question[0].Name; uqname != test.uqname {
+			t.Errorf("Test#%v failed  outgoing qname expected %q, got %q", i, test.uqname, uqname)
+			continue
+		}
+		if (ustate == state) != (test.qname == test.uqname) {
+			t.Errorf("Test#%v failed  request should be copied only if qname changed", i)
+		}
+		if req.Question[0].Name != test.qname {
+			t.Errorf("Test#%v failed  incoming request modified", i)
+		}
+
+		reply := new(dns.Msg)
+		reply.SetReply(ustate.Req)
+		// Upstream hosts may reply owner names in any case
+		reply.Answer = newTestRRs(t, strings.ToLower(test.uqname)+" 60 IN A 10.0.0.1")
+		u.restoreReply(state, ustate, reply)
+		if !questionMatch(state, reply) || reply.Question[0].Name != test.qname {
+			t.Errorf("Test#%v failed  unexpected restored question: %v", i, reply.Question)
+		}
+		if ustate != state && reply.Answer[0].Header().Name != test.qname {
+			t.Errorf("Test#%v failed  unexpected restored reply: %v", i, reply)
+		}
+	}
+}
+
+func TestForceTTL(t *testing.T) {
+	u := &reloadableUpstream{}
+	reply := new(dns.Msg)
+	reply.Answer = newTestRRs(t, "example.com. 300 IN A 192.0.2.1")
+	reply.Ns = newTestRRs(t, "example.com. 3600 IN NS ns.example.com.")
+	reply.Extra = newTestRRs(t, "ns.example.com. 3600 IN A 192.0.2.53")
+
+	u.transformReply(nil, reply)
+	if reply.Answer[0].Header().Ttl != 300 {
+		t.Fatalf("TTL shouldn't be modified if force_ttl disabled")
+	}
+
+	u.setTransform(&forceTTLTransform{ttl: 0})
+	u.transformReply(nil, reply)
+	for _, rr := range append(reply.Answer, reply.Ns...) {
+		if rr.Header().Ttl != 0 {
+			t.Fatalf("Expected TTL 0, got %v", rr)
+		}
+	}
+	if reply.Extra[0].Header().Ttl != 3600 {
+		t.Fatalf("Additional records shouldn't be modified, got %v", reply.Extra[0])
+	}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	u := &reloadableUpstream{}
+	u.setTransform(&defaultTTLTransform{ttl: 60})
+	reply := new(dns.Msg)
+	reply.Answer = newTestRRs(t,
+		"example.com. 0 IN HTTPS 1 . alpn=h2",
+		"example.com. 5 IN A 192.0.2.1",
+	)
+	reply.Ns = newTestRRs(t, "example.com. 0 IN NS ns.example.com.")
+	reply.Extra = newTestRRs(t, "ns.example.com. 0 IN A 192.0.2.53")
+
+	u.transformReply(nil, reply)
+	for i, ttl := range []uint32{60, 5, 60} {
+		if rr := append(reply.Answer, reply.Ns...)[i]; rr.Header().Ttl != ttl {
+			t.Errorf("Expected TTL %v, got %v", ttl, rr)
+		}
+	}
+	if reply.Extra[0].Header().Ttl != 0 {
+		t.Errorf("Additional records shouldn't be modified, got %v", reply.Extra[0])
+	}
+}
+
+func TestTcpKeepalive(t *testing.T) {
+	u := &reloadableUpstream{tcpKeepalive: 50}
+	u.setTransform(&tcpKeepaliveTransform{timeout: 50})
+	newReq := func(keepalive bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.SetEdns0(4096, false)
+		if keepalive {
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+		}
+		return req
+	}
+
+	tests := []struct {
+		tcp       bool
+		keepalive bool
+		expected  bool
+	}{
+		{true, true, true},
+		{true, false, false},
+		{false, true, false},
+		{false, false, false},
+	}
+	for i, test := range tests {
+		state := &request.Request{W: &coretest.ResponseWriter{TCP: test.tcp}, Req: newReq(test.keepalive)}
+		ustate := u.prepareRequest(state)
+		if findEdns0Option(ustate.Req, dns.EDNS0TCPKEEPALIVE) != nil {
+			t.Errorf("Test#%v failed  keepalive option shouldn't be forwarded", i)
+		}
+		if findEdns0Option(state.Req, dns.EDNS0TCPKEEPALIVE) != nil != test.keepalive {
+			t.Errorf("Test#%v failed  client request shouldn't be modified", i)
+		}
+
+		// Upstream's keepalive option should never be passed to the client
+		reply := new(dns.Msg)
+		reply.SetReply(ustate.Req)
+		reply.SetEdns0(4096, false)
+		reply.IsEdns0().Option = append(reply.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Length: 2, Timeout: 1})
+		u.transformReply(state, reply)
+
+		o := findEdns0Option(reply, dns.EDNS0TCPKEEPALIVE)
+		if (o != nil) != test.expected {
+			t.Errorf("Test#%v failed  expected keepalive option: %v, got %v", i, test.expected, o)
+			continue
+		}
+		if o != nil && o.(*dns.EDNS0_TCP_KEEPALIVE).Timeout != 50 {
+			t.Errorf("Test#%v failed  unexpected keepalive option %v", i, o)
+		}
+	}
+}
+
+func TestQuestionMatch(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("Example.COM.", dns.TypeA)
+	state := &request.Request{Req: req}
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		qclass  uint16
+		matched bool
+	}{
+		{"Example.COM.", dns.TypeA, dns.ClassINET, true},
+		{"eXAMPLE.com.", dns.TypeA, dns.ClassINET, true},
+		{"example.net.", dns.TypeA, dns.ClassINET, false},
+		{"example.com.", dns.TypeAAAA, dns.ClassINET, false},
+		{"example.com.", dns.TypeA, dns.ClassCHAOS, false},
+	}
+	for i, test := range tests {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		reply.Question[0] = dns.Question{Name: test.name, Qtype: test.qtype, Qclass: test.qclass}
+		if matched := questionMatch(state, reply); matched != test.matched {
+			t.Errorf("Test#%v failed  %v matched: %v vs %v", i, reply.Question[0], matched, test.matched)
+		}
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Question = nil
+	if questionMatch(state, reply) {
+		t.Errorf("Reply without question shouldn't match")
+	}
+}
+
+func TestLenientMatch(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("Example.COM.", dns.TypeA)
+	state := &request.Request{Req: req}
+
+	tests := []struct {
+		question []dns.Question
+		id       uint16
+		strict   bool
+		lenient  bool
+	}{
+		{[]dns.Question{{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}, req.Id, true, true},
+		{[]dns.Question{{Name: "EXAMPLE.COM", Qtype: dns.TypeA, Qclass: dns.ClassINET}}, req.Id, false, true},
+		{[]dns.Question{{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassCHAOS}}, req.Id, false, true},
+		{nil, req.Id, false, true},
+		{[]dns.Question{{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}}, req.Id, false, false},
+		// Transaction ID of strictly matched replies is checked by UpstreamHost.Exchange()
+		{[]dns.Question{{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}, req.Id + 1, true, true},
+		{[]dns.Question{{Name: "example.net.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}, req.Id + 1, false, false},
+	}
+	for i, test := range tests {
+		for _, lenient := range []bool{false, true} {
+			u := &reloadableUpstream{lenientMatch: lenient}
+			reply := new(dns.Msg)
+			reply.SetReply(req)
+			reply.Id = test.id
+			reply.Question = test.question
+			expected := test.strict || (lenient && test.lenient)
+			if matched := u.replyMatch(state, reply); matched != expected {
+				t.Errorf("Test#%v failed  lenient: %v matched: %v vs %v", i, lenient, matched, expected)
+				continue
+			}
+			if expected && !questionMatch(state, reply) {
+				t.Errorf("Test#%v failed  question not restored: %v", i, reply.Question)
+			}
+		}
+	}
+}
+
+func TestNormalizeQuestion(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("Example.COM.", dns.TypeA)
+	state := &request.Request{Req: req}
+
+	a := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	aaaa := dns.Question{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
+	other := dns.Question{Name: "example.net.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	tests := []struct {
+		question []dns.Question
+		id       uint16
+		matched  bool
+	}{
+		{[]dns.Question{a}, req.Id, true},
+		{[]dns.Question{a, aaaa}, req.Id, true},
+		{[]dns.Question{other, a}, req.Id, true},
+		{[]dns.Question{other, aaaa}, req.Id, false},
+		{nil, req.Id, false},
+		{[]dns.Question{a, aaaa}, req.Id + 1, false},
+	}
+	for i, test := range tests {
+		u := &reloadableUpstream{normalizeQuestion: true}
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		reply.Id = test.id
+		reply.Question = test.question
+		if matched := u.replyMatch(state, reply); matched != test.matched {
+			t.Errorf("Test#%v failed  matched: %v vs %v", i, matched, test.matched)
+			continue
+		}
+		if test.matched && !questionMatch(state, reply) {
+			t.Errorf("Test#%v failed  question not normalized: %v", i, reply.Question)
+		}
+	}
+}
+
+func TestLogMismatchedReply(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	state := &request.Request{W: &coretest.ResponseWriter{}, Req: req}
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Question[0].Name = "example.net."
+	reply.Answer = newTestRRs(t, "example.net. 60 IN A 192.0.2.1")
+	raw, err := reply.Pack()
+	if err != nil {
+		t.Fatalf("Pack() failed: %v", err)
+	}
+	host := &UpstreamHost{proto: "dns", addr: "192.0.2.53:53"}
+
+	var buf bytes.Buffer
+	stdlog.SetOutput(&buf)
+	defer stdlog.SetOutput(os.Stderr)
+
+	u := &reloadableUpstream{}
+	if u.logMismatchedReply(host, state, reply, raw); buf.Len() != 0 {
+		t.Errorf("Expected nothing logged by default, got %q", buf.String())
+	}
+
+	u.logMismatch = 16
+	u.logMismatchedReply(host, state, reply, raw)
+	msg := strings.TrimSuffix(buf.String(), "\n")
+	if !strings.Contains(msg, host.Name()) || !strings.Contains(msg, "example.com.") || !strings.Contains(msg, "example.net.") {
+		t.Errorf("Expected host and questions logged, got %q", msg)
+	}
+	// Header line followed by a single hexdump line of 16 bytes
+	if lines := strings.Split(msg, "\n"); len(lines) != 2 || !strings.Contains(lines[1], fmt.Sprintf("%02x %02x", raw[0], raw[1])) {
+		t.Errorf("Expected hexdump of the wire format bounded to 16 bytes, got %q", msg)
+	}
+
+	// Logs in the same interval are suppressed and counted
+	buf.Reset()
+	u.logMismatchedReply(host, state, reply, raw)
+	if buf.Len() != 0 {
+		t.Errorf("Expected log suppressed, got %q", buf.String())
+	}
+	atomic.StoreInt64(&u.mismatchLog.next, 0)
+	u.logMismatchedReply(host, state, reply, nil)
+	if msg := buf.String(); !strings.Contains(msg, "suppressed: 1") || !strings.Contains(msg, "wire format unavailable") {
+		t.Errorf("Expected suppressed logs counted, got %q", msg)
+	}
+}
+
+func TestLoopDetect(t *testing.T) {
+	r := newTestDnsredir(t, "dnsredir . {\n loop_detect\n to 1.1.1.1\n}")
+	r.loopDetect = true
+	u := (*r.Upstreams)[0].(*reloadableUpstream)
+
+	for _, edns := range []bool{false, true} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if edns {
+			req.SetEdns0(1232, false)
+		}
+		state := &request.Request{W: &coretest.ResponseWriter{}, Req: req}
+		if isLooped(state.Req) {
+			t.Fatalf("Client query shouldn't be looped")
+		}
+
+		ustate := u.prepareRequest(state)
+		if !isLooped(ustate.Req) || isLooped(state.Req) {
+			t.Fatalf("Expected only the upstream query tagged with nonce")
+		}
+		// The looped back query is refused
+		rec := dnstest.NewRecorder(&coretest.ResponseWriter{})
+		if _, err := r.ServeDNS(context.Background(), rec, ustate.Req); err != nil || rec.Msg == nil || rec.Msg.Rcode != dns.RcodeRefused {
+			t.Fatalf("Expected looped query refused, got %v %v", rec.Msg, err)
+		}
+
+		// Upstream echoed the query's OPT
+		reply := new(dns.Msg)
+		reply.SetReply(ustate.Req)
+		reply.Extra = append(reply.Extra, dns.Copy(ustate.Req.IsEdns0()))
+		u.restoreReply(state, ustate, reply)
+		if edns && (reply.IsEdns0() == nil || findEdns0Option(reply, loopDetectOption) != nil) {
+			t.Errorf("Expected nonce stripped from reply OPT, got %v", reply.Extra)
+		}
+		if !edns && reply.IsEdns0() != nil {
+			t.Errorf("Expected OPT stripped from reply, got %v", reply.Extra)
+		}
+	}
+
+	// Nonce of other processes isn't a loop
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: loopDetectOption, Data: []byte("whatever")})
+	if isLooped(req) {
+		t.Errorf("Nonce of other processes shouldn't be considered as looped")
+	}
+}
+
+func TestMaxUpstreamMsgSize(t *testing.T) {
+	for _, truncate := range []bool{false, true} {
+		input := "dnsredir . {\n max_upstream_msg_size 512\n to 1.1.1.1\n}"
+		if truncate {
+			input = "dnsredir . {\n max_upstream_msg_size 512 truncate\n to 1.1.1.1\n}"
+		}
+		r := newTestDnsredir(t, input)
+		u := (*r.Upstreams)[0].(*reloadableUpstream)
+
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeTXT)
+		req.SetEdns0(dns.MaxMsgSize, false)
+		state := &request.Request{W: &coretest.ResponseWriter{}, Req: req}
+		ustate := u.prepareRequest(state)
+		if size := ustate.Req.IsEdns0().UDPSize(); size != 512 || req.IsEdns0().UDPSize() != dns.MaxMsgSize {
+			t.Fatalf("Expected only UDP size of the upstream query clamped, got %v", size)
+		}
+
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		if u.oversizedReply(reply) {
+			t.Fatalf("Expected small reply isn't oversized")
+		}
+		for i := 0; i < 10; i++ {
+			reply.Answer = append(reply.Answer, newTestRRs(t, fmt.Sprintf(`example.com. 60 IN TXT "%v"`, strings.Repeat("x", 100+i)))...)
+		}
+		if !u.oversizedReply(reply) {
+			t.Fatalf("Expected reply of %v bytes oversized", reply.Len())
+		}
+		if truncate != reply.Truncated || (truncate && reply.Len() > 512) {
+			t.Errorf("Unexpected reply  truncate: %v truncated: %v size: %v", truncate, reply.Truncated, reply.Len())
+		}
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n max_upstream_msg_size 511\n to 1.1.1.1\n}",
+		"dnsredir . {\n max_upstream_msg_size 65536\n to 1.1.1.1\n}",
+		"dnsredir . {\n max_upstream_msg_size 1232 drop\n to 1.1.1.1\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := NewReloadableUpstreams(c); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package dnsredir
+
+import (
+	"github.com/coredns/coredns/request"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultServfailTtl = 5 * time.Second
+	// Resolution failures shouldn't be cached longer than 5 minutes, see: https://tools.ietf.org/html/rfc9520#section-3.2
+	maxServfailTtl = 5 * time.Minute
+	// Maximum number of failed questions cached per upstream
+	maxServfailCache = 4096
+)
+
+type servfailKey struct {
+	name  string
+	qtype uint16
+}
+
+// A bounded cache of questions failed to resolve, see: https://tools.ietf.org/html/rfc9520
+// So a storm of queries for a broken name doesn't repeatedly exhaust the retry loop.
+type servfailCache struct {
+	ttl time.Duration
+
+	sync.Mutex
+	// Values are unused, questions are cached as long as they're unexpired
+	expires *expiringLru
+}
+
+func newServfailCache(ttl time.Duration) *servfailCache {
+	return &servfailCache{
+		ttl:     ttl,
+		expires: newExpiringLru(maxServfailCache),
+	}
+}
+
+func newServfailKey(state *request.Request) servfailKey {
+	return servfailKey{strings.ToLower(state.QName()), state.QType()}
+}
+
+// Cache the failed question, the least recently used one is evicted if the cache is full
+// nil cache caches nothing
+func (c *servfailCache) add(state *request.Request, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.expires.add(newServfailKey(state), nil, now.Add(c.ttl))
+}
+
+// Check if the question failed recently
+func (c *servfailCache) contains(state *request.Request, now time.Time) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.expires.get(newServfailKey(state), now)
+	return ok
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"strings"
 )
 
 func init() { plugin.Register(pluginName, setup) }
@@ -16,7 +17,48 @@ func setup(c *caddy.Controller) error {
 		return PluginError(err)
 	}
 
-	r := &Dnsredir{Upstreams: &ups}
+	r := &Dnsredir{
+		Upstreams:   &ups,
+		serverBlock: strings.Join(c.ServerBlockKeys, " "),
+	}
+	seen := make(StringSet)
+	for _, up := range ups {
+		if addr := up.(*reloadableUpstream).adminAddr; addr != "" && !seen.Contains(addr) {
+			seen.Add(addr)
+			r.adminAddrs = append(r.adminAddrs, addr)
+		}
+		if up.(*reloadableUpstream).loopDetect {
+			r.loopDetect = true
+		}
+		if up.(*reloadableUpstream).matchLongest {
+			r.matchLongest = true
+		}
+		// Routing happens before the upstream is known, the first upstream enabled trace wins
+		if u := up.(*reloadableUpstream); u.trace != 0 && r.trace == 0 {
+			r.trace = u.trace
+		}
+		// Ditto. Opcodes are checked before routing
+		if u := up.(*reloadableUpstream); u.opcodes != nil && r.opcodes == nil {
+			r.opcodes = u.opcodes
+			r.opcodeRcode = u.opcodeRcode
+		}
+		if u := up.(*reloadableUpstream); u.overlap != overlapIgnore && r.overlap == overlapIgnore {
+			r.overlap = u.overlap
+		}
+		if u := up.(*reloadableUpstream); u.maxConcurrent != 0 && r.maxConcurrent == 0 {
+			r.maxConcurrent = u.maxConcurrent
+			r.maxConcurrentDrop = u.maxConcurrentDrop
+		}
+		// CHAOS names are answered regardless of name lists, the first upstream configured them wins
+		for name, txt := range up.(*reloadableUpstream).chaosNames {
+			if r.chaosNames == nil {
+				r.chaosNames = make(map[string]string)
+			}
+			if _, ok := r.chaosNames[name]; !ok {
+				r.chaosNames[name] = txt
+			}
+		}
+	}
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		r.Next = next
 		return r
@@ -77,3 +77,42 @@ func TestSetupTo(t *testing.T) {
 		}
 	}
 }
+
+func TestSetupEmptyTo(t *testing.T) {
+	tests := []testCase{
+		{"dnsredir . { to \"\" \n }", true, "empty upstream address"},
+		{"dnsredir . { to 1.2.3.4 \" \" \n }", true, "empty upstream address"},
+		{"dnsredir example.com { \n }", true, "no upstream host specified for"},
+		{"dnsredir . { to 1.2.3.4 \n }", false, ""},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		_, err := newReloadableUpstream(c)
+		if !test.Pass(err) {
+			t.Errorf("Test#%v failed  %v vs err: %v", i, test, err)
+		}
+	}
+}
+
+func TestSetupTlsPolicy(t *testing.T) {
+	tests := []testCase{
+		// Negative
+		{"dnsredir . { to tls://1.1.1.1 \n tls_min_version \n }", true, "Wrong argument count"},
+		{"dnsredir . { to tls://1.1.1.1 \n tls_min_version 1.4 \n }", true, "unknown TLS version"},
+		{"dnsredir . { to tls://1.1.1.1 \n tls_ciphers \n }", true, "Wrong argument count"},
+		{"dnsredir . { to tls://1.1.1.1 \n tls_ciphers TLS_FOO_BAR \n }", true, "unknown cipher suite"},
+		// Positive
+		{"dnsredir . { to tls://1.1.1.1 \n tls_min_version 1.3 \n }", false, ""},
+		{"dnsredir . { to tls://1.1.1.1 \n tls_ciphers TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 tls_ecdhe_rsa_with_aes_128_gcm_sha256 \n }", false, ""},
+		{"dnsredir . { to tls://1.1.1.1 \n tls_min_version 1.2 \n tls_ciphers TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 \n tls \n }", false, ""},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		_, err := newReloadableUpstream(c)
+		if !test.Pass(err) {
+			t.Errorf("Test#%v failed  %v vs err: %v", i, test, err)
+		}
+	}
+}
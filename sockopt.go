@@ -0,0 +1,26 @@
+package dnsredir
+
+import (
+	"strings"
+	"syscall"
+)
+
+// Return a net.Dialer control function applying UDP socket options, nil if none configured
+func (t *Transport) udpControl() func(network, address string, c syscall.RawConn) error {
+	if t.udpSndbuf == 0 && t.udpRcvbuf == 0 {
+		return nil
+	}
+	sndbuf, rcvbuf := t.udpSndbuf, t.udpRcvbuf
+	return func(network, address string, c syscall.RawConn) error {
+		if !strings.HasPrefix(network, "udp") {
+			return nil
+		}
+		var err error
+		if e := c.Control(func(fd uintptr) {
+			err = setSockBuf(fd, sndbuf, rcvbuf)
+		}); e != nil {
+			return e
+		}
+		return err
+	}
+}
@@ -0,0 +1,19 @@
+// +build !windows
+
+package dnsredir
+
+import "syscall"
+
+func setSockBuf(fd uintptr, sndbuf, rcvbuf int) error {
+	if sndbuf != 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, sndbuf); err != nil {
+			return err
+		}
+	}
+	if rcvbuf != 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvbuf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package dnsredir
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+const srvScheme = "srv://"
+
+// Discovered hosts use classic DNS protocol, i.e. protocol specified in incoming requests
+const srvProto = "dns"
+
+// Resolve SRV names and start refreshing the host pool periodically
+// The initial resolution is synchronous, so queries can be served right after startup
+func (u *reloadableUpstream) startSrvDiscovery() {
+	if u.srvNames == nil {
+		return
+	}
+
+	u.refreshSrvHosts()
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		ticker := time.NewTicker(u.srvRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-u.stop:
+				return
+			case <-ticker.C:
+				u.refreshSrvHosts()
+			}
+		}
+	}()
+}
+
+func (u *reloadableUpstream) lookupSrv(resolver *net.Resolver, name string) ([]*net.SRV, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHcTimeout)
+	defer cancel()
+	_, addrs, err := resolver.LookupSRV(ctx, "", "", name)
+	return addrs, err
+}
+
+// Resolve SRV names and swap the host pool atomically
+// Existing hosts are kept if SRV records don't change, so their health states and connections are preserved.
+// If an SRV name fails to resolve, hosts previously discovered via it are kept.
+func (u *reloadableUpstream) refreshSrvHosts() {
+	resolver := bootstrapResolver(u.bootstrap, u.ipPref)
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	type srvKey struct {
+		addr     string
+		priority uint16
+		weight   uint16
+	}
+	old := make(map[srvKey]*UpstreamHost)
+	for _, host := range u.loadHosts() {
+		if host.srvName != "" {
+			old[srvKey{host.addr, host.priority, host.weight}] = host
+		}
+	}
+
+	pool := append(UpstreamHostPool(nil), u.hosts...)
+	kept := make(map[*UpstreamHost]struct{})
+	for _, name := range u.srvNames {
+		addrs, err := u.lookupSrv(resolver, name)
+		if err != nil {
+			log.Warningf("Failed to resolve SRV %v, keep discovered hosts  error: %v", name, err)
+			for _, host := range old {
+				if host.srvName == name {
+					pool = append(pool, host)
+					kept[host] = struct{}{}
+				}
+			}
+			continue
+		}
+
+		for _, srv := range addrs {
+			// Target "." means the service is decidedly not available, see: https://tools.ietf.org/html/rfc2782
+			if srv.Target == "." {
+				continue
+			}
+			key := srvKey{
+				addr:     net.JoinHostPort(removeTrailingDot(srv.Target), strconv.Itoa(int(srv.Port))),
+				priority: srv.Priority,
+				weight:   srv.Weight,
+			}
+			if host, ok := old[key]; ok {
+				if _, ok := kept[host]; !ok {
+					pool = append(pool, host)
+					kept[host] = struct{}{}
+				}
+				continue
+			}
+
+			host := &UpstreamHost{
+				proto:    srvProto,
+				addr:     key.addr,
+				downFunc: checkDownFunc(u),
+				srvName:  name,
+				priority: key.priority,
+				weight:   key.weight,
+			}
+			if err := u.initHost(host); err != nil {
+				log.Warningf("Failed to initialize host %v discovered via SRV %v  error: %v", key.addr, name, err)
+				continue
+			}
+			host.startTransport()
+			// Prevent duplicated SRV records
+			old[key] = host
+			kept[host] = struct{}{}
+			pool = append(pool, host)
+			log.Infof("Upstream %v discovered via SRV %v  priority: %v weight: %v", host.Name(), name, key.priority, key.weight)
+		}
+	}
+
+	u.pool.Store(pool)
+
+	// In-flight queries may still use removed hosts, stop their transports once all queries timed out
+	retired := u.srvRetired[:0]
+	for _, r := range u.srvRetired {
+		if time.Since(r.at) >= defaultTimeout {
+			r.host.stopTransport()
+		} else {
+			retired = append(retired, r)
+		}
+	}
+	for _, host := range old {
+		if _, ok := kept[host]; !ok {
+			log.Infof("Upstream %v removed from SRV %v", host.Name(), host.srvName)
+			retired = append(retired, retiredHost{host: host, at: time.Now()})
+		}
+	}
+	u.srvRetired = retired
+}
+
+type retiredHost struct {
+	host *UpstreamHost
+	at   time.Time
+}
+
+// Stop transports of all retired hosts, SRV discovery should be stopped already
+func (u *reloadableUpstream) stopSrvRetired() {
+	for _, r := range u.srvRetired {
+		r.host.stopTransport()
+	}
+	u.srvRetired = nil
+}
@@ -0,0 +1,146 @@
+package dnsredir
+
+import (
+	"fmt"
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"testing"
+)
+
+// A local DNS server serving SRV records
+type testSrvServer struct {
+	sync.Mutex
+	records []string
+}
+
+func (s *testSrvServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	s.Lock()
+	for _, r := range s.records {
+		rr, _ := dns.NewRR(r)
+		m.Answer = append(m.Answer, rr)
+	}
+	s.Unlock()
+	_ = w.WriteMsg(m)
+}
+
+func (s *testSrvServer) set(records ...string) {
+	s.Lock()
+	s.records = records
+	s.Unlock()
+}
+
+func TestSrvDiscovery(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() failed: %v", err)
+	}
+	handler := &testSrvServer{}
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go func() { _ = server.ActivateAndServe() }()
+	defer func() { _ = server.Shutdown() }()
+
+	const name = "_dns._udp.resolvers.example."
+	handler.set(
+		name+" 30 IN SRV 10 60 53 ns1.resolvers.example.",
+		name+" 30 IN SRV 10 20 5353 ns2.resolvers.example.",
+		name+" 30 IN SRV 20 0 53 ns3.resolvers.example.",
+	)
+
+	input := fmt.Sprintf(`dnsredir . {
+	to srv://%v
+	bootstrap %v
+}`, name, pc.LocalAddr())
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+	u := up.(*reloadableUpstream)
+	u.checkInterval = 0
+	u.HealthCheck.Start()
+	u.startSrvDiscovery()
+	defer func() {
+		u.HealthCheck.Stop()
+		u.stopSrvRetired()
+	}()
+
+	hosts := u.loadHosts()
+	if len(hosts) != 3 {
+		t.Fatalf("Expected 3 hosts discovered, got %v", hosts)
+	}
+	byAddr := make(map[string]*UpstreamHost)
+	for _, host := range hosts {
+		byAddr[host.addr] = host
+	}
+	if h := byAddr["ns2.resolvers.example:5353"]; h == nil || h.priority != 10 || h.weight != 20 || h.proto != srvProto {
+		t.Fatalf("Unexpected discovered host %v", h)
+	}
+
+	// Only hosts of the lowest priority tier should be selected
+	for i := 0; i < 100; i++ {
+		if h := u.Select(); h.priority != 10 {
+			t.Fatalf("Host %v of lower priority tier selected", h.Name())
+		}
+	}
+	for _, host := range hosts {
+		if host.priority == 10 {
+			host.fails = defaultMaxFails
+		}
+	}
+	if h := u.Select(); h == nil || h.addr != "ns3.resolvers.example:53" {
+		t.Fatalf("Expected fail over to next priority tier, got %v", h)
+	}
+
+	handler.set(
+		name+" 30 IN SRV 10 60 53 ns1.resolvers.example.",
+		name+" 30 IN SRV 10 20 53 ns4.resolvers.example.",
+		// Service not available at the target, should be skipped
+		name+" 30 IN SRV 30 0 0 .",
+	)
+	u.refreshSrvHosts()
+	hosts = u.loadHosts()
+	if len(hosts) != 2 {
+		t.Fatalf("Expected 2 hosts after refresh, got %v", hosts)
+	}
+	for _, host := range hosts {
+		if host.addr == "ns1.resolvers.example:53" && host != byAddr[host.addr] {
+			t.Errorf("Host of unchanged SRV record should be kept")
+		}
+	}
+	if len(u.srvRetired) != 2 {
+		t.Errorf("Expected 2 retired hosts, got %v", len(u.srvRetired))
+	}
+
+	// Keep discovered hosts if SRV name fails to resolve
+	_ = server.Shutdown()
+	u.refreshSrvHosts()
+	if len(u.loadHosts()) != 2 {
+		t.Fatalf("Discovered hosts should be kept, got %v", u.loadHosts())
+	}
+}
+
+func TestWeightedSelect(t *testing.T) {
+	a := &UpstreamHost{addr: "a", weight: 3}
+	b := &UpstreamHost{addr: "b", weight: 1}
+	z := &UpstreamHost{addr: "z", weight: 0}
+	pool := UpstreamHostPool{a, b, z}
+
+	counts := make(map[*UpstreamHost]int)
+	for i := 0; i < 4000; i++ {
+		counts[weightedSelect(pool, nil)]++
+	}
+	if counts[z] != 0 {
+		t.Errorf("Zero weight host shouldn't be selected with nonzero weight hosts")
+	}
+	if counts[a] < 2700 || counts[a] > 3300 {
+		t.Errorf("Expected about 3000 selections of weight 3 host, got %v", counts[a])
+	}
+
+	if weightedSelect(UpstreamHostPool{z}, nil) != nil {
+		t.Errorf("nil should be returned if total weight is zero")
+	}
+}
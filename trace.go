@@ -0,0 +1,130 @@
+package dnsredir
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Trace every query, traces are logged only
+	traceAll = iota + 1
+	// Trace queries carrying the trace option only, traces are logged and replied as TXT records
+	traceEdns
+)
+
+var traceModes = map[string]int{
+	"all":  traceAll,
+	"edns": traceEdns,
+}
+
+// EDNS0 local option requesting a per-query trace, see: https://tools.ietf.org/html/rfc6891#section-9
+const traceOption = 65301
+
+// Sequence of trace correlation IDs, starts at random thus IDs of different CoreDNS processes hardly collide
+var traceSeq = func() uint64 {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("rand.Read() failed, error: %v", err))
+	}
+	return binary.BigEndian.Uint64(b)
+}()
+
+// Selection and exchange decisions made for a single query, in order
+// nil trace traces nothing, thus tracing costs nothing unless enabled.
+type queryTrace struct {
+	id    string
+	start time.Time
+	steps []string
+	// Reply the trace as TXT records in the additional section
+	reply bool
+}
+
+func hasTraceOption(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == traceOption {
+			return true
+		}
+	}
+	return false
+}
+
+// Return trace of the request, nil if it's not traced
+func (r *Dnsredir) newTrace(state *request.Request) *queryTrace {
+	switch r.trace {
+	case traceAll:
+	case traceEdns:
+		if !hasTraceOption(state.Req) {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return &queryTrace{
+		id:    fmt.Sprintf("%016x", atomic.AddUint64(&traceSeq, 1)),
+		start: time.Now(),
+		reply: r.trace == traceEdns,
+	}
+}
+
+func (t *queryTrace) addf(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	step := fmt.Sprintf(format, args...)
+	t.steps = append(t.steps, fmt.Sprintf("+%v %v", time.Since(t.start).Round(time.Microsecond), step))
+}
+
+// Log the trace, rcode and err are the result returned by ServeDNS(), written is true if a reply was written
+func (t *queryTrace) finish(state *request.Request, rcode int, err error, written bool) {
+	if t == nil {
+		return
+	}
+	if !written {
+		t.addf("rcode: %v err: %v", dns.RcodeToString[rcode], err)
+	}
+	log.Infof("Trace %v  qname: %v qtype: %v client: %v\n\t%v",
+		t.id, state.QName(), state.Type(), state.RemoteAddr(), strings.Join(t.steps, "\n\t"))
+}
+
+// Append the trace to the reply as TXT records, one record per step
+func (t *queryTrace) appendTo(m *dns.Msg) {
+	hdr := dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS}
+	m.Extra = append(m.Extra, &dns.TXT{Hdr: hdr, Txt: []string{"id: " + t.id}})
+	for _, step := range t.steps {
+		// A character string is up to 255 bytes, see: https://tools.ietf.org/html/rfc1035#section-3.3
+		var txt []string
+		for len(step) > 255 {
+			txt = append(txt, step[:255])
+			step = step[255:]
+		}
+		m.Extra = append(m.Extra, &dns.TXT{Hdr: hdr, Txt: append(txt, step)})
+	}
+}
+
+// A ResponseWriter finishing the trace with the reply written
+type traceWriter struct {
+	dns.ResponseWriter
+	trace   *queryTrace
+	written bool
+}
+
+func (w *traceWriter) WriteMsg(m *dns.Msg) error {
+	w.written = true
+	w.trace.addf("rcode: %v answers: %v truncated: %v", dns.RcodeToString[m.Rcode], len(m.Answer), m.Truncated)
+	if w.trace.reply && len(m.Question) != 0 {
+		// The reply may be still referenced, e.g. by prefetch_alternate
+		m = m.Copy()
+		w.trace.appendTo(m)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,358 @@
+package dnsredir
+
+import (
+	"bytes"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+)
+
+// ResponseTransform modifies replies from upstream hosts before they're written to the client
+// Transforms of an upstream form an ordered pipeline, in the order their directives are specified.
+type ResponseTransform interface {
+	// Name of the transform, which is unique in a pipeline
+	Name() string
+	// Transform the reply in place, state is the client's request
+	Transform(state *request.Request, reply *dns.Msg)
+}
+
+// Add the transform to the pipeline, a transform with the same name will be replaced in place
+func (u *reloadableUpstream) setTransform(t ResponseTransform) {
+	for i, t0 := range u.transforms {
+		if t0.Name() == t.Name() {
+			u.transforms[i] = t
+			return
+		}
+	}
+	u.transforms = append(u.transforms, t)
+}
+
+// Apply per-upstream transforms to the reply before writing it to the client
+func (u *reloadableUpstream) transformReply(state *request.Request, reply *dns.Msg) {
+	for _, t := range u.transforms {
+		t.Transform(state, reply)
+	}
+}
+
+// Force TTL of answer and authority records
+type forceTTLTransform struct {
+	ttl uint32
+}
+
+func (t *forceTTLTransform) Name() string { return "force_ttl" }
+
+func (t *forceTTLTransform) Transform(_ *request.Request, reply *dns.Msg) {
+	rewriteTTLs(reply, func(dns.RR) uint32 { return t.ttl })
+}
+
+// Set TTL of answer and authority records with zero TTL, non-zero TTLs are left intact
+type defaultTTLTransform struct {
+	ttl uint32
+}
+
+func (t *defaultTTLTransform) Name() string { return "default_ttl" }
+
+func (t *defaultTTLTransform) Transform(_ *request.Request, reply *dns.Msg) {
+	rewriteTTLs(reply, func(rr dns.RR) uint32 {
+		if ttl := rr.Header().Ttl; ttl != 0 {
+			return ttl
+		}
+		return t.ttl
+	})
+}
+
+// Inclusive TTL bounds
+type ttlRange struct {
+	min, max uint32
+}
+
+func (r ttlRange) clamp(ttl uint32) uint32 {
+	if ttl < r.min {
+		return r.min
+	}
+	if ttl > r.max {
+		return r.max
+	}
+	return ttl
+}
+
+// TTL bounds keyed by record type, signatures are bounded as the records they cover
+type ttlPolicy map[uint16]ttlRange
+
+func (p ttlPolicy) ttl(rr dns.RR) uint32 {
+	rrtype := rr.Header().Rrtype
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		// Keep TTL of signatures consistent with the RRset
+		rrtype = sig.TypeCovered
+	}
+	if r, ok := p[rrtype]; ok {
+		return r.clamp(rr.Header().Ttl)
+	}
+	return rr.Header().Ttl
+}
+
+// Clamp TTL of answer and authority records per record type, records of other types are left intact
+type ttlOverrideTransform struct {
+	policy ttlPolicy
+}
+
+func (t *ttlOverrideTransform) Name() string { return "ttl_override" }
+
+func (t *ttlOverrideTransform) Transform(_ *request.Request, reply *dns.Msg) {
+	rewriteTTLs(reply, t.policy.ttl)
+}
+
+// Strip answer records of given types, a reply left with no answer of the queried type becomes NODATA
+type filterTypeTransform struct {
+	qtypes map[uint16]struct{}
+}
+
+func (t *filterTypeTransform) Name() string { return "filter_type" }
+
+func (t *filterTypeTransform) filtered(rr dns.RR) bool {
+	qtype := rr.Header().Rrtype
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		// Signatures of filtered records are useless
+		qtype = sig.TypeCovered
+	}
+	_, ok := t.qtypes[qtype]
+	return ok
+}
+
+func (t *filterTypeTransform) Transform(state *request.Request, reply *dns.Msg) {
+	var removed dns.RR
+	answer := reply.Answer[:0]
+	for _, rr := range reply.Answer {
+		if !t.filtered(rr) {
+			answer = append(answer, rr)
+		} else if removed == nil {
+			removed = rr
+		}
+	}
+	reply.Answer = answer
+	if removed == nil || reply.Rcode != dns.RcodeSuccess {
+		return
+	}
+
+	for _, rr := range reply.Answer {
+		if qtype := state.QType(); rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+			return
+		}
+	}
+	// A proper NODATA needs an SOA in authority section for negative caching, see: https://tools.ietf.org/html/rfc2308#section-2.2
+	for _, rr := range reply.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return
+		}
+	}
+	// Clients cache the NODATA as long as they would cache the filtered records
+	ttl := removed.Header().Ttl
+	reply.Ns = append(reply.Ns, &dns.SOA{
+		Hdr:     dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      filterSoaNs,
+		Mbox:    filterSoaMbox,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	})
+}
+
+// Names of synthesized SOA records, which are under the reserved `invalid.' TLD, see: https://tools.ietf.org/html/rfc2606#section-2
+const (
+	filterSoaNs   = "ns.dnsredir.invalid."
+	filterSoaMbox = "hostmaster.dnsredir.invalid."
+)
+
+// Return true if the reply is negative, i.e. NXDOMAIN or NODATA, see: https://tools.ietf.org/html/rfc2308#section-2
+func isNegativeReply(state *request.Request, reply *dns.Msg) bool {
+	switch reply.Rcode {
+	case dns.RcodeNameError:
+		return true
+	case dns.RcodeSuccess:
+		qtype := state.QType()
+		for _, rr := range reply.Answer {
+			if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Return TTL of the negative reply derived from SOA in authority section, false if no SOA found
+// It's the minimum of SOA TTL and SOA MINIMUM field, see: https://tools.ietf.org/html/rfc2308#section-5
+func negativeTTL(reply *dns.Msg) (uint32, bool) {
+	for _, rr := range reply.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl, true
+			}
+			return soa.Hdr.Ttl, true
+		}
+	}
+	return 0, false
+}
+
+// Cap TTL of negative replies, so downstream caches won't cache NXDOMAIN or NODATA too long
+// SOA TTL is lowered to the capped negative TTL, thus resolvers deriving it per RFC 2308 see the same value.
+// SOA MINIMUM field is left intact.
+type negTTLMaxTransform struct {
+	ttl uint32
+}
+
+func (t *negTTLMaxTransform) Name() string { return "neg_ttl_max" }
+
+func (t *negTTLMaxTransform) Transform(state *request.Request, reply *dns.Msg) {
+	if !isNegativeReply(state, reply) {
+		return
+	}
+	ttl, ok := negativeTTL(reply)
+	if !ok {
+		return
+	}
+	if ttl > t.ttl {
+		ttl = t.ttl
+	}
+	for _, rr := range reply.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Hdr.Ttl = ttl
+		}
+	}
+}
+
+// Shrink UDP replies exceeding the client's buffer size, by dropping Additional records(except OPT) first
+// Omitted Additional records don't set TC bit, thus clients won't fall back to TCP unnecessarily,
+//	see: https://tools.ietf.org/html/rfc2181#section-9
+// If it still doesn't fit, the reply is truncated with TC bit set.
+type shrinkAdditionalTransform struct{}
+
+func (t *shrinkAdditionalTransform) Name() string { return "shrink_additional" }
+
+func (t *shrinkAdditionalTransform) Transform(state *request.Request, reply *dns.Msg) {
+	if state.Proto() != "udp" {
+		return
+	}
+	size := state.Size()
+	reply.Compress = true
+	if reply.Len() <= size {
+		return
+	}
+
+	// Drop from the end, glue records of the first name servers are kept as many as possible
+	for i := len(reply.Extra) - 1; i >= 0 && reply.Len() > size; i-- {
+		if reply.Extra[i].Header().Rrtype != dns.TypeOPT {
+			reply.Extra = append(reply.Extra[:i], reply.Extra[i+1:]...)
+		}
+	}
+	if reply.Len() > size {
+		reply.Truncate(size)
+	}
+}
+
+// Sort answer records within each group of consecutive records of the same owner name, type and class(i.e. RRset),
+//	so replies are deterministic, e.g. for byte-stable golden files. CNAME chain order is left intact.
+type sortAnswersTransform struct{}
+
+func (t *sortAnswersTransform) Name() string { return "sort_answers" }
+
+// Check if two records belong to the same group, see: sortAnswersTransform
+func sameRRset(a, b dns.RR) bool {
+	ha, hb := a.Header(), b.Header()
+	return ha.Rrtype == hb.Rrtype && ha.Class == hb.Class && strings.EqualFold(ha.Name, hb.Name)
+}
+
+// A and AAAA records are ordered by IP address, others by RDATA in presentation format
+func lessRdata(a, b dns.RR) bool {
+	switch a := a.(type) {
+	case *dns.A:
+		return bytes.Compare(a.A.To16(), b.(*dns.A).A.To16()) < 0
+	case *dns.AAAA:
+		return bytes.Compare(a.AAAA.To16(), b.(*dns.AAAA).AAAA.To16()) < 0
+	}
+	return rdataString(a) < rdataString(b)
+}
+
+func rdataString(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+func (t *sortAnswersTransform) Transform(_ *request.Request, reply *dns.Msg) {
+	answer := reply.Answer
+	for i := 0; i < len(answer); {
+		j := i + 1
+		for j < len(answer) && sameRRset(answer[i], answer[j]) {
+			j++
+		}
+		group := answer[i:j]
+		sort.SliceStable(group, func(x, y int) bool {
+			return lessRdata(group[x], group[y])
+		})
+		i = j
+	}
+}
+
+// Cap number of answer records of UDP replies, TC bit is set if any record trimmed so the client may retry over TCP
+//	for the full set. TCP replies are left intact, otherwise the client has no way to get the full set.
+type maxAnswersTransform struct {
+	max int
+}
+
+func (t *maxAnswersTransform) Name() string { return "max_answers" }
+
+func (t *maxAnswersTransform) Transform(state *request.Request, reply *dns.Msg) {
+	if state.Proto() != "udp" || len(reply.Answer) <= t.max {
+		return
+	}
+	reply.Answer = reply.Answer[:t.max]
+	reply.Truncated = true
+}
+
+// Order address records of answer and additional sections, records of the preferred type go first
+// Only slots of address records are reordered stably, thus other records(e.g. a CNAME chain) are left in place.
+type orderTransform struct {
+	first uint16 // Either dns.TypeA or dns.TypeAAAA
+}
+
+func (t *orderTransform) Name() string { return "order" }
+
+func (t *orderTransform) Transform(state *request.Request, reply *dns.Msg) {
+	t.reorder(reply.Answer)
+	t.reorder(reply.Extra)
+}
+
+func (t *orderTransform) reorder(rrs []dns.RR) {
+	var slots []int
+	var first, second []dns.RR
+	for i, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case t.first:
+			first = append(first, rr)
+		case dns.TypeA, dns.TypeAAAA:
+			second = append(second, rr)
+		default:
+			continue
+		}
+		slots = append(slots, i)
+	}
+	if len(first) == 0 || len(second) == 0 {
+		return
+	}
+	for i, rr := range append(first, second...) {
+		rrs[slots[i]] = rr
+	}
+}
+
+// Negotiate EDNS0 TCP Keepalive with the client
+type tcpKeepaliveTransform struct {
+	timeout uint16 // In units of 100 milliseconds
+}
+
+func (t *tcpKeepaliveTransform) Name() string { return "tcp_keepalive" }
+
+func (t *tcpKeepaliveTransform) Transform(state *request.Request, reply *dns.Msg) {
+	setTcpKeepalive(state, reply, t.timeout)
+}
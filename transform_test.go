@@ -0,0 +1,376 @@
+package dnsredir
+
+import (
+	"fmt"
+	"github.com/coredns/caddy"
+	coretest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+)
+
+func TestTransformPipeline(t *testing.T) {
+	input := `dnsredir . {
+	force_ttl 10
+	tcp_keepalive 1s
+	force_ttl 20
+	to 1.2.3.4
+}`
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+	u := up.(*reloadableUpstream)
+
+	var names []string
+	for _, t := range u.transforms {
+		names = append(names, t.Name())
+	}
+	if len(names) != 2 || names[0] != "force_ttl" || names[1] != "tcp_keepalive" {
+		t.Fatalf("Unexpected transforms %v", names)
+	}
+
+	reply := new(dns.Msg)
+	reply.Answer = newTestRRs(t, "example.com. 300 IN A 192.0.2.1")
+	u.transforms[0].Transform(nil, reply)
+	if ttl := reply.Answer[0].Header().Ttl; ttl != 20 {
+		t.Fatalf("Later force_ttl should replace the former one, got TTL %v", ttl)
+	}
+}
+
+func TestFilterType(t *testing.T) {
+	u := &reloadableUpstream{}
+	u.setTransform(&filterTypeTransform{qtypes: map[uint16]struct{}{dns.TypeAAAA: {}}})
+
+	tests := []struct {
+		qname   string
+		qtype   uint16
+		answer  []string
+		ns      []string
+		answers int
+		soa     string // Expected SOA owner, empty if no SOA expected
+	}{
+		{"example.com.", dns.TypeA, []string{"example.com. 60 IN A 192.0.2.1"}, nil, 1, ""},
+		{"example.com.", dns.TypeAAAA, []string{
+			"example.com. 300 IN AAAA 2001:db8::1",
+			"example.com. 300 IN RRSIG AAAA 8 2 300 20300101000000 20200101000000 1 example.com. AAAA",
+		}, nil, 0, "example.com."},
+		// NODATA after CNAME
+		{"www.example.com.", dns.TypeAAAA, []string{
+			"www.example.com. 60 IN CNAME example.com.",
+			"example.com. 300 IN AAAA 2001:db8::1",
+		}, nil, 1, "www.example.com."},
+		{"example.com.", dns.TypeAAAA, []string{"example.com. 300 IN AAAA 2001:db8::1"}, []string{
+			"com. 900 IN SOA a.gtld-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400",
+		}, 0, "com."},
+		{"example.com.", dns.TypeANY, []string{
+			"example.com. 60 IN A 192.0.2.1",
+			"example.com. 300 IN AAAA 2001:db8::1",
+		}, nil, 1, ""},
+		// NODATA from upstream is left intact
+		{"example.com.", dns.TypeAAAA, nil, nil, 0, ""},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.qname, test.qtype)
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		reply.Answer = newTestRRs(t, test.answer...)
+		reply.Ns = newTestRRs(t, test.ns...)
+		u.transformReply(&request.Request{Req: req}, reply)
+
+		if len(reply.Answer) != test.answers {
+			t.Errorf("Test#%v failed  expected %v answers, got %v", i, test.answers, reply.Answer)
+		}
+		var soa *dns.SOA
+		for _, rr := range reply.Ns {
+			if rr, ok := rr.(*dns.SOA); ok {
+				soa = rr
+			}
+		}
+		if (soa == nil) != (test.soa == "") || (soa != nil && soa.Hdr.Name != test.soa) {
+			t.Errorf("Test#%v failed  expected SOA %q, got %v", i, test.soa, reply.Ns)
+			continue
+		}
+		if soa != nil && soa.Hdr.Name == test.qname && (soa.Hdr.Ttl != 300 || soa.Minttl != 300) {
+			t.Errorf("Test#%v failed  expected synthesized SOA TTL of the stripped records, got %v", i, soa)
+		}
+	}
+}
+
+func TestShrinkAdditional(t *testing.T) {
+	u := &reloadableUpstream{}
+	u.setTransform(&shrinkAdditionalTransform{})
+
+	newReply := func(req *dns.Msg, answers, extras int) *dns.Msg {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		for i := 0; i < answers; i++ {
+			reply.Answer = append(reply.Answer, newTestRRs(t, fmt.Sprintf("example.com. 60 IN A 192.0.2.%v", i))...)
+		}
+		for i := 0; i < extras; i++ {
+			reply.Extra = append(reply.Extra, newTestRRs(t, fmt.Sprintf("ns%v.example.net. 60 IN AAAA 2001:db8::%v", i, i))...)
+		}
+		if opt := req.IsEdns0(); opt != nil {
+			reply.SetEdns0(opt.UDPSize(), false)
+		}
+		return reply
+	}
+
+	tests := []struct {
+		tcp       bool
+		edns      uint16 // Zero if no EDNS0
+		answers   int
+		extras    int
+		truncated bool
+	}{
+		{false, 0, 1, 2, false},
+		{false, 0, 10, 30, false},
+		{false, 1232, 10, 60, false},
+		{false, 0, 40, 0, true},
+		{true, 0, 10, 30, false},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if test.edns != 0 {
+			req.SetEdns0(test.edns, false)
+		}
+		state := &request.Request{W: &coretest.ResponseWriter{TCP: test.tcp}, Req: req}
+		reply := newReply(req, test.answers, test.extras)
+		size := reply.Len()
+		u.transformReply(state, reply)
+
+		if test.tcp {
+			if reply.Len() != size {
+				t.Errorf("Test#%v failed  TCP reply shouldn't be shrunk", i)
+			}
+			continue
+		}
+		if reply.Len() > state.Size() {
+			t.Errorf("Test#%v failed  reply size %v exceeds %v", i, reply.Len(), state.Size())
+		}
+		if reply.Truncated != test.truncated {
+			t.Errorf("Test#%v failed  truncated: %v vs %v", i, reply.Truncated, test.truncated)
+		}
+		if !test.truncated && len(reply.Answer) != test.answers {
+			t.Errorf("Test#%v failed  expected %v answers kept, got %v", i, test.answers, len(reply.Answer))
+		}
+		if (test.edns != 0) != (reply.IsEdns0() != nil) {
+			t.Errorf("Test#%v failed  OPT record should be kept", i)
+		}
+	}
+}
+
+func TestNegTTLMax(t *testing.T) {
+	u := &reloadableUpstream{}
+	u.setTransform(&negTTLMaxTransform{ttl: 600})
+
+	tests := []struct {
+		rcode  int
+		answer []string
+		soa    string // Empty if no SOA
+		ttl    uint32 // Expected SOA TTL
+	}{
+		// SOA TTL is smaller
+		{dns.RcodeNameError, nil, "example.com. 60 IN SOA ns. host. 1 2 3 4 300", 60},
+		// SOA MINIMUM is smaller
+		{dns.RcodeNameError, nil, "example.com. 3600 IN SOA ns. host. 1 2 3 4 300", 300},
+		// Both exceed the cap
+		{dns.RcodeNameError, nil, "example.com. 86400 IN SOA ns. host. 1 2 3 4 7200", 600},
+		{dns.RcodeNameError, nil, "example.com. 0 IN SOA ns. host. 1 2 3 4 7200", 0},
+		// NODATA with CNAME chain
+		{dns.RcodeSuccess, []string{"www.example.com. 60 IN CNAME example.com."}, "example.com. 3600 IN SOA ns. host. 1 2 3 4 3600", 600},
+		// Positive answers left intact
+		{dns.RcodeSuccess, []string{"www.example.com. 60 IN A 192.0.2.1"}, "example.com. 3600 IN SOA ns. host. 1 2 3 4 3600", 3600},
+		// Non-negative RCODE left intact
+		{dns.RcodeServerFailure, nil, "example.com. 3600 IN SOA ns. host. 1 2 3 4 3600", 3600},
+		{dns.RcodeNameError, nil, "", 0},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		state := &request.Request{Req: req}
+		reply := new(dns.Msg)
+		reply.SetRcode(req, test.rcode)
+		reply.Answer = newTestRRs(t, test.answer...)
+		if test.soa != "" {
+			reply.Ns = newTestRRs(t, test.soa)
+		}
+		u.transformReply(state, reply)
+
+		if test.soa == "" {
+			if len(reply.Ns) != 0 {
+				t.Errorf("Test#%v failed  unexpected authority %v", i, reply.Ns)
+			}
+			continue
+		}
+		soa := reply.Ns[0].(*dns.SOA)
+		if soa.Hdr.Ttl != test.ttl {
+			t.Errorf("Test#%v failed  SOA TTL %v vs %v", i, soa.Hdr.Ttl, test.ttl)
+		}
+		if ttl, _ := negativeTTL(reply); isNegativeReply(state, reply) && ttl != test.ttl {
+			t.Errorf("Test#%v failed  negative TTL %v vs %v", i, ttl, test.ttl)
+		}
+	}
+}
+
+func TestTTLOverride(t *testing.T) {
+	input := `dnsredir . {
+	ttl_override NS 3600 86400
+	ttl_override a 0 300
+	ttl_override A 60 300
+	to 1.1.1.1
+}`
+	c := caddy.NewTestController("dns", input)
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, input: %q error: %v", input, err)
+	}
+	u := up.(*reloadableUpstream)
+	if len(u.transforms) != 1 {
+		t.Fatalf("Expected a single merged transform, got %v", u.transforms)
+	}
+
+	reply := new(dns.Msg)
+	reply.Answer = newTestRRs(t,
+		"example.com. 30 IN A 192.0.2.1",
+		"example.com. 30 IN RRSIG A 8 2 30 20300101000000 20200101000000 12345 example.com. AAAA",
+		"example.net. 3600 IN A 192.0.2.2",
+		"example.org. 30 IN AAAA 2001:db8::1",
+	)
+	reply.Ns = newTestRRs(t, "example.com. 60 IN NS ns.example.com.")
+	u.transformReply(&request.Request{}, reply)
+
+	for i, ttl := range []uint32{60, 60, 300, 30} {
+		if reply.Answer[i].Header().Ttl != ttl {
+			t.Errorf("Answer#%v TTL %v vs %v", i, reply.Answer[i].Header().Ttl, ttl)
+		}
+	}
+	if reply.Ns[0].Header().Ttl != 3600 {
+		t.Errorf("Expected NS TTL 3600, got %v", reply.Ns[0].Header().Ttl)
+	}
+
+	for _, input := range []string{
+		"dnsredir . {\n ttl_override A 300 60\n to 1.1.1.1\n}",
+		"dnsredir . {\n ttl_override BOGUS 0 60\n to 1.1.1.1\n}",
+		"dnsredir . {\n ttl_override A 60\n to 1.1.1.1\n}",
+		"dnsredir . {\n ttl_override A -1 60\n to 1.1.1.1\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := newReloadableUpstream(c); err == nil {
+			t.Errorf("Expected error for input %q", input)
+		}
+	}
+}
+
+func TestSortAnswers(t *testing.T) {
+	reply := new(dns.Msg)
+	reply.SetQuestion("www.example.com.", dns.TypeA)
+	reply.Answer = newTestRRs(t,
+		"www.example.com. 60 IN CNAME cdn.example.net.",
+		"cdn.example.net. 60 IN CNAME edge.example.org.",
+		"edge.example.org. 60 IN A 192.0.2.10",
+		"edge.example.org. 60 IN A 192.0.2.9",
+		"edge.example.org. 60 IN A 10.0.0.1",
+		"foo.example.org. 60 IN TXT \"b\"",
+		"foo.example.org. 60 IN TXT \"a\"",
+	)
+	expected := newTestRRs(t,
+		"www.example.com. 60 IN CNAME cdn.example.net.",
+		"cdn.example.net. 60 IN CNAME edge.example.org.",
+		"edge.example.org. 60 IN A 10.0.0.1",
+		"edge.example.org. 60 IN A 192.0.2.9",
+		"edge.example.org. 60 IN A 192.0.2.10",
+		"foo.example.org. 60 IN TXT \"a\"",
+		"foo.example.org. 60 IN TXT \"b\"",
+	)
+	(&sortAnswersTransform{}).Transform(nil, reply)
+	for i, rr := range reply.Answer {
+		if rr.String() != expected[i].String() {
+			t.Errorf("Answer#%v expected %v, got %v", i, expected[i], rr)
+		}
+	}
+}
+
+func TestMaxAnswers(t *testing.T) {
+	r := newTestDnsredir(t, "dnsredir . {\n max_answers 2 \n to 1.2.3.4 \n}")
+	u := (*r.Upstreams)[0].(*reloadableUpstream)
+
+	tests := []struct {
+		tcp       bool
+		answers   int
+		expected  int
+		truncated bool
+	}{
+		{false, 1, 1, false},
+		{false, 2, 2, false},
+		{false, 5, 2, true},
+		{true, 5, 5, false},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		state := &request.Request{W: &coretest.ResponseWriter{TCP: test.tcp}, Req: req}
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		for j := 0; j < test.answers; j++ {
+			reply.Answer = append(reply.Answer, newTestRRs(t, fmt.Sprintf("example.com. 60 IN A 192.0.2.%v", j))...)
+		}
+		u.transformReply(state, reply)
+
+		if len(reply.Answer) != test.expected {
+			t.Errorf("Test#%v failed  expected %v answers, got %v", i, test.expected, len(reply.Answer))
+		}
+		if reply.Truncated != test.truncated {
+			t.Errorf("Test#%v failed  truncated: %v vs %v", i, reply.Truncated, test.truncated)
+		}
+		if len(reply.Answer) != 0 && reply.Answer[0].(*dns.A).A.String() != "192.0.2.0" {
+			t.Errorf("Test#%v failed  leading answers should be kept, got %v", i, reply.Answer[0])
+		}
+	}
+}
+
+func TestOrder(t *testing.T) {
+	rrs := []string{
+		"www.example.com. 60 IN CNAME example.com.",
+		"example.com. 60 IN AAAA 2001:db8::1",
+		"example.com. 60 IN A 192.0.2.1",
+		"example.com. 60 IN AAAA 2001:db8::2",
+		"example.com. 60 IN A 192.0.2.2",
+	}
+	tests := []struct {
+		order    string
+		expected []string
+	}{
+		{"a_first", []string{"CNAME", "192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"}},
+		{"aaaa_first", []string{"CNAME", "2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"}},
+	}
+	for i, test := range tests {
+		r := newTestDnsredir(t, fmt.Sprintf("dnsredir . {\n order %v \n to 1.2.3.4 \n}", test.order))
+		u := (*r.Upstreams)[0].(*reloadableUpstream)
+		reply := new(dns.Msg)
+		reply.Answer = newTestRRs(t, rrs...)
+		reply.Extra = newTestRRs(t, rrs[1:]...)
+		u.transformReply(nil, reply)
+
+		for _, section := range [][]dns.RR{reply.Answer, reply.Extra} {
+			expected := test.expected
+			if len(section) != len(expected) {
+				expected = expected[1:]
+			}
+			for j, rr := range section {
+				if !strings.Contains(rr.String(), expected[j]) {
+					t.Errorf("Test#%v failed  record#%v expected %v, got %v", i, j, expected[j], rr)
+				}
+			}
+		}
+	}
+
+	c := caddy.NewTestController("dns", "dnsredir . {\n order mx_first \n to 1.2.3.4 \n}")
+	if _, err := newReloadableUpstream(c); err == nil {
+		t.Errorf("Expected error for unknown order")
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/coredns/coredns/plugin"
 	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
 	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 	"net"
 	"os"
@@ -23,6 +24,8 @@ import (
 )
 
 type reloadableUpstream struct {
+	// FROM... as specified in Corefile
+	from []string
 	// Flag indicate match any request, i.e. the root zone "."
 	matchAny bool
 	*NameList
@@ -33,40 +36,319 @@ type reloadableUpstream struct {
 	bootstrap []string
 	ipset     interface{}
 	pf        interface{}
-	noIPv6    bool
+	ipPref    ipPreference
+	// Replies with these IPs or RCODEs are considered failures, e.g. captive portal
+	unhealthyIPs    StringSet
+	unhealthyRcodes map[int]struct{}
+	maxCnameDepth   int
+	// Suffix appended to single-label queries, in FQDN form, e.g. "corp.example."
+	appendSuffix string
+	// Admin HTTP endpoint address, empty if disabled
+	adminAddr string
+	// Action taken on overlapping names across upstreams of the plugin instance, see: Dnsredir.overlap
+	overlap int
+	// Maximum in-flight upstream exchanges of the plugin instance, zero if unlimited, see: Dnsredir.maxConcurrent
+	maxConcurrent     int32
+	maxConcurrentDrop bool
+	// Questions failed to resolve recently, nil if disabled
+	servfailCache *servfailCache
+	// Answers cached for at least cache_min_ttl, nil if disabled
+	answerCache *answerCache
+	// Per-client rate limiter of requests forwarded to this upstream, nil if unlimited
+	rateLimit         *rateLimiter
+	rateLimitResponse int
+	// Fault injection for testing, nil if disabled
+	chaos *chaos
+	// Allowed opcodes, nil if any opcode is allowed
+	opcodes     map[int]struct{}
+	opcodeRcode int
+	// RCODE replied to zone transfer(AXFR/IXFR) requests
+	xfrRcode int
+	// TXT replied to CHAOS queries keyed by query name, empty value if refused, nil if not configured
+	chaosNames map[string]string
+	// Limits of query name, zero if unlimited
+	maxLabels          int
+	maxLabelsRcode     int
+	maxNameLength      int
+	maxNameLengthRcode int
+	// Names failed immediately with failRcode, nil if disabled
+	failNames domainSet
+	failRcode int
+	// Records answered locally, nil if none, see: override.go
+	overrides   overrideSet
+	overrideTTL uint32
+	// Zones delegated locally by referrals, nil if none, see: delegate.go
+	delegations delegationSet
+	// EDNS0 TCP Keepalive timeout replied to clients, in units of 100 milliseconds, zero if disabled
+	tcpKeepalive uint16
+	// Reject query names not conforming to hostname syntax
+	strictNames bool
+	// Reply SERVFAIL immediately if a reply fails to unpack, rather than retry with another host
+	unpackServfail bool
+	// Retry another host rather than forwarding truncated replies over stream(i.e. TCP, TLS, HTTPS)
+	streamTruncatedNext bool
+	// Only log and count matched names, which are routed as if unmatched, see: Dnsredir.route()
+	dryrun bool
+	// Ceiling of handling a request upstream, including all retries, zero if defaultTimeout only
+	maxQueryTime time.Duration
+	// RCODE replied once maxQueryTime exceeded, see: maxQueryTimeDrop
+	maxQueryTimeRcode int
+	// Action taken if question section of the reply mismatches the query
+	mismatch int
+	// Match replies by transaction ID and question type only, see: replyMatch()
+	lenientMatch bool
+	// Retry truncated UDP replies over TCP, rather than replying them to clients
+	tcpFallback bool
+	// Match replies with extra questions and normalize them to the client's, see: replyMatch()
+	normalizeQuestion bool
+	// Maximum size of queries' EDNS0 UDP buffer and replies of upstream hosts, zero if unlimited, see: oversizedReply()
+	maxMsgSize int
+	// Truncate oversized replies rather than retry with another host
+	maxMsgSizeTruncate bool
+	// Maximum bytes of mismatched replies hexdumped at warning level, zero if disabled
+	logMismatch int
+	mismatchLog logLimiter
+	// SRV names used to discover upstream hosts dynamically, see: srv.go
+	srvNames   []string
+	srvRefresh time.Duration
+	srvRetired []retiredHost // Hosts removed from SRV records, accessed by the discovery goroutine only
+	// Transforms applied to replies in order, see: ResponseTransform
+	transforms []ResponseTransform
+	// How root zone(".") queries are routed, see: rootDefault
+	root int
+	// Query types routed to this upstream, nil if any
+	qtypes map[uint16]struct{}
+	// Requests routed to this upstream by presence of DNS Cookie, see: cookieAny
+	cookie int
+	// Reply cookie-less UDP requests with TC bit set, so clients retry over TCP
+	cookieTc bool
+	// Detailed timing of Match() phases, nil if disabled
+	matchTiming *matchTiming
+	// Exchanges slower than it are logged at warning level, zero if disabled
+	slowLog time.Duration
+	// Exchange timeout of upstream hosts, zero to use the default
+	timeout time.Duration
+	// Maximum in-flight exchanges per upstream host, zero if unlimited, see: UpstreamHost.maxInflight
+	maxInflight int32
+	// Re-marshal replies of upstream hosts before forwarding, see: unpackReply()
+	sanitize bool
+	// Limit alternate queries in flight, nil if prefetch_alternate disabled, see: prefetch()
+	prefetchSem chan struct{}
+	// How CD(Checking Disabled) bit of queries sent to upstream hosts is set, see: cdBitPreserve
+	cdBit int
+	// How RD(Recursion Desired) bit of queries sent to upstream hosts is set, see: rdBitPreserve
+	rdBit int
+	// How query name sent to upstream hosts is cased, see: casePreserve
+	qnameCase int
+	// Tag queries sent to upstream hosts with a nonce, so looped back queries are refused, see: isLooped()
+	loopDetect bool
+	// Per-query trace mode, zero if disabled, see: Dnsredir.trace
+	trace int
+	// Route names to the most specific matched upstream, see: Dnsredir.matchLongest
+	matchLongest bool
+	// Codes of EDNS0 options forwarded to upstream hosts, others are removed, nil if all forwarded
+	forwardEdns map[uint16]struct{}
+	// How queries are matched during initial population of name lists, see: onInitForward
+	onInit     int
+	onInitHold time.Duration
+	// RCODE replied to unmatched queries while name lists aren't ready, see: onUnreadyForward
+	onUnready int
 }
 
+const (
+	// Pass through the client's query name case
+	casePreserve = iota
+	// Lower case the query name
+	caseLower
+	// Upper case the query name
+	caseUpper
+)
+
+var caseActions = map[string]int{
+	"preserve": casePreserve,
+	"lower":    caseLower,
+	"upper":    caseUpper,
+}
+
+const (
+	// Pass through the client's CD bit
+	cdBitPreserve = iota
+	// Always set the CD bit
+	cdBitSet
+	// Always clear the CD bit
+	cdBitClear
+)
+
+var cdBitActions = map[string]int{
+	"preserve": cdBitPreserve,
+	"set":      cdBitSet,
+	"clear":    cdBitClear,
+}
+
+const (
+	// Pass through the client's RD bit
+	rdBitPreserve = iota
+	// Always set the RD bit
+	rdBitSet
+	// Always clear the RD bit
+	rdBitClear
+)
+
+var rdBitActions = map[string]int{
+	"preserve": rdBitPreserve,
+	"set":      rdBitSet,
+	"clear":    rdBitClear,
+}
+
+const (
+	// Reply FORMERR to the client
+	mismatchFormerr = iota
+	// Retry with next upstream host
+	mismatchNext
+	// Drop the reply silently
+	mismatchDrop
+)
+
+var mismatchActions = map[string]int{
+	"formerr": mismatchFormerr,
+	"next":    mismatchNext,
+	"drop":    mismatchDrop,
+}
+
+const (
+	// Root queries are matched only if `.' is specified as FROM...
+	rootDefault = iota
+	// Root queries are always matched
+	rootMatch
+	// Root queries are never matched, thus passed to next upstream or next plugin
+	rootNext
+)
+
+const (
+	// Match against names populated so far, unmatched queries are passed to next upstream
+	onInitForward = iota
+	// Wait for initial population(up to a timeout) before matching
+	onInitHold
+	// Unmatched queries are passed to next plugin, rather than next upstream
+	onInitFallthrough
+)
+
+// Unmatched queries are passed to next upstream even if name lists aren't ready, see: NameList.ready()
+// NOERROR is never replied to unready name lists, thus it means forward.
+const onUnreadyForward = dns.RcodeSuccess
+
+// Reply nothing once max_query_time exceeded, so the client times out
+const maxQueryTimeDrop = -1
+
 // reloadableUpstream implements Upstream interface
 
 // Check if given name in upstream name list
 // `name' is lower cased and without trailing dot(except for root zone)
 func (u *reloadableUpstream) Match(name string) bool {
+	if name == "." {
+		switch u.root {
+		case rootMatch:
+			return true
+		case rootNext:
+			return false
+		}
+	}
+
 	if u.matchAny {
 		if !plugin.Name(".").Matches(name) {
 			panic(fmt.Sprintf("Why %q doesn't match %q?!", name, "."))
 		}
 
-		ignored := u.ignored.Match(name)
+		t := u.matchTiming.start()
+		ignored := u.ignored.matchTimed(name, u.matchTiming)
+		u.matchTiming.observe(matchPhaseExcept, t)
 		if ignored {
 			log.Debugf("#0 Skip %q since it's ignored", name)
 		}
 		return !ignored
 	}
 
-	if !u.NameList.Match(name) && !u.inline.Match(name) {
+	t := u.matchTiming.start()
+	matched := u.NameList.matchTimed(name, u.matchTiming)
+	t = u.matchTiming.observe(matchPhaseNames, t)
+	if !matched {
+		matched = u.inline.matchTimed(name, u.matchTiming)
+		t = u.matchTiming.observe(matchPhaseInline, t)
+	}
+	if !matched {
 		return false
 	}
 
-	if u.ignored.Match(name) {
+	ignored := u.ignored.matchTimed(name, u.matchTiming)
+	u.matchTiming.observe(matchPhaseExcept, t)
+	if ignored {
 		log.Debugf("#1 Skip %q since it's ignored", name)
 		return false
 	}
 	return true
 }
 
+// Return number of labels of the most specific name matched, zero if matched by the root zone(i.e. ".")
+// Assume `name' is lower cased, without trailing dot and matched, thus its longest suffix in name lists
+//	is the most specific one, e.g. "a.corp.example" for "x.a.corp.example" if the list also has "example".
+// Suffixes are looked up exactly, since Match() of a suffix is true as long as any of its parents is listed.
+func (u *reloadableUpstream) matchSpecificity(name string) int {
+	if u.matchAny || name == "." {
+		return 0
+	}
+	indexes := dns.Split(name)
+	for i, index := range indexes {
+		suffix := name[index:]
+		if u.NameList.contains(suffix) || u.inline.contains(suffix) {
+			return len(indexes) - i
+		}
+	}
+	// Matched yet not found, e.g. lookup of a redis:// source failed since then
+	return 0
+}
+
+// Check if the request is routed to this upstream by constraints other than the name, i.e. qtype and cookie
+func (u *reloadableUpstream) matchRequest(state *request.Request) bool {
+	if u.qtypes != nil {
+		if _, ok := u.qtypes[state.QType()]; !ok {
+			return false
+		}
+	}
+	if u.cookie != cookieAny && (u.cookie == cookiePresent) != hasCookie(state) {
+		return false
+	}
+	return true
+}
+
+// Return true if the reply contains any sentinel IP or RCODE specified in unhealthy_answer
+func (u *reloadableUpstream) isUnhealthyAnswer(reply *dns.Msg) bool {
+	if _, ok := u.unhealthyRcodes[reply.Rcode]; ok {
+		return true
+	}
+	if len(u.unhealthyIPs) == 0 {
+		return false
+	}
+	for _, rr := range reply.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if u.unhealthyIPs.Contains(ip.String()) {
+			return true
+		}
+	}
+	return false
+}
+
 func (u *reloadableUpstream) Start() error {
 	u.periodicUpdate(u.bootstrap)
 	u.HealthCheck.Start()
+	u.startSrvDiscovery()
 	if err := ipsetSetup(u); err != nil {
 		return err
 	}
@@ -79,7 +361,9 @@ func (u *reloadableUpstream) Start() error {
 func (u *reloadableUpstream) Stop() error {
 	close(u.stopPathReload)
 	close(u.stopUrlReload)
+	u.closeRedis()
 	u.HealthCheck.Stop()
+	u.stopSrvRetired()
 	if err := ipsetShutdown(u); err != nil {
 		return err
 	}
@@ -89,6 +373,80 @@ func (u *reloadableUpstream) Stop() error {
 	return nil
 }
 
+// Initialize the upstream host with settings of the upstream
+func (u *reloadableUpstream) initHost(host *UpstreamHost) error {
+	addr, tlsServerName := SplitByByte(host.addr, '@')
+	host.addr = addr
+
+	host.timeout = u.timeout
+	host.maxInflight = u.maxInflight
+	host.sanitize = u.sanitize
+	host.checkSem = u.checkSem
+	host.transport = newTransport()
+	// Inherit from global transport settings
+	host.transport.recursionDesired = u.transport.recursionDesired
+	host.transport.expire = u.transport.expire
+	host.transport.fixedDialTimeout = u.transport.fixedDialTimeout
+	host.transport.tcpProbePercent = u.transport.tcpProbePercent
+	host.transport.udpSndbuf = u.transport.udpSndbuf
+	host.transport.udpRcvbuf = u.transport.udpRcvbuf
+	host.transport.userAgent = u.transport.userAgent
+	if host.proto == transport.TLS {
+		// Deep copy
+		host.transport.tlsConfig = new(tls.Config)
+		host.transport.tlsConfig.Certificates = u.transport.tlsConfig.Certificates
+		host.transport.tlsConfig.RootCAs = u.transport.tlsConfig.RootCAs
+		host.transport.tlsConfig.MinVersion = u.transport.tlsConfig.MinVersion
+		host.transport.tlsConfig.CipherSuites = u.transport.tlsConfig.CipherSuites
+		if u.transport.tlsSessionCache != 0 {
+			// Per-host cache, so reconnections resume sessions rather than full handshakes
+			host.transport.tlsSessionCache = u.transport.tlsSessionCache
+			host.transport.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(u.transport.tlsSessionCache)
+		}
+		// Don't set TLS server name if addr host part is already a domain name
+		if hostPortIsIpPort(addr) {
+			host.transport.tlsConfig.ServerName = u.transport.tlsConfig.ServerName
+		}
+
+		// TLS server name in tls:// takes precedence over the global one(if any)
+		if len(tlsServerName) != 0 {
+			tlsServerName = tlsServerName[1:]
+			serverName, ok := stringToDomain(tlsServerName)
+			if !ok {
+				return fmt.Errorf("invalid TLS server name %q", tlsServerName)
+			}
+			host.transport.tlsConfig.ServerName = serverName
+		}
+	}
+
+	network := protoToNetwork(host.proto)
+	if network == "dns" {
+		// Use classic DNS protocol for health checking
+		network = "udp"
+	}
+	host.c = &dns.Client{
+		Net:         network,
+		TLSConfig:   host.transport.tlsConfig,
+		Timeout:     u.checkTimeout,
+		DialTimeout: host.transport.fixedDialTimeout,
+	}
+	host.InitDOH(u)
+	host.poolKey = transportKey(host, u.bootstrap, u.ipPref)
+
+	if u.breakerThreshold != 0 {
+		host.breaker = newCircuitBreaker(host.Name(), u.breakerThreshold, u.breakerCooldown)
+	}
+	if u.errorHistory != 0 {
+		host.errors = newErrorHistory(u.errorHistory)
+	}
+	for _, link := range host.fallbacks {
+		if err := u.initHost(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Parses Caddy config input and return a list of reloadable upstream for this plugin
 func NewReloadableUpstreams(c *caddy.Controller) ([]Upstream, error) {
 	var ups []Upstream
@@ -124,14 +482,20 @@ func newReloadableUpstream(c *caddy.Controller) (Upstream, error) {
 			urlReadTimeout: defaultUrlReadTimeout,
 			stopUrlReload:  make(chan struct{}),
 		},
-		ignored: make(domainSet),
-		inline:  make(domainSet),
+		ignored:     make(domainSet),
+		inline:      make(domainSet),
+		xfrRcode:    dns.RcodeRefused,
+		failRcode:   dns.RcodeServerFailure,
+		overrideTTL: defaultOverrideTTL,
+		srvRefresh:  defaultSrvRefresh,
 		HealthCheck: &HealthCheck{
 			stop:          make(chan struct{}),
 			maxFails:      defaultMaxFails,
 			checkInterval: defaultHcInterval,
+			checkTimeout:  defaultHcTimeout,
 			transport: &Transport{
 				expire:           defaultConnExpire,
+				userAgent:        userAgent,
 				tlsConfig:        new(tls.Config),
 				recursionDesired: true,
 			},
@@ -148,49 +512,17 @@ func newReloadableUpstream(c *caddy.Controller) (Upstream, error) {
 		}
 	}
 
-	if u.hosts == nil {
-		return nil, c.Errf("missing mandatory property: %q", "to")
+	if len(u.hosts) == 0 && len(u.srvNames) == 0 {
+		// An upstream without hosts can never select one, thus every matched query fails
+		return nil, c.Errf("missing mandatory property: %q, no upstream host specified for %v", "to", u.from)
+	}
+	if u.rateLimit != nil {
+		u.rateLimit.response = u.rateLimitResponse
 	}
 	for _, host := range u.hosts {
-		addr, tlsServerName := SplitByByte(host.addr, '@')
-		host.addr = addr
-
-		host.transport = newTransport()
-		// Inherit from global transport settings
-		host.transport.recursionDesired = u.transport.recursionDesired
-		host.transport.expire = u.transport.expire
-		if host.proto == transport.TLS {
-			// Deep copy
-			host.transport.tlsConfig = new(tls.Config)
-			host.transport.tlsConfig.Certificates = u.transport.tlsConfig.Certificates
-			host.transport.tlsConfig.RootCAs = u.transport.tlsConfig.RootCAs
-			// Don't set TLS server name if addr host part is already a domain name
-			if hostPortIsIpPort(addr) {
-				host.transport.tlsConfig.ServerName = u.transport.tlsConfig.ServerName
-			}
-
-			// TLS server name in tls:// takes precedence over the global one(if any)
-			if len(tlsServerName) != 0 {
-				tlsServerName = tlsServerName[1:]
-				serverName, ok := stringToDomain(tlsServerName)
-				if !ok {
-					return nil, c.Errf("invalid TLS server name %q", tlsServerName)
-				}
-				host.transport.tlsConfig.ServerName = serverName
-			}
-		}
-
-		network := protoToNetwork(host.proto)
-		if network == "dns" {
-			// Use classic DNS protocol for health checking
-			network = "udp"
-		}
-		host.c = &dns.Client{
-			Net:       network,
-			TLSConfig: host.transport.tlsConfig,
-			Timeout:   defaultHcTimeout,
+		if err := u.initHost(host); err != nil {
+			return nil, c.Err(err.Error())
 		}
-		host.InitDOH(u)
 	}
 
 	if err := u.inline.ForEachDomain(func(name string) error {
@@ -222,7 +554,7 @@ func newReloadableUpstream(c *caddy.Controller) (Upstream, error) {
 			switch item.whichType {
 			case NameItemTypePath:
 				hasPath = true
-			case NameItemTypeUrl:
+			case NameItemTypeUrl, NameItemTypeTxt, NameItemTypeRedis:
 				hasUrl = true
 			default:
 				panic(fmt.Sprintf("Unexpected NameItem type %v", item.whichType))
@@ -242,6 +574,10 @@ func newReloadableUpstream(c *caddy.Controller) (Upstream, error) {
 		log.Infof("inline: %v", u.inline)
 	}
 
+	if tlsConfig := u.transport.tlsConfig; tlsConfig.MinVersion == tls.VersionTLS13 && len(tlsConfig.CipherSuites) != 0 {
+		log.Warningf("%q takes no effect since TLS 1.3 cipher suites are not configurable", "tls_ciphers")
+	}
+
 	return u, nil
 }
 
@@ -251,6 +587,7 @@ func parseFrom(c *caddy.Controller, u *reloadableUpstream) error {
 	if n == 0 {
 		return c.ArgErr()
 	}
+	u.from = forms
 
 	if n == 1 && forms[0] == "." {
 		u.matchAny = true
@@ -326,6 +663,76 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		}
 		u.urlReload = dur
 		log.Infof("%v: %v %v", dir, u.urlReload, u.urlReadTimeout)
+	case "user_agent":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		if args[0] == "" || strings.ContainsAny(args[0], "\r\n") {
+			return c.Errf("%v: invalid User-Agent %q", dir, args[0])
+		}
+		u.urlUserAgent = args[0]
+		u.transport.userAgent = args[0]
+		log.Infof("%v: %q", dir, args[0])
+	case "reload_concurrency":
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		if n != 0 {
+			u.urlFetchSem = make(chan struct{}, n)
+		} else {
+			u.urlFetchSem = nil
+		}
+		log.Infof("%v: %v", dir, n)
+	case "reload_max_stale":
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dur < minUrlReloadInterval && dur != 0 {
+			return c.Errf("%v: minimal duration is %v", dir, minUrlReloadInterval)
+		}
+		u.maxStale = dur
+		log.Infof("%v: %v", dir, dur)
+	case "max_names":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		n, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return c.Errf("%v: invalid count %q", dir, args[0])
+		}
+		u.maxNames = n
+		log.Infof("%v: %v", dir, n)
+	case "tag":
+		// Multiple "tag"s will be merged together
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		if u.loadTags == nil {
+			u.loadTags = make(StringSet)
+		}
+		for _, tag := range args {
+			u.loadTags.Add(tag)
+		}
+		log.Infof("%v: %v", dir, args)
+	case "bloom_filter":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		u.bloomRate = defaultBloomRate
+		if len(args) == 1 {
+			rate, err := strconv.ParseFloat(args[0], 64)
+			if err != nil || !(rate > 0 && rate <= maxBloomRate) {
+				return c.Errf("%v: invalid false positive rate %q, expected (0, %v]", dir, args[0], maxBloomRate)
+			}
+			u.bloomRate = rate
+		}
+		log.Infof("%v: %v", dir, u.bloomRate)
 	case "except":
 		// Multiple "except"s will be merged together
 		args := c.RemainingArgs()
@@ -338,6 +745,83 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 			}
 		}
 		log.Infof("%v: %v", dir, u.ignored)
+	case "qtype":
+		// Multiple "qtype"s will be merged together
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		if u.qtypes == nil {
+			u.qtypes = make(map[uint16]struct{})
+		}
+		for _, arg := range args {
+			qtype, ok := dns.StringToType[strings.ToUpper(arg)]
+			if !ok {
+				return c.Errf("%v: unknown type %q", dir, arg)
+			}
+			u.qtypes[qtype] = struct{}{}
+		}
+		log.Infof("%v: %v", dir, args)
+	case "cookie":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		action, ok := cookieActions[args[0]]
+		if !ok {
+			return c.Errf("%v: unknown action %q, expected present or absent", dir, args[0])
+		}
+		u.cookie = action
+		log.Infof("%v: %v", dir, args[0])
+	case "cookie_tc":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.cookieTc = true
+		log.Infof("%v: enabled", dir)
+	case "fail":
+		// Multiple "fail"s will be merged together
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		if u.failNames == nil {
+			u.failNames = make(domainSet)
+		}
+		for _, name := range args {
+			if !u.failNames.Add(name) {
+				log.Warningf("%q isn't a domain name", name)
+			}
+		}
+		log.Infof("%v: %v", dir, u.failNames)
+	case "fail_rcode":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		rcode, ok := stringToRcode(args[0])
+		if !ok {
+			return c.Errf("%v: unknown RCODE %q", dir, args[0])
+		}
+		u.failRcode = rcode
+		log.Infof("%v: %v", dir, dns.RcodeToString[rcode])
+	case "override":
+		// Multiple "override"s will be merged together
+		if err := parseOverride(c, u); err != nil {
+			return err
+		}
+	case "delegate":
+		// Multiple "delegate"s will be merged together
+		if err := parseDelegate(c, u); err != nil {
+			return err
+		}
+	case "override_ttl":
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		u.overrideTTL = uint32(n)
+		log.Infof("%v: %v", dir, n)
 	case "spray":
 		if len(c.RemainingArgs()) != 0 {
 			return c.ArgErr()
@@ -346,15 +830,23 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		log.Infof("%v: enabled", dir)
 	case "policy":
 		arr := c.RemainingArgs()
-		if len(arr) != 1 {
+		if len(arr) != 1 && len(arr) != 2 {
 			return c.ArgErr()
 		}
 		policy, ok := SupportedPolicies[arr[0]]
 		if !ok {
 			return c.Errf("unknown policy: %q", arr[0])
 		}
+		if len(arr) == 2 {
+			if arr[1] != "random_start" {
+				return c.Errf("%v: unknown option: %q", dir, arr[1])
+			}
+			if policy, ok = newRandomStartPolicy(arr[0]); !ok {
+				return c.Errf("%v: %q has no initial selection to randomize", dir, arr[0])
+			}
+		}
 		u.policy = policy
-		log.Infof("%v: %v", dir, arr[0])
+		log.Infof("%v: %v", dir, strings.Join(arr, " "))
 	case "max_fails":
 		n, err := parseInt32(c)
 		if err != nil {
@@ -381,6 +873,27 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		u.checkInterval = dur
 		u.transport.recursionDesired = n == 1
 		log.Infof("%v: %v %v", dir, u.checkInterval, u.transport.recursionDesired)
+	case "health_check_timeout":
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dur < minHcTimeout {
+			return c.Errf("%v: minimal timeout is %v", dir, minHcTimeout)
+		}
+		u.checkTimeout = dur
+		log.Infof("%v: %v", dir, dur)
+	case "health_check_concurrency":
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		if n != 0 {
+			u.checkSem = make(chan struct{}, n)
+		} else {
+			u.checkSem = nil
+		}
+		log.Infof("%v: %v", dir, n)
 	case "to":
 		// Multiple "to"s will be merged together
 		if err := parseTo(c, u); err != nil {
@@ -396,6 +909,82 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		}
 		u.transport.expire = dur
 		log.Infof("%v: %v", dir, dur)
+	case "dial_timeout":
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dur < minDialTimeoutOption && dur != 0 {
+			return c.Errf("%v: minimal timeout is %v", dir, minDialTimeoutOption)
+		}
+		u.transport.fixedDialTimeout = dur
+		log.Infof("%v: %v", dir, dur)
+	case "max_inflight":
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		u.maxInflight = n
+		log.Infof("%v: %v", dir, n)
+	case "sanitize_response":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.sanitize = true
+		log.Infof("%v: enabled", dir)
+	case "timeout":
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dur != 0 && (dur < minExchangeTimeout || dur > defaultTimeout) {
+			return c.Errf("%v: timeout must be in range [%v, %v]", dir, minExchangeTimeout, defaultTimeout)
+		}
+		u.timeout = dur
+		log.Infof("%v: %v", dir, dur)
+	case "tcp_probe_ratio":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		percent, err := parsePercent(dir, args[0])
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		u.transport.tcpProbePercent = percent
+		log.Infof("%v: %v%%", dir, percent)
+	case "tcp_keepalive":
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dur != 0 && (dur < 100*time.Millisecond || dur > 0xffff*100*time.Millisecond) {
+			return c.Errf("%v: timeout %v out of range [%v, %v]", dir, dur, 100*time.Millisecond, 0xffff*100*time.Millisecond)
+		}
+		if dur > tcpIdleTimeout {
+			log.Warningf("%v: timeout %v exceeds TCP idle timeout %v of the server", dir, dur, tcpIdleTimeout)
+		}
+		u.tcpKeepalive = uint16(dur / (100 * time.Millisecond))
+		if u.tcpKeepalive != 0 {
+			u.setTransform(&tcpKeepaliveTransform{timeout: u.tcpKeepalive})
+		}
+		log.Infof("%v: %v", dir, dur)
+	case "udp_sndbuf":
+		fallthrough
+	case "udp_rcvbuf":
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		if n < minSockBufSize && n != 0 {
+			return c.Errf("%v: minimal size is %v", dir, minSockBufSize)
+		}
+		if dir == "udp_sndbuf" {
+			u.transport.udpSndbuf = int(n)
+		} else {
+			u.transport.udpRcvbuf = int(n)
+		}
+		log.Infof("%v: %v", dir, n)
 	case "tls":
 		args := c.RemainingArgs()
 		if len(args) > 3 {
@@ -405,8 +994,10 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		if err != nil {
 			return err
 		}
-		// Merge server name if tls_servername set previously
+		// Merge server name, min version and cipher suites if set previously
 		tlsConfig.ServerName = u.transport.tlsConfig.ServerName
+		tlsConfig.MinVersion = u.transport.tlsConfig.MinVersion
+		tlsConfig.CipherSuites = u.transport.tlsConfig.CipherSuites
 		u.transport.tlsConfig = tlsConfig
 		log.Infof("%v: %v", dir, args)
 	case "tls_servername":
@@ -420,31 +1011,692 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		}
 		u.transport.tlsConfig.ServerName = serverName
 		log.Infof("%v: %v", dir, serverName)
-	case "bootstrap":
-		if err := parseBootstrap(c, u); err != nil {
-			return err
+	case "tls_min_version":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
 		}
-	case "ipset":
-		if err := ipsetParse(c, u); err != nil {
-			return err
+		version, ok := tlsVersions[args[0]]
+		if !ok {
+			return c.Errf("%v: unknown TLS version %q", dir, args[0])
 		}
-	case "pf":
-		if err := pfParse(c, u); err != nil {
+		u.transport.tlsConfig.MinVersion = version
+		log.Infof("%v: %v", dir, args[0])
+	case "tls_ciphers":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		ciphers, err := parseCipherSuites(args)
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.transport.tlsConfig.CipherSuites = ciphers
+		log.Infof("%v: %v", dir, args)
+	case "tls_session_cache":
+		n, err := parseInt32(c)
+		if err != nil {
 			return err
 		}
-	case "no_ipv6":
+		u.transport.tlsSessionCache = int(n)
+		log.Infof("%v: %v", dir, n)
+	case "unhealthy_answer":
+		// Multiple "unhealthy_answer"s will be merged together
 		args := c.RemainingArgs()
-		if len(args) != 0 {
+		if len(args) == 0 {
 			return c.ArgErr()
 		}
-		u.noIPv6 = true
-		log.Infof("%v: %v", dir, u.noIPv6)
-	default:
-		if len(c.RemainingArgs()) != 0 || !u.inline.Add(dir) {
-			return c.Errf("unknown property: %q", dir)
+		for _, arg := range args {
+			if ip := net.ParseIP(arg); ip != nil {
+				if u.unhealthyIPs == nil {
+					u.unhealthyIPs = make(StringSet)
+				}
+				u.unhealthyIPs.Add(ip.String())
+			} else if rcode, ok := stringToRcode(arg); ok {
+				if u.unhealthyRcodes == nil {
+					u.unhealthyRcodes = make(map[int]struct{})
+				}
+				u.unhealthyRcodes[rcode] = struct{}{}
+			} else {
+				return c.Errf("%v: %q is neither an IP address nor a RCODE", dir, arg)
+			}
 		}
-		if u.ignored.Len() != 0 {
-			return c.Errf("%q must comes before %q", "INLINE", "except")
+		log.Infof("%v: %v", dir, args)
+	case "circuit_breaker":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 || n > 0x7fffffff {
+			return c.Errf("%v: invalid failure threshold %q", dir, args[0])
+		}
+		dur, err := parseDuration0(dir, args[1])
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		if dur < minBreakerCooldown {
+			return c.Errf("%v: minimal cooldown is %v", dir, minBreakerCooldown)
+		}
+		u.breakerThreshold = int32(n)
+		u.breakerCooldown = dur
+		log.Infof("%v: %v %v", dir, n, dur)
+	case "srv_refresh":
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dur < minSrvRefresh {
+			return c.Errf("%v: minimal interval is %v", dir, minSrvRefresh)
+		}
+		u.srvRefresh = dur
+		log.Infof("%v: %v", dir, dur)
+	case "recovery_ramp":
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dur < minRecoveryRamp && dur != 0 {
+			return c.Errf("%v: minimal duration is %v", dir, minRecoveryRamp)
+		}
+		u.recoveryRamp = dur
+		log.Infof("%v: %v", dir, dur)
+	case "servfail_ttl":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		ttl := defaultServfailTtl
+		if len(args) == 1 {
+			dur, err := parseDuration0(dir, args[0])
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			if dur < time.Second || dur > maxServfailTtl {
+				return c.Errf("%v: expected duration between %v and %v", dir, time.Second, maxServfailTtl)
+			}
+			ttl = dur
+		}
+		u.servfailCache = newServfailCache(ttl)
+		log.Infof("%v: %v", dir, ttl)
+	case "cache_min_ttl":
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dur < time.Second || dur > maxAnswerCacheTtl {
+			return c.Errf("%v: expected duration between %v and %v", dir, time.Second, maxAnswerCacheTtl)
+		}
+		u.answerCache = newAnswerCache(dur)
+		log.Infof("%v: %v", dir, dur)
+	case "slow_log":
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dur < minSlowLog && dur != 0 {
+			return c.Errf("%v: minimal duration is %v", dir, minSlowLog)
+		}
+		u.slowLog = dur
+		log.Infof("%v: %v", dir, dur)
+	case "max_cname_depth":
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		u.maxCnameDepth = int(n)
+		log.Infof("%v: %v", dir, n)
+	case "on_init":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		switch args[0] {
+		case "forward":
+			u.onInit = onInitForward
+		case "hold":
+			u.onInit = onInitHold
+			u.onInitHold = defaultOnInitHold
+		case "fallthrough":
+			u.onInit = onInitFallthrough
+		default:
+			return c.Errf("%v: unknown value %q, expected hold, forward or fallthrough", dir, args[0])
+		}
+		if len(args) == 2 {
+			if u.onInit != onInitHold {
+				return c.Errf("%v: timeout only applicable to hold", dir)
+			}
+			dur, err := parseDuration0(dir, args[1])
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			if dur < minOnInitHold {
+				return c.Errf("%v: minimal timeout is %v", dir, minOnInitHold)
+			}
+			u.onInitHold = dur
+		}
+		log.Infof("%v: %v %v", dir, args[0], u.onInitHold)
+	case "on_unready":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		if args[0] == "forward" {
+			u.onUnready = onUnreadyForward
+			log.Infof("%v: %v", dir, args[0])
+			break
+		}
+		rcode, ok := stringToRcode(args[0])
+		if !ok || rcode == dns.RcodeSuccess {
+			return c.Errf("%v: unknown value %q, expected forward or RCODE other than NOERROR", dir, args[0])
+		}
+		u.onUnready = rcode
+		log.Infof("%v: %v", dir, dns.RcodeToString[rcode])
+	case "root":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		switch args[0] {
+		case "match":
+			u.root = rootMatch
+		case "next":
+			u.root = rootNext
+		default:
+			return c.Errf("%v: unknown value %q, expected match or next", dir, args[0])
+		}
+		log.Infof("%v: %v", dir, args[0])
+	case "match":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		switch args[0] {
+		case "first":
+			u.matchLongest = false
+		case "longest":
+			u.matchLongest = true
+		default:
+			return c.Errf("%v: unknown value %q, expected longest or first", dir, args[0])
+		}
+		log.Infof("%v: %v", dir, args[0])
+	case "dryrun":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.dryrun = true
+		log.Infof("%v: enabled", dir)
+	case "unpack_error":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		switch args[0] {
+		case "next":
+			u.unpackServfail = false
+		case "servfail":
+			u.unpackServfail = true
+		default:
+			return c.Errf("%v: unknown action %q, expected next or servfail", dir, args[0])
+		}
+		log.Infof("%v: %v", dir, args[0])
+	case "tcp_truncated":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		switch args[0] {
+		case "forward":
+			u.streamTruncatedNext = false
+		case "next":
+			u.streamTruncatedNext = true
+		default:
+			return c.Errf("%v: unknown action %q, expected forward or next", dir, args[0])
+		}
+		log.Infof("%v: %v", dir, args[0])
+	case "max_query_time":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 2 {
+			return c.ArgErr()
+		}
+		dur, err := parseDuration0(dir, args[0])
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		if dur < minExchangeTimeout || dur > defaultTimeout {
+			return c.Errf("%v: expected duration in range [%v, %v]", dir, minExchangeTimeout, defaultTimeout)
+		}
+		u.maxQueryTime = dur
+		u.maxQueryTimeRcode = dns.RcodeServerFailure
+		action := dns.RcodeToString[u.maxQueryTimeRcode]
+		if len(args) == 2 {
+			if args[1] == "drop" {
+				u.maxQueryTimeRcode = maxQueryTimeDrop
+			} else if rcode, ok := stringToRcode(args[1]); ok && rcode != dns.RcodeSuccess {
+				u.maxQueryTimeRcode = rcode
+			} else {
+				return c.Errf("%v: unknown value %q, expected drop or RCODE other than NOERROR", dir, args[1])
+			}
+			action = args[1]
+		}
+		log.Infof("%v: %v %v", dir, dur, action)
+	case "trace":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		mode, ok := traceModes[args[0]]
+		if !ok {
+			return c.Errf("%v: unknown mode %q, expected all or edns", dir, args[0])
+		}
+		u.trace = mode
+		log.Infof("%v: %v", dir, args[0])
+	case "mismatch":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		action, ok := mismatchActions[args[0]]
+		if !ok {
+			return c.Errf("%v: unknown action %q, expected formerr, next or drop", dir, args[0])
+		}
+		u.mismatch = action
+		log.Infof("%v: %v", dir, args[0])
+	case "filter_type":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		qtypes := make(map[uint16]struct{})
+		for _, arg := range args {
+			qtype, ok := dns.StringToType[strings.ToUpper(arg)]
+			if !ok {
+				return c.Errf("%v: unknown type %q", dir, arg)
+			}
+			qtypes[qtype] = struct{}{}
+		}
+		u.setTransform(&filterTypeTransform{qtypes: qtypes})
+		log.Infof("%v: %v", dir, args)
+	case "ttl_override":
+		// Multiple "ttl_override"s will be merged together
+		args := c.RemainingArgs()
+		if len(args) != 3 {
+			return c.ArgErr()
+		}
+		rrtype, ok := dns.StringToType[strings.ToUpper(args[0])]
+		if !ok {
+			return c.Errf("%v: unknown type %q", dir, args[0])
+		}
+		min, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return c.Errf("%v: invalid TTL %q", dir, args[1])
+		}
+		max, err := strconv.ParseUint(args[2], 10, 32)
+		if err != nil {
+			return c.Errf("%v: invalid TTL %q", dir, args[2])
+		}
+		if min > max {
+			return c.Errf("%v: minimal TTL %v is greater than maximal TTL %v", dir, min, max)
+		}
+		var t *ttlOverrideTransform
+		for _, t0 := range u.transforms {
+			if t1, ok := t0.(*ttlOverrideTransform); ok {
+				t = t1
+			}
+		}
+		if t == nil {
+			t = &ttlOverrideTransform{policy: make(ttlPolicy)}
+			u.setTransform(t)
+		}
+		t.policy[rrtype] = ttlRange{min: uint32(min), max: uint32(max)}
+		log.Infof("%v: %v", dir, args)
+	case "loop_detect":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.loopDetect = true
+		log.Infof("%v: enabled", dir)
+	case "sort_answers":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.setTransform(&sortAnswersTransform{})
+		log.Infof("%v: enabled", dir)
+	case "max_answers":
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return c.Errf("%v: expected a positive integer", dir)
+		}
+		u.setTransform(&maxAnswersTransform{max: int(n)})
+		log.Infof("%v: %v", dir, n)
+	case "order":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		switch args[0] {
+		case "a_first":
+			u.setTransform(&orderTransform{first: dns.TypeA})
+		case "aaaa_first":
+			u.setTransform(&orderTransform{first: dns.TypeAAAA})
+		default:
+			return c.Errf("%v: unknown order %q, expected a_first or aaaa_first", dir, args[0])
+		}
+		log.Infof("%v: %v", dir, args[0])
+	case "shrink_additional":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.setTransform(&shrinkAdditionalTransform{})
+		log.Infof("%v: enabled", dir)
+	case "cd_bit":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		action, ok := cdBitActions[args[0]]
+		if !ok {
+			return c.Errf("%v: unknown action %q, expected preserve, set or clear", dir, args[0])
+		}
+		u.cdBit = action
+		log.Infof("%v: %v", dir, args[0])
+	case "rd_bit":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		action, ok := rdBitActions[args[0]]
+		if !ok {
+			return c.Errf("%v: unknown action %q, expected preserve, set or clear", dir, args[0])
+		}
+		u.rdBit = action
+		log.Infof("%v: %v", dir, args[0])
+	case "case":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		action, ok := caseActions[args[0]]
+		if !ok {
+			return c.Errf("%v: unknown action %q, expected preserve, lower or upper", dir, args[0])
+		}
+		u.qnameCase = action
+		log.Infof("%v: %v", dir, args[0])
+	case "force_ttl":
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		u.setTransform(&forceTTLTransform{ttl: uint32(n)})
+		log.Infof("%v: %v", dir, n)
+	case "default_ttl":
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return c.Errf("%v: TTL must be positive", dir)
+		}
+		u.setTransform(&defaultTTLTransform{ttl: uint32(n)})
+		log.Infof("%v: %v", dir, n)
+	case "neg_ttl_max":
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		u.setTransform(&negTTLMaxTransform{ttl: uint32(n)})
+		log.Infof("%v: %v", dir, n)
+	case "append_suffix":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		suffix, ok := stringToDomain(args[0])
+		if !ok {
+			return c.Errf("%v: %q isn't a valid domain name", dir, args[0])
+		}
+		u.appendSuffix = dns.Fqdn(suffix)
+		log.Infof("%v: %v", dir, suffix)
+	case "chaos_delay":
+		fallthrough
+	case "chaos_fail":
+		if err := parseChaos(c, u); err != nil {
+			return err
+		}
+	case "opcode":
+		if err := parseOpcode(c, u); err != nil {
+			return err
+		}
+	case "forward_edns":
+		// Multiple "forward_edns"s will be merged together
+		if err := parseForwardEdns(c, u); err != nil {
+			return err
+		}
+	case "error_history":
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		if n > maxErrorHistory {
+			return c.Errf("%v: maximal size is %v", dir, maxErrorHistory)
+		}
+		u.errorHistory = int(n)
+		log.Infof("%v: %v", dir, n)
+	case "prefetch_alternate":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.prefetchSem = make(chan struct{}, maxPrefetchAlternate)
+		log.Infof("%v: enabled", dir)
+	case "match_timing":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.matchTiming = &matchTiming{}
+		log.Infof("%v: enabled", dir)
+	case "lenient_match":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.lenientMatch = true
+		log.Infof("%v: enabled", dir)
+	case "tcp_fallback":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.tcpFallback = true
+		log.Infof("%v: enabled", dir)
+	case "normalize_question":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.normalizeQuestion = true
+		log.Infof("%v: enabled", dir)
+	case "max_upstream_msg_size":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 2 {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < dns.MinMsgSize || n > dns.MaxMsgSize {
+			return c.Errf("%v: invalid size %q, expected %v to %v", dir, args[0], dns.MinMsgSize, dns.MaxMsgSize)
+		}
+		if len(args) == 2 {
+			switch strings.ToLower(args[1]) {
+			case "reject":
+			case "truncate":
+				u.maxMsgSizeTruncate = true
+			default:
+				return c.Errf("%v: unknown action %q, expected reject or truncate", dir, args[1])
+			}
+		}
+		u.maxMsgSize = n
+		log.Infof("%v: %v %v", dir, n, args[1:])
+	case "log_mismatch":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		u.logMismatch = defaultLogMismatch
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 || n > dns.MaxMsgSize {
+				return c.Errf("%v: invalid size %q, expected 1 to %v", dir, args[0], dns.MaxMsgSize)
+			}
+			u.logMismatch = n
+		}
+		log.Infof("%v: %v", dir, u.logMismatch)
+	case "strict_names":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.strictNames = true
+		log.Infof("%v: enabled", dir)
+	case "max_labels":
+		n, rcode, err := parseNameLimit(c)
+		if err != nil {
+			return err
+		}
+		u.maxLabels, u.maxLabelsRcode = n, rcode
+	case "max_name_length":
+		n, rcode, err := parseNameLimit(c)
+		if err != nil {
+			return err
+		}
+		u.maxNameLength, u.maxNameLengthRcode = n, rcode
+	case "zone_transfer":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		switch strings.ToUpper(args[0]) {
+		case "REFUSED":
+			u.xfrRcode = dns.RcodeRefused
+		case "NOTIMP":
+			u.xfrRcode = dns.RcodeNotImplemented
+		default:
+			return c.Errf("%v: unknown RCODE %q, expected REFUSED or NOTIMP", dir, args[0])
+		}
+		log.Infof("%v: %v", dir, dns.RcodeToString[u.xfrRcode])
+	case "chaos_version":
+		fallthrough
+	case "chaos_hostname":
+		if err := parseChaosTxt(c, u); err != nil {
+			return err
+		}
+	case "max_concurrent":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 2 {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 || n > 0x7fffffff {
+			return c.Errf("%v: invalid limit %q", dir, args[0])
+		}
+		if len(args) == 2 {
+			switch strings.ToLower(args[1]) {
+			case "servfail":
+			case "drop":
+				u.maxConcurrentDrop = true
+			default:
+				return c.Errf("%v: unknown action %q, expected servfail or drop", dir, args[1])
+			}
+		}
+		u.maxConcurrent = int32(n)
+		log.Infof("%v: %v %v", dir, n, args[1:])
+	case "ratelimit":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 2 {
+			return c.ArgErr()
+		}
+		rate, err := strconv.Atoi(args[0])
+		if err != nil || rate <= 0 {
+			return c.Errf("%v: invalid rate %q", dir, args[0])
+		}
+		burst := rate
+		if len(args) == 2 {
+			burst, err = strconv.Atoi(args[1])
+			if err != nil || burst <= 0 {
+				return c.Errf("%v: invalid burst %q", dir, args[1])
+			}
+		}
+		u.rateLimit = newRateLimiter(rate, burst)
+		log.Infof("%v: %v %v", dir, rate, burst)
+	case "ratelimit_response":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		response, ok := rateLimitResponses[strings.ToLower(args[0])]
+		if !ok {
+			return c.Errf("%v: unknown response %q, expected refused, servfail or truncated", dir, args[0])
+		}
+		u.rateLimitResponse = response
+		log.Infof("%v: %v", dir, args[0])
+	case "overlap":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		action, ok := overlapActions[args[0]]
+		if !ok {
+			return c.Errf("%v: unknown action %q, expected warn or error", dir, args[0])
+		}
+		u.overlap = action
+		log.Infof("%v: %v", dir, args[0])
+	case "admin":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		if _, _, err := net.SplitHostPort(args[0]); err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.adminAddr = args[0]
+		log.Infof("%v: %v", dir, u.adminAddr)
+	case "bootstrap":
+		if err := parseBootstrap(c, u); err != nil {
+			return err
+		}
+	case "ipset":
+		if err := ipsetParse(c, u); err != nil {
+			return err
+		}
+	case "pf":
+		if err := pfParse(c, u); err != nil {
+			return err
+		}
+	case "no_ipv6":
+		fallthrough
+	case "ipv4_only":
+		fallthrough
+	case "ipv6_only":
+		fallthrough
+	case "prefer_ipv4":
+		fallthrough
+	case "prefer_ipv6":
+		args := c.RemainingArgs()
+		if len(args) != 0 {
+			return c.ArgErr()
+		}
+		ipPref := ipv4Only
+		if dir != "no_ipv6" {
+			ipPref = ipPreferences[dir]
+		}
+		if u.ipPref != ipAny && u.ipPref != ipPref {
+			return c.Errf("%v: conflict with %v", dir, u.ipPref)
+		}
+		u.ipPref = ipPref
+		log.Infof("%v: %v", dir, u.ipPref)
+	default:
+		if len(c.RemainingArgs()) != 0 || !u.inline.Add(dir) {
+			return c.Errf("unknown property: %q", dir)
+		}
+		if u.ignored.Len() != 0 {
+			return c.Errf("%q must comes before %q", "INLINE", "except")
 		}
 	}
 	return nil
@@ -499,25 +1751,87 @@ func parseDuration(c *caddy.Controller) (time.Duration, error) {
 }
 
 func parseTo(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
 	args := c.RemainingArgs()
 	if len(args) == 0 {
 		return c.ArgErr()
 	}
+	for _, arg := range args {
+		if strings.TrimSpace(arg) == "" {
+			return c.Errf("%v: empty upstream address, e.g. an environment variable expanded to nothing", dir)
+		}
+	}
 
-	toHosts, err := HostPort(args)
-	if err != nil {
-		return err
+	// Leading priority=N and weight=N annotate static hosts of this "to"
+	var priority, weight uint16
+	annotated := false
+	for len(args) != 0 {
+		var p *uint16
+		var s string
+		if s = strings.TrimPrefix(args[0], "priority="); s != args[0] {
+			p = &priority
+		} else if s = strings.TrimPrefix(args[0], "weight="); s != args[0] {
+			p = &weight
+		} else {
+			break
+		}
+		n, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return c.Errf("invalid annotation %q, expected an integer in range [0, 65535]", args[0])
+		}
+		*p = uint16(n)
+		annotated = true
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return c.ArgErr()
 	}
 
-	for _, host := range toHosts {
-		trans, addr := SplitTransportHost(host)
-		log.Infof("Transport: %v Address: %v", trans, addr)
+	var static []string
+	for _, arg := range args {
+		if strings.HasPrefix(strings.ToLower(arg), srvScheme) {
+			if annotated {
+				return c.Errf("%q can't be annotated with priority or weight, which come from SRV records", arg)
+			}
+			// SRV names contain underscores, thus stringToDomain() isn't applicable
+			name := strings.ToLower(arg[len(srvScheme):])
+			if _, ok := dns.IsDomainName(name); !ok || dns.CountLabel(name) == 0 {
+				return c.Errf("%q isn't a valid SRV name", arg)
+			}
+			u.srvNames = append(u.srvNames, dns.Fqdn(name))
+			log.Infof("SRV discovery: %v", name)
+			continue
+		}
+		static = append(static, arg)
+	}
+	if len(static) == 0 {
+		return nil
+	}
 
-		uh := &UpstreamHost{
-			proto: trans,
-			// Not an error, host and tls server name will be separated later
-			addr:     addr,
-			downFunc: checkDownFunc(u),
+	for _, arg := range static {
+		// A host may be a transport fallback chain, see: fallbackSeparator
+		links, err := HostPort(strings.Split(arg, fallbackSeparator))
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+
+		var chain []*UpstreamHost
+		for _, link := range links {
+			trans, addr := SplitTransportHost(link)
+			log.Infof("Transport: %v Address: %v", trans, addr)
+
+			chain = append(chain, &UpstreamHost{
+				proto: trans,
+				// Not an error, host and tls server name will be separated later
+				addr:     addr,
+				downFunc: checkDownFunc(u),
+				priority: priority,
+				weight:   weight,
+			})
+		}
+		uh := chain[0]
+		if len(chain) > 1 {
+			uh.fallbacks = chain[1:]
 		}
 		u.hosts = append(u.hosts, uh)
 
@@ -583,6 +1897,40 @@ func parseBootstrap(c *caddy.Controller, u *reloadableUpstream) error {
 	return nil
 }
 
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Convert cipher suite names(e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) to IDs
+// see: https://golang.org/pkg/crypto/tls/#pkg-constants
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	insecure := make(map[string]uint16)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = suite.ID
+	}
+
+	var ciphers []uint16
+	for _, name := range names {
+		name = strings.ToUpper(name)
+		if id, ok := known[name]; ok {
+			ciphers = append(ciphers, id)
+		} else if id, ok := insecure[name]; ok {
+			log.Warningf("Cipher suite %v is insecure", name)
+			ciphers = append(ciphers, id)
+		} else {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+	}
+	return ciphers, nil
+}
+
 const (
 	defaultMaxFails = 3
 
@@ -592,13 +1940,31 @@ const (
 
 	defaultHcInterval = 2000 * time.Millisecond
 	defaultHcTimeout  = 5000 * time.Millisecond
+
+	defaultSrvRefresh = 30 * time.Second
 )
 
 const (
 	minPathReloadInterval = 1 * time.Second
 	minUrlReloadInterval  = 15 * time.Second
 	minUrlReadTimeout     = 3 * time.Second
+	minExchangeTimeout    = 10 * time.Millisecond
+
+	minHcInterval        = 1 * time.Second
+	minHcTimeout         = 100 * time.Millisecond
+	minExpireInterval    = 1 * time.Second
+	minDialTimeoutOption = 100 * time.Millisecond
+	minRecoveryRamp      = 1 * time.Second
+	minBreakerCooldown   = 1 * time.Second
+	minSockBufSize       = 1024
+	minSrvRefresh        = 1 * time.Second
+	minSlowLog           = 1 * time.Millisecond
+	minOnInitHold        = 10 * time.Millisecond
+	defaultBloomRate     = 0.01
+	defaultLogMismatch   = 256
+	maxBloomRate         = 0.5
+	defaultOnInitHold    = 2 * time.Second
 
-	minHcInterval     = 1 * time.Second
-	minExpireInterval = 1 * time.Second
+	// TCP idle timeout of the DNS server, taken from github.com/miekg/dns/server.go
+	tcpIdleTimeout = 8 * time.Second
 )
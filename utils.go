@@ -2,15 +2,18 @@ package dnsredir
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
 	"hash/fnv"
 	"io"
 	"io/ioutil"
-	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -88,6 +91,19 @@ func isDomainName(s string) bool {
 	return true
 }
 
+// Convert RCODE name(e.g. REFUSED) or number to RCODE value
+func stringToRcode(s string) (int, bool) {
+	if rcode, ok := dns.StringToRcode[strings.ToUpper(s)]; ok {
+		return rcode, true
+	}
+	rcode, err := strconv.Atoi(s)
+	// Extended RCODE is 12-bit, see: https://tools.ietf.org/html/rfc6891#section-6.1.3
+	if err != nil || rcode < 0 || rcode > 0xfff {
+		return 0, false
+	}
+	return rcode, true
+}
+
 func removeTrailingDot(s string) string {
 	if n := len(s); n > 0 && s[n-1] == '.' {
 		return s[:n-1]
@@ -126,22 +142,28 @@ func isContentType(contentType string, h *http.Header) bool {
 // see:
 //	https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
 //	https://medium.com/@nate510/don-t-use-go-s-default-http-client-4804cb19f779
-func getUrlContent(theUrl, contentType string, bootstrap []string, timeout time.Duration) (string, error) {
+func getUrlContent(theUrl, contentType string, bootstrap []string, timeout time.Duration, ua string) (string, error) {
+	return getUrlContentIfModified(theUrl, contentType, bootstrap, timeout, ua, nil)
+}
+
+// HTTP cache validators of the last fetched content of a URL, see: https://tools.ietf.org/html/rfc7232
+type urlValidators struct {
+	etag         string
+	lastModified string
+}
+
+// Returned by getUrlContentIfModified() if content of the URL is unchanged since last fetch
+var errNotModified = errors.New("not modified")
+
+// Fetch content of the URL conditionally with validators `v'(if any), which are updated with the response
+// errNotModified is returned if the server replied 304 Not Modified, thus an unchanged list isn't downloaded again.
+func getUrlContentIfModified(theUrl, contentType string, bootstrap []string, timeout time.Duration, ua string, v *urlValidators) (string, error) {
 	var transport http.RoundTripper
 
 	if len(bootstrap) != 0 {
-		resolver := &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				var d net.Dialer
-				// Randomly choose a bootstrap DNS to resolve upstream host(if any)
-				addr := bootstrap[rand.Intn(len(bootstrap))]
-				return d.DialContext(ctx, network, addr)
-			},
-		}
 		dialer := &net.Dialer{
 			Timeout:  timeout,
-			Resolver: resolver,
+			Resolver: bootstrapResolver(bootstrap, ipAny),
 		}
 		// see: http.DefaultTransport
 		transport = &http.Transport{
@@ -161,8 +183,19 @@ func getUrlContent(theUrl, contentType string, bootstrap []string, timeout time.
 	if err != nil {
 		return "", err
 	}
-	// Set a fake user agent in case of access denied error
-	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:80.0) Gecko/20100101 Firefox/80.0")
+	if ua == "" {
+		// Identify ourselves as DoH requests do, so providers can tell who's fetching, see: user_agent
+		ua = userAgent
+	}
+	req.Header.Set("User-Agent", ua)
+	if v != nil {
+		if v.etag != "" {
+			req.Header.Set("If-None-Match", v.etag)
+		}
+		if v.lastModified != "" {
+			req.Header.Set("If-Modified-Since", v.lastModified)
+		}
+	}
 
 	c := &http.Client{
 		Transport: transport, // [sic] If nil, DefaultTransport is used.
@@ -174,6 +207,9 @@ func getUrlContent(theUrl, contentType string, bootstrap []string, timeout time.
 	}
 	defer Close(resp.Body)
 
+	if resp.StatusCode == http.StatusNotModified && v != nil {
+		return "", errNotModified
+	}
 	if resp.StatusCode != http.StatusOK {
 		return "", fmt.Errorf("bad status code: %v", resp.StatusCode)
 	}
@@ -182,7 +218,7 @@ func getUrlContent(theUrl, contentType string, bootstrap []string, timeout time.
 		if theUrl, err = fixUrl(theUrl, resp.Header); err != nil {
 			return "", err
 		} else {
-			return getUrlContent(theUrl, contentType, bootstrap, timeout)
+			return getUrlContentIfModified(theUrl, contentType, bootstrap, timeout, ua, v)
 		}
 	}
 
@@ -190,10 +226,35 @@ func getUrlContent(theUrl, contentType string, bootstrap []string, timeout time.
 	if err != nil {
 		return "", err
 	}
+	if v != nil {
+		v.etag = resp.Header.Get("ETag")
+		v.lastModified = resp.Header.Get("Last-Modified")
+	}
 	// We don't use http.DetectContentType()
 	return string(content), nil
 }
 
+// Fetch name list content from TXT records of `name', each TXT record holds lines separated by commas
+//	e.g. "example.com corp,example.net vpn"
+// Multiple strings of a TXT record are concatenated, see: https://tools.ietf.org/html/rfc7208#section-3.3
+func getTxtContent(name string, bootstrap []string, timeout time.Duration) (string, error) {
+	resolver := bootstrapResolver(bootstrap, ipAny)
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// Fully qualified, so search domains won't be appended
+	txts, err := resolver.LookupTXT(ctx, dns.Fqdn(name))
+	if err != nil {
+		return "", err
+	}
+	// Sort records since their order varies between queries, which changes content hash otherwise
+	sort.Strings(txts)
+	return strings.ReplaceAll(strings.Join(txts, "\n"), ",", "\n"), nil
+}
+
 func fixUrl(theUrl string, h http.Header) (string, error) {
 	const LocationKey = "Location"
 	location := h.Get(LocationKey)
@@ -1,7 +1,12 @@
 package dnsredir
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestStringToDomain(t *testing.T) {
@@ -59,3 +64,56 @@ func TestStringToDomain(t *testing.T) {
 		}
 	}
 }
+
+func TestGetUrlContentUserAgent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintln(w, r.UserAgent())
+	}))
+	defer srv.Close()
+
+	content, err := getUrlContent(srv.URL, "", nil, 3*time.Second, "dnsredir-test/1.0")
+	if err != nil {
+		t.Fatalf("getUrlContent() failed: %v", err)
+	}
+	if ua := strings.TrimSpace(content); ua != "dnsredir-test/1.0" {
+		t.Fatalf("Expected custom User-Agent, got %q", ua)
+	}
+
+	content, err = getUrlContent(srv.URL, "", nil, 3*time.Second, "")
+	if err != nil {
+		t.Fatalf("getUrlContent() failed: %v", err)
+	}
+	if ua := strings.TrimSpace(content); ua != userAgent {
+		t.Fatalf("Expected default User-Agent, got %q", ua)
+	}
+}
+
+func TestGetUrlContentIfModified(t *testing.T) {
+	const etag = `"v1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Wed, 14 Oct 2026 00:00:00 GMT")
+		_, _ = fmt.Fprintln(w, "example.com")
+	}))
+	defer srv.Close()
+
+	var v urlValidators
+	content, err := getUrlContentIfModified(srv.URL, "", nil, 3*time.Second, "", &v)
+	if err != nil || strings.TrimSpace(content) != "example.com" {
+		t.Fatalf("getUrlContentIfModified() failed  content: %q error: %v", content, err)
+	}
+	if v.etag != etag || v.lastModified == "" {
+		t.Fatalf("Unexpected validators %+v", v)
+	}
+	if _, err := getUrlContentIfModified(srv.URL, "", nil, 3*time.Second, "", &v); err != errNotModified {
+		t.Fatalf("Expected %v, got %v", errNotModified, err)
+	}
+	// Unconditional fetch always downloads the content
+	if content, err := getUrlContent(srv.URL, "", nil, 3*time.Second, ""); err != nil || content == "" {
+		t.Fatalf("getUrlContent() failed  content: %q error: %v", content, err)
+	}
+}